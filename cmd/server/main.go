@@ -9,7 +9,19 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/dendianugerah/reubah/internal/archive"
+	"github.com/dendianugerah/reubah/internal/cache"
+	"github.com/dendianugerah/reubah/internal/config"
 	"github.com/dendianugerah/reubah/internal/handlers"
+	"github.com/dendianugerah/reubah/internal/jobs"
+	"github.com/dendianugerah/reubah/internal/processor/background"
+	"github.com/dendianugerah/reubah/internal/processor/document"
+	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/proxy"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/internal/validator"
+	"github.com/dendianugerah/reubah/internal/webhook"
 	"github.com/gorilla/mux"
 )
 
@@ -17,16 +29,73 @@ func main() {
 	// Initialize logger
 	logger := log.New(os.Stdout, "[REUBAH] ", log.LstdFlags|log.Lshortfile)
 
+	// Load the configuration file named by REUBAH_CONFIG and the
+	// environment
+	cfg, err := config.Load(os.Getenv("REUBAH_CONFIG"))
+	if err != nil {
+		logger.Fatalf("Invalid configuration: %v", err)
+	}
+	applyConfig(cfg)
+
+	// Setup the processed-result cache
+	resultCache, err := cache.New(cfg.Cache.Backend, cfg.Cache.Dir, cfg.Cache.SizeMB<<20)
+	if err != nil {
+		logger.Fatalf("Invalid cache configuration: %v", err)
+	}
+	handlers.SetCache(resultCache)
+
+	// Setup the background removal backend
+	remover, err := background.New(cfg.Background.Remover, background.RembgConfig{
+		Command: cfg.Background.RembgCommand,
+		URL:     cfg.Background.RembgURL,
+		Timeout: time.Duration(cfg.Background.RembgTimeout),
+	})
+	if err != nil {
+		logger.Fatalf("Invalid background remover configuration: %v", err)
+	}
+	handlers.SetBackgroundRemover(remover)
+
+	// Setup the expiring storage of API and job results
+	results, err := storage.New(cfg.API.ResultDir, time.Duration(cfg.API.ResultTTL))
+	if err != nil {
+		logger.Fatalf("Invalid result storage: %v", err)
+	}
+
+	// Setup the queue of asynchronous requests
+	queue := jobs.New(jobs.Options{
+		Workers:   cfg.Jobs.Workers,
+		QueueSize: cfg.Jobs.QueueSize,
+		TTL:       time.Duration(cfg.Jobs.TTL),
+	})
+	handlers.SetJobs(queue, results, cfg.API.BaseURL)
+
+	// Setup the callbacks posted when jobs end
+	var webhooks *webhook.Dispatcher
+	if cfg.Webhooks.Secret != "" {
+		webhooks = webhook.New(webhook.Options{
+			Secret:       string(cfg.Webhooks.Secret),
+			Attempts:     cfg.Webhooks.Attempts,
+			Backoff:      time.Duration(cfg.Webhooks.Backoff),
+			Timeout:      time.Duration(cfg.Webhooks.Timeout),
+			AllowPrivate: cfg.Webhooks.PrivateURLs,
+			LogTTL:       time.Duration(cfg.Jobs.TTL),
+		})
+		handlers.SetWebhooks(webhooks)
+	}
+
 	// Create router and setup routes
 	r := setupRouter()
+	setupTransformRoute(r, cfg, logger)
+	setupAPIRoutes(r, cfg, results, logger)
+	setupAdminRoutes(r, cfg, logger)
 
 	// Create server with timeouts and other configurations
 	srv := &http.Server{
 		Handler:        r,
-		Addr:           getPort(),
-		WriteTimeout:   15 * time.Second,
-		ReadTimeout:    15 * time.Second,
-		IdleTimeout:    60 * time.Second,
+		Addr:           cfg.Server.Addr,
+		WriteTimeout:   time.Duration(cfg.Server.WriteTimeout),
+		ReadTimeout:    time.Duration(cfg.Server.ReadTimeout),
+		IdleTimeout:    time.Duration(cfg.Server.IdleTimeout),
 		MaxHeaderBytes: 1 << 20, // 1MB
 	}
 
@@ -52,16 +121,28 @@ func main() {
 		logger.Printf("Start shutdown... \nSignal: %v", sig)
 
 		// Give outstanding requests a deadline for completion.
-		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		shutdownTimeout := time.Duration(cfg.Server.ShutdownTimeout)
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
 		defer cancel()
 
 		// Asking listener to shut down and shed load.
 		if err := srv.Shutdown(ctx); err != nil {
-			logger.Printf("Graceful shutdown did not complete in %v : %v", 15*time.Second, err)
+			logger.Printf("Graceful shutdown did not complete in %v : %v", shutdownTimeout, err)
 			if err := srv.Close(); err != nil {
 				logger.Fatalf("Could not stop server gracefully : %v", err)
 			}
 		}
+
+		// Let running jobs finish within what is left of the deadline
+		if err := queue.Shutdown(ctx); err != nil {
+			logger.Printf("Jobs did not complete in %v : %v", shutdownTimeout, err)
+		}
+		if webhooks != nil {
+			if err := webhooks.Shutdown(ctx); err != nil {
+				logger.Printf("Callbacks were not delivered in %v : %v", shutdownTimeout, err)
+			}
+		}
+		results.Close()
 	}
 }
 
@@ -82,12 +163,71 @@ func setupRouter() *mux.Router {
 	// Routes
 	r.HandleFunc("/", handlers.ShowUploadForm).Methods("GET")
 	r.HandleFunc("/process", handlers.ProcessImage).Methods("POST")
+	r.HandleFunc("/process/batch", handlers.ProcessBatch).Methods("POST")
 	r.HandleFunc("/process/merge-pdf", handlers.MergePDF).Methods("POST")
 	r.HandleFunc("/process/document", handlers.ConvertDocument).Methods("POST")
+	r.HandleFunc("/compare", handlers.CompareImages).Methods("POST")
+	r.HandleFunc("/inspect", handlers.InspectImage).Methods("POST")
+	r.HandleFunc("/hash", handlers.HashImages).Methods("POST")
+	r.HandleFunc("/palette", handlers.ExtractPalette).Methods("POST")
+	r.HandleFunc("/jobs/{id}", handlers.GetJob).Methods("GET")
+	r.HandleFunc("/jobs/{id}/result", handlers.GetJobResult).Methods("GET")
+	r.HandleFunc("/jobs/{id}/deliveries", handlers.GetJobDeliveries).Methods("GET")
 
 	return r
 }
 
+// setupTransformRoute enables the /img/ transformation endpoint when an
+// origin and a signing key are configured
+func setupTransformRoute(r *mux.Router, cfg *config.Config, logger *log.Logger) {
+	if cfg.Proxy.Origin == "" {
+		return
+	}
+
+	if cfg.Proxy.SigningKey == "" {
+		logger.Printf("An origin is set but the signing key is empty, transformation endpoint disabled")
+		return
+	}
+
+	origin, err := proxy.NewOrigin(cfg.Proxy.Origin, proxy.OriginOptions{
+		Timeout: time.Duration(cfg.Proxy.Timeout),
+		MaxSize: cfg.Limits.MaxFileSizeMB << 20,
+	})
+	if err != nil {
+		logger.Fatalf("Invalid image origin: %v", err)
+	}
+
+	r.PathPrefix(handlers.TransformPrefix).Handler(
+		handlers.NewTransformHandler(origin, proxy.NewSigner(string(cfg.Proxy.SigningKey))),
+	).Methods("GET", "HEAD")
+	logger.Printf("Transformation endpoint enabled for origin %s", cfg.Proxy.Origin)
+}
+
+// setupAPIRoutes mounts the versioned JSON API
+func setupAPIRoutes(r *mux.Router, cfg *config.Config, results *storage.Store, logger *log.Logger) {
+	opts := handlers.APIOptions{BaseURL: cfg.API.BaseURL}
+	if cfg.API.URLSources {
+		opts.Fetcher = upload.NewFetcher(time.Duration(cfg.API.FetchTimeout), cfg.API.PrivateURLs)
+	}
+	api, err := handlers.NewAPIHandler(results, opts)
+	if err != nil {
+		logger.Fatalf("Failed to set up the API: %v", err)
+	}
+	r.PathPrefix(handlers.APIPrefix + "/").Handler(api)
+}
+
+// setupAdminRoutes enables the admin endpoints when an admin token is
+// configured
+func setupAdminRoutes(r *mux.Router, cfg *config.Config, logger *log.Logger) {
+	if cfg.Admin.Token == "" {
+		return
+	}
+
+	admin := handlers.NewAdminHandler(string(cfg.Admin.Token), cfg)
+	r.HandleFunc("/admin/config", admin.Config).Methods("GET")
+	logger.Printf("Admin endpoints enabled")
+}
+
 // Middleware functions
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -131,9 +271,45 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 // 	})
 // }
 
-func getPort() string {
-	if port := os.Getenv("PORT"); port != "" {
-		return ":" + port
+// applyConfig hands the configured limits, defaults and tool settings to
+// the packages that use them
+func applyConfig(cfg *config.Config) {
+	if cfg.Server.TempDir != "" {
+		// Also picked up by os.TempDir and the external tools
+		os.Setenv("TMPDIR", cfg.Server.TempDir)
 	}
-	return ":8081"
+
+	endpoints := map[string]upload.Limits{}
+	for _, endpoint := range config.Endpoints {
+		endpoints[endpoint] = uploadLimits(cfg, cfg.Limits.Upload(endpoint))
+	}
+	handlers.SetUploadLimits(uploadLimits(cfg, cfg.Limits.UploadLimits), endpoints)
+	handlers.SetArchiveOptions(archive.Options{
+		MaxEntries:   cfg.Limits.MaxArchiveEntries,
+		MaxTotalSize: cfg.Limits.MaxArchiveMB << 20,
+		MaxDepth:     cfg.Limits.MaxArchiveDepth,
+	})
+
+	handlers.SetDefaults(handlers.Defaults{
+		Format:     cfg.Defaults.Format,
+		Quality:    cfg.Defaults.Quality,
+		ResizeMode: cfg.Defaults.ResizeMode,
+		PDFQuality: cfg.Defaults.PDFQuality,
+	})
+	handlers.SetBatchWorkers(cfg.Batch.Workers)
+	resize.SetMaxDimensions(cfg.Limits.MaxWidth, cfg.Limits.MaxHeight)
+	validator.SetMaxPixels(int64(cfg.Limits.MaxMegapixels * 1e6))
+	document.SetOffice(document.Office{
+		Command: cfg.Document.OfficeCommand,
+		Timeout: time.Duration(cfg.Document.Timeout),
+	})
+}
+
+func uploadLimits(cfg *config.Config, l config.UploadLimits) upload.Limits {
+	limits := upload.DefaultLimits()
+	limits.MaxFileSize = l.MaxFileSizeMB << 20
+	limits.MaxTotalSize = l.MaxUploadMB << 20
+	limits.MaxFiles = l.MaxFiles
+	limits.Dir = cfg.Server.TempDir
+	return limits
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/webhook"
+)
+
+// main runs a local stand-in for a callback receiver. It checks the
+// signature of every callback and logs its payload, and can fail the first
+// deliveries to exercise the retries of the server.
+func main() {
+	addr := flag.String("addr", ":8082", "address to listen on")
+	secret := flag.String("secret", os.Getenv("REUBAH_WEBHOOK_SECRET"), "webhook secret of the server")
+	failures := flag.Int("fail", 0, "answer the first N deliveries with 503")
+	tolerance := flag.Duration("tolerance", 5*time.Minute, "maximum age of a delivery")
+	flag.Parse()
+
+	if *secret == "" {
+		log.Fatal("Set -secret or REUBAH_WEBHOOK_SECRET")
+	}
+
+	var mu sync.Mutex
+	received := 0
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id := r.Header.Get(webhook.DeliveryHeader)
+		if err := webhook.Verify([]byte(*secret), r.Header, body, *tolerance); err != nil {
+			log.Printf("Rejected delivery %s: %v", id, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		mu.Lock()
+		received++
+		n := received
+		mu.Unlock()
+		if n <= *failures {
+			log.Printf("Failing delivery %s (%d of %d)", id, n, *failures)
+			http.Error(w, "failing on purpose", http.StatusServiceUnavailable)
+			return
+		}
+
+		var pretty bytes.Buffer
+		json.Indent(&pretty, body, "", "  ")
+		log.Printf("Delivery %s, event %s:\n%s", id, r.Header.Get(webhook.EventHeader), pretty.String())
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	log.Printf("Receiving callbacks on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
@@ -0,0 +1,356 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Format is the container format of an archive
+type Format string
+
+const (
+	FormatZip   Format = "zip"
+	FormatTar   Format = "tar"
+	FormatTarGz Format = "tar.gz"
+)
+
+// Signatures of the supported formats. An empty ZIP has only its end of
+// central directory record.
+var (
+	zipMagic      = []byte("PK\x03\x04")
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1f, 0x8b}
+	tarMagic      = []byte("ustar")
+)
+
+// tarMagicOffset is where the ustar magic sits in the first tar header
+const tarMagicOffset = 257
+
+// Options bound the expansion of the archives of one request
+type Options struct {
+	// MaxEntries bounds the entries read, directories included
+	MaxEntries int
+	// MaxTotalSize bounds the bytes extracted, whatever the archives claim
+	// about their contents
+	MaxTotalSize int64
+	// MaxDepth is how many levels of archives are expanded, deeper ones
+	// being rejected. 1 rejects any archive within an archive.
+	MaxDepth int
+	// Sorted orders the entries of each archive by natural filename order,
+	// so page10 follows page9, instead of the order they were archived in
+	Sorted bool
+}
+
+// DefaultOptions returns the options used unless configured otherwise
+func DefaultOptions() Options {
+	return Options{MaxEntries: 1000, MaxTotalSize: 1 << 30, MaxDepth: 2}
+}
+
+// Detect returns the format of file, empty when it isn't an archive
+func Detect(file *upload.File) (Format, error) {
+	f, err := file.Open()
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, tarMagicOffset+len(tarMagic))
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	switch {
+	case bytes.HasPrefix(head, zipMagic), bytes.HasPrefix(head, emptyZipMagic):
+		return FormatZip, nil
+	case isTar(head):
+		return FormatTar, nil
+	case bytes.HasPrefix(head, gzipMagic):
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return "", err
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return "", nil
+		}
+		defer gz.Close()
+		head = head[:cap(head)]
+		n, _ := io.ReadFull(gz, head)
+		if isTar(head[:n]) {
+			return FormatTarGz, nil
+		}
+	}
+	return "", nil
+}
+
+func isTar(head []byte) bool {
+	return len(head) >= tarMagicOffset+len(tarMagic) && bytes.Equal(head[tarMagicOffset:], tarMagic)
+}
+
+// Expand replaces the archives uploaded as field by the files they contain,
+// keeping their place among the other uploads. Archives found inside are
+// expanded as well, down to opts.MaxDepth levels, and their entries are
+// named below the entry that held them. Entries are spooled to form but
+// bounded by opts rather than its count and total limits, which apply to
+// the archives as uploaded.
+func Expand(form *upload.Form, field string, opts Options) error {
+	e := &expansion{form: form, field: field, opts: opts}
+	uploaded := form.File[field]
+	form.File[field] = nil
+	for _, file := range uploaded {
+		// Expanding removes the archive again and adds its entries in its
+		// place
+		form.File[field] = append(form.File[field], file)
+		if err := e.expandFile(file, "", 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Contains reports whether one of files is an archive
+func Contains(files []*upload.File) (bool, error) {
+	for _, file := range files {
+		format, err := Detect(file)
+		if err != nil {
+			return false, errors.New(errors.ErrProcessingFailed, "Failed to open "+file.Filename, err)
+		}
+		if format != "" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expansion counts what the archives of one request expanded to
+type expansion struct {
+	form    *upload.Form
+	field   string
+	opts    Options
+	entries int
+	total   int64
+}
+
+// expandFile expands file, the last upload of the field, if it is an
+// archive, naming its entries below prefix. depth is the level of archives
+// file would be expanded at.
+func (e *expansion) expandFile(file *upload.File, prefix string, depth int) error {
+	format, err := Detect(file)
+	if err != nil {
+		return errors.New(errors.ErrProcessingFailed, "Failed to open "+file.Filename, err)
+	}
+	if format == "" {
+		return nil
+	}
+	if depth > e.opts.MaxDepth {
+		return errors.New(errors.ErrInvalidFormat,
+			fmt.Sprintf("Archive %s is nested more than %d levels deep", file.Filename, e.opts.MaxDepth), nil)
+	}
+
+	f, err := file.Open()
+	if err != nil {
+		return errors.New(errors.ErrProcessingFailed, "Failed to open "+file.Filename, err)
+	}
+	defer f.Close()
+	// The open file stays readable once removed
+	if err := e.form.Remove(e.field, file); err != nil {
+		return errors.New(errors.ErrProcessingFailed, "Failed to remove "+file.Filename, err)
+	}
+
+	start := len(e.form.File[e.field])
+	switch format {
+	case FormatZip:
+		reader, err := zip.NewReader(f, file.Size)
+		if err != nil {
+			return errors.New(errors.ErrInvalidFormat, "Invalid ZIP archive: "+file.Filename, err)
+		}
+		if err := e.expandZip(reader, prefix, depth); err != nil {
+			return err
+		}
+	case FormatTar:
+		if err := e.expandTar(tar.NewReader(f), file.Filename, prefix, depth); err != nil {
+			return err
+		}
+	case FormatTarGz:
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return errors.New(errors.ErrInvalidFormat, "Invalid gzip archive: "+file.Filename, err)
+		}
+		defer gz.Close()
+		if err := e.expandTar(tar.NewReader(gz), file.Filename, prefix, depth); err != nil {
+			return err
+		}
+	}
+
+	if e.opts.Sorted {
+		entries := e.form.File[e.field][start:]
+		sort.SliceStable(entries, func(i, j int) bool {
+			return NaturalLess(entries[i].Filename, entries[j].Filename)
+		})
+	}
+	return nil
+}
+
+func (e *expansion) expandZip(reader *zip.Reader, prefix string, depth int) error {
+	for _, entry := range reader.File {
+		if err := e.count(); err != nil {
+			return err
+		}
+		if !entry.Mode().IsRegular() || skipEntry(entry.Name) {
+			continue
+		}
+		rc, err := entry.Open()
+		if err != nil {
+			return errors.New(errors.ErrInvalidFormat, "Invalid ZIP entry: "+entry.Name, err)
+		}
+		err = e.add(entry.Name, prefix, rc, depth)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *expansion) expandTar(reader *tar.Reader, filename, prefix string, depth int) error {
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(errors.ErrInvalidFormat, "Invalid tar archive: "+filename, err)
+		}
+		if err := e.count(); err != nil {
+			return err
+		}
+		// Links and devices are skipped along with directories
+		if header.Typeflag != tar.TypeReg || skipEntry(header.Name) {
+			continue
+		}
+		if err := e.add(header.Name, prefix, reader, depth); err != nil {
+			return err
+		}
+	}
+}
+
+// add spools the entry name read from r and expands it in turn if it is an
+// archive
+func (e *expansion) add(name, prefix string, r io.Reader, depth int) error {
+	clean, err := safeName(name)
+	if err != nil {
+		return err
+	}
+	if err := e.form.AddExtracted(e.field, prefix+clean, textproto.MIMEHeader{}, &countingReader{r: r, e: e}); err != nil {
+		return err
+	}
+	files := e.form.File[e.field]
+	added := files[len(files)-1]
+	return e.expandFile(added, added.Filename+"/", depth+1)
+}
+
+func (e *expansion) count() error {
+	e.entries++
+	if e.entries > e.opts.MaxEntries {
+		return errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("Archives have too many entries, at most %d are allowed", e.opts.MaxEntries), nil)
+	}
+	return nil
+}
+
+// countingReader fails once the archives of an expansion extracted more
+// than their total size limit
+type countingReader struct {
+	r io.Reader
+	e *expansion
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.e.total += int64(n)
+	if c.e.total > c.e.opts.MaxTotalSize {
+		return n, errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("Archives expand to more than the allowed %dMB", c.e.opts.MaxTotalSize>>20), nil)
+	}
+	return n, err
+}
+
+// safeName returns the cleaned path of an entry, refusing absolute paths and
+// paths that climb out of the archive, so no entry name can point outside
+// of it even if it is ever used on disk
+func safeName(name string) (string, error) {
+	slashed := strings.ReplaceAll(name, "\\", "/")
+	unsafe := strings.ContainsRune(slashed, 0) || path.IsAbs(slashed) ||
+		(len(slashed) >= 2 && slashed[1] == ':')
+	for _, element := range strings.Split(slashed, "/") {
+		if element == ".." {
+			unsafe = true
+		}
+	}
+	if unsafe {
+		return "", errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Unsafe path in archive: %q", name), nil)
+	}
+	return path.Clean(slashed), nil
+}
+
+// skipEntry reports whether an entry is metadata added by the archiver,
+// such as the resource forks macOS stores under __MACOSX or hidden files
+func skipEntry(name string) bool {
+	if strings.HasPrefix(name, "__MACOSX/") {
+		return true
+	}
+	return strings.HasPrefix(path.Base(name), ".")
+}
+
+// NaturalLess orders filenames the way people number them: runs of digits
+// compare by value, so page2 sorts before page10, and letters compare
+// regardless of case
+func NaturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		chunkA, restA := leadingChunk(a)
+		chunkB, restB := leadingChunk(b)
+		if chunkA != chunkB {
+			digitsA, digitsB := isDigit(chunkA[0]), isDigit(chunkB[0])
+			if digitsA && digitsB {
+				valueA, valueB := strings.TrimLeft(chunkA, "0"), strings.TrimLeft(chunkB, "0")
+				if len(valueA) != len(valueB) {
+					return len(valueA) < len(valueB)
+				}
+				if valueA != valueB {
+					return valueA < valueB
+				}
+				// Same value, fewer leading zeros first
+				return len(chunkA) < len(chunkB)
+			}
+			lowerA, lowerB := strings.ToLower(chunkA), strings.ToLower(chunkB)
+			if lowerA != lowerB {
+				return lowerA < lowerB
+			}
+			return chunkA < chunkB
+		}
+		a, b = restA, restB
+	}
+	return len(a) < len(b)
+}
+
+// leadingChunk splits s after its leading run of digits or non-digits
+func leadingChunk(s string) (string, string) {
+	digits := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
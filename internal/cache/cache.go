@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cache stores encoded results by content-addressed key
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// Backend names accepted by New
+const (
+	BackendMemory = "memory"
+	BackendDisk   = "disk"
+	BackendNone   = "none"
+)
+
+// New creates a cache for the named backend. maxBytes bounds the total size
+// of stored values; dir is only used by the disk backend.
+func New(backend, dir string, maxBytes int64) (Cache, error) {
+	switch strings.ToLower(backend) {
+	case BackendMemory, "":
+		return NewMemory(maxBytes), nil
+	case BackendDisk:
+		return NewDisk(dir, maxBytes)
+	case BackendNone, "off":
+		return Nop{}, nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend: %s", backend)
+	}
+}
+
+// Nop is a cache that stores nothing
+type Nop struct{}
+
+func (Nop) Get(string) ([]byte, bool) { return nil, false }
+func (Nop) Set(string, []byte)        {}
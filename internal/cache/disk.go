@@ -0,0 +1,185 @@
+package cache
+
+import (
+	"container/list"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Disk stores values as files in a directory, evicting the least recently
+// used files once the total size exceeds the budget. The sizes and order of
+// use of the files are kept in memory, read from the directory once when
+// the cache is created.
+type Disk struct {
+	mu       sync.Mutex
+	dir      string
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type diskEntry struct {
+	key  string
+	size int64
+}
+
+func NewDisk(dir string, maxBytes int64) (*Disk, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "reubah-cache")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	c := &Disk{
+		dir:      dir,
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+	// Index entries left over from a previous run, most recently used first
+	files := c.files()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.After(files[j].modTime)
+	})
+	for _, f := range files {
+		c.entries[f.key] = c.order.PushBack(&diskEntry{key: f.key, size: f.size})
+		c.size += f.size
+	}
+	if c.size > c.maxBytes {
+		c.evict()
+	}
+	return c, nil
+}
+
+func (c *Disk) Get(key string) ([]byte, bool) {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if err != nil {
+		// Forget entries removed behind our back
+		if ok && os.IsNotExist(err) {
+			c.removeElement(elem)
+		}
+		return nil, false
+	}
+	if ok {
+		c.order.MoveToFront(elem)
+	}
+
+	// Modification time doubles as the last access time for the order of
+	// the next run
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+func (c *Disk) Set(key string, value []byte) {
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		log.Printf("cache: failed to create directory: %v", err)
+		return
+	}
+
+	// Write to a temporary file first so readers never see partial entries
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		log.Printf("cache: failed to create entry: %v", err)
+		return
+	}
+	if _, err := tmp.Write(value); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		log.Printf("cache: failed to write entry: %v", err)
+		return
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("cache: failed to store entry: %v", err)
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+	c.entries[key] = c.order.PushFront(&diskEntry{key: key, size: int64(len(value))})
+	c.size += int64(len(value))
+
+	if c.size > c.maxBytes {
+		c.evict()
+	}
+}
+
+// path shards entries by key prefix to keep directories small
+func (c *Disk) path(key string) string {
+	if len(key) < 4 {
+		return filepath.Join(c.dir, key)
+	}
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+type diskFile struct {
+	key     string
+	size    int64
+	modTime time.Time
+}
+
+// files lists the entries in the cache directory, removing temporary files
+// of writes that never finished
+func (c *Disk) files() []diskFile {
+	var files []diskFile
+	filepath.WalkDir(c.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".tmp-") {
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, diskFile{key: d.Name(), size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	return files
+}
+
+// lowWaterPercent is how full eviction leaves the cache, so that it doesn't
+// evict again on each of the next writes
+const lowWaterPercent = 90
+
+// evict removes the least recently used entries until the cache is back
+// under lowWaterPercent of its budget
+func (c *Disk) evict() {
+	target := c.maxBytes / 100 * lowWaterPercent
+	for c.size > target && c.order.Len() > 0 {
+		elem := c.order.Back()
+		os.Remove(c.path(elem.Value.(*diskEntry).key))
+		c.removeElement(elem)
+	}
+}
+
+func (c *Disk) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*diskEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+)
+
+// Memory is an in-memory LRU cache bounded by the total size of its values
+type Memory struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+}
+
+type memoryEntry struct {
+	key   string
+	value []byte
+}
+
+func NewMemory(maxBytes int64) *Memory {
+	return &Memory{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *Memory) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*memoryEntry).value, true
+}
+
+func (c *Memory) Set(key string, value []byte) {
+	// Values larger than the whole budget would only evict everything else
+	if int64(len(value)) > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*memoryEntry)
+		c.size += int64(len(value)) - int64(len(entry.value))
+		entry.value = value
+		c.order.MoveToFront(elem)
+	} else {
+		c.entries[key] = c.order.PushFront(&memoryEntry{key: key, value: value})
+		c.size += int64(len(value))
+	}
+
+	for c.size > c.maxBytes {
+		c.removeElement(c.order.Back())
+	}
+}
+
+func (c *Memory) removeElement(elem *list.Element) {
+	entry := c.order.Remove(elem).(*memoryEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.value))
+}
@@ -0,0 +1,408 @@
+package config
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/archive"
+	"github.com/dendianugerah/reubah/internal/cache"
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/dendianugerah/reubah/internal/jobs"
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/processor/background"
+	"github.com/dendianugerah/reubah/internal/processor/document"
+	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/proxy"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/internal/webhook"
+)
+
+// Endpoints that accept uploads and can have their own upload limits
+var Endpoints = []string{"process", "batch", "document", "merge-pdf", "compare", "inspect", "hash", "palette"}
+
+// Config holds the server settings. Load fills it from the defaults, an
+// optional JSON file and environment variables, later sources overriding
+// earlier ones.
+type Config struct {
+	Server     Server     `json:"server"`
+	Limits     Limits     `json:"limits"`
+	Defaults   Defaults   `json:"defaults"`
+	Cache      Cache      `json:"cache"`
+	Background Background `json:"background"`
+	Batch      Batch      `json:"batch"`
+	Document   Document   `json:"document"`
+	Proxy      Proxy      `json:"proxy"`
+	Admin      Admin      `json:"admin"`
+	API        API        `json:"api"`
+	Jobs       Jobs       `json:"jobs"`
+	Webhooks   Webhooks   `json:"webhooks"`
+}
+
+// Server configures the HTTP server
+type Server struct {
+	Addr            string   `json:"addr"`
+	ReadTimeout     Duration `json:"readTimeout"`
+	WriteTimeout    Duration `json:"writeTimeout"`
+	IdleTimeout     Duration `json:"idleTimeout"`
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+	// TempDir holds uploads and the scratch files of external tools, empty
+	// for the system default
+	TempDir string `json:"tempDir"`
+}
+
+// Limits bound uploads and image sizes
+type Limits struct {
+	UploadLimits
+	// Endpoints overrides the upload limits per endpoint, unset fields
+	// keep the values above
+	Endpoints map[string]UploadLimits `json:"endpoints,omitempty"`
+	// MaxWidth and MaxHeight bound output images
+	MaxWidth  int `json:"maxWidth"`
+	MaxHeight int `json:"maxHeight"`
+	// MaxMegapixels bounds input images before they are decoded
+	MaxMegapixels float64 `json:"maxMegapixels"`
+	// MaxArchiveEntries, MaxArchiveMB and MaxArchiveDepth bound the
+	// entries, extracted size and nesting of the archives of a request
+	MaxArchiveEntries int   `json:"maxArchiveEntries"`
+	MaxArchiveMB      int64 `json:"maxArchiveMB"`
+	MaxArchiveDepth   int   `json:"maxArchiveDepth"`
+}
+
+// UploadLimits bound the multipart upload of a single request
+type UploadLimits struct {
+	MaxFileSizeMB int64 `json:"maxFileSizeMB,omitempty"`
+	MaxUploadMB   int64 `json:"maxUploadMB,omitempty"`
+	MaxFiles      int   `json:"maxFiles,omitempty"`
+}
+
+// Upload returns the effective upload limits of an endpoint
+func (l Limits) Upload(endpoint string) UploadLimits {
+	limits := l.UploadLimits
+	override := l.Endpoints[endpoint]
+	if override.MaxFileSizeMB > 0 {
+		limits.MaxFileSizeMB = override.MaxFileSizeMB
+	}
+	if override.MaxUploadMB > 0 {
+		limits.MaxUploadMB = override.MaxUploadMB
+	}
+	if override.MaxFiles > 0 {
+		limits.MaxFiles = override.MaxFiles
+	}
+	return limits
+}
+
+// Defaults are used for settings a request leaves out
+type Defaults struct {
+	Format     string `json:"format"`
+	Quality    int    `json:"quality"`
+	ResizeMode string `json:"resizeMode"`
+	PDFQuality int    `json:"pdfQuality"`
+}
+
+// Cache configures the processed-result cache
+type Cache struct {
+	Backend string `json:"backend"`
+	Dir     string `json:"dir"`
+	SizeMB  int64  `json:"sizeMB"`
+}
+
+// Background configures background removal
+type Background struct {
+	Remover      string   `json:"remover"`
+	RembgCommand string   `json:"rembgCommand"`
+	RembgURL     string   `json:"rembgURL"`
+	RembgTimeout Duration `json:"rembgTimeout"`
+}
+
+// Batch configures batch processing
+type Batch struct {
+	// Workers bounds the images of a batch processed at the same time
+	Workers int `json:"workers"`
+}
+
+// Document configures document conversion
+type Document struct {
+	OfficeCommand string   `json:"officeCommand"`
+	Timeout       Duration `json:"timeout"`
+}
+
+// Proxy configures the image transformation endpoint, which is enabled when
+// both Origin and SigningKey are set
+type Proxy struct {
+	Origin     string   `json:"origin"`
+	SigningKey Secret   `json:"signingKey"`
+	Timeout    Duration `json:"timeout"`
+}
+
+// Admin configures the admin endpoints, which are enabled when Token is set
+type Admin struct {
+	Token Secret `json:"token"`
+}
+
+// API configures the versioned JSON API
+type API struct {
+	// BaseURL prefixes the download links of results, empty to derive it
+	// from each request
+	BaseURL string `json:"baseURL"`
+	// ResultDir keeps results for download, empty for a directory below the
+	// system temp directory
+	ResultDir string   `json:"resultDir"`
+	ResultTTL Duration `json:"resultTTL"`
+	// URLSources lets JSON requests name their sources by URL, PrivateURLs
+	// also allows loopback, private and link-local addresses
+	URLSources   bool     `json:"urlSources"`
+	PrivateURLs  bool     `json:"privateURLs"`
+	FetchTimeout Duration `json:"fetchTimeout"`
+}
+
+// Jobs configures the queue of asynchronous requests
+type Jobs struct {
+	Workers   int `json:"workers"`
+	QueueSize int `json:"queueSize"`
+	// TTL is how long finished jobs can be polled, their results are kept
+	// for api.resultTTL
+	TTL Duration `json:"ttl"`
+}
+
+// Webhooks configures the callbacks posted when jobs end, which are enabled
+// when Secret is set
+type Webhooks struct {
+	// Secret keys the HMAC signature of every callback
+	Secret Secret `json:"secret"`
+	// Attempts bounds the tries of a callback, the first retry waiting
+	// Backoff and every further one twice as long
+	Attempts int      `json:"attempts"`
+	Backoff  Duration `json:"backoff"`
+	Timeout  Duration `json:"timeout"`
+	// PrivateURLs allows callbacks to loopback, private and link-local
+	// addresses
+	PrivateURLs bool `json:"privateURLs"`
+}
+
+// Default returns the built-in settings
+func Default() *Config {
+	return &Config{
+		Server: Server{
+			Addr:            ":8081",
+			ReadTimeout:     Duration(15 * time.Second),
+			WriteTimeout:    Duration(15 * time.Second),
+			IdleTimeout:     Duration(60 * time.Second),
+			ShutdownTimeout: Duration(15 * time.Second),
+		},
+		Limits: Limits{
+			UploadLimits: UploadLimits{
+				MaxFileSizeMB: constants.MaxFileSize >> 20,
+				MaxUploadMB:   256,
+				MaxFiles:      100,
+			},
+			MaxWidth:          constants.MaxImageWidth,
+			MaxHeight:         constants.MaxImageHeight,
+			MaxMegapixels:     float64(constants.MaxImageWidth*constants.MaxImageHeight) / 1e6,
+			MaxArchiveEntries: archive.DefaultOptions().MaxEntries,
+			MaxArchiveMB:      archive.DefaultOptions().MaxTotalSize >> 20,
+			MaxArchiveDepth:   archive.DefaultOptions().MaxDepth,
+		},
+		Defaults: Defaults{
+			Format:     constants.DefaultFormat,
+			Quality:    constants.DefaultQuality,
+			ResizeMode: constants.DefaultResizeMode,
+			PDFQuality: constants.DefaultQuality,
+		},
+		Cache: Cache{
+			Backend: cache.BackendMemory,
+			SizeMB:  256,
+		},
+		Background: Background{
+			Remover:      background.BackendNative,
+			RembgCommand: "rembg",
+			RembgTimeout: Duration(background.DefaultRembgTimeout),
+		},
+		Batch: Batch{
+			Workers: runtime.NumCPU(),
+		},
+		Document: Document{
+			OfficeCommand: document.DefaultOfficeCommand,
+			Timeout:       Duration(document.DefaultOfficeTimeout),
+		},
+		Proxy: Proxy{
+			Timeout: Duration(proxy.DefaultOriginOptions().Timeout),
+		},
+		API: API{
+			ResultTTL:    Duration(storage.DefaultTTL),
+			URLSources:   true,
+			FetchTimeout: Duration(upload.DefaultFetchTimeout),
+		},
+		Jobs: Jobs{
+			Workers:   jobs.DefaultOptions().Workers,
+			QueueSize: jobs.DefaultOptions().QueueSize,
+			TTL:       Duration(jobs.DefaultOptions().TTL),
+		},
+		Webhooks: Webhooks{
+			Attempts: webhook.DefaultOptions().Attempts,
+			Backoff:  Duration(webhook.DefaultOptions().Backoff),
+			Timeout:  Duration(webhook.DefaultOptions().Timeout),
+		},
+	}
+}
+
+// Load reads the settings from the JSON file at path, if path is not
+// empty, and then from the environment, and validates the result
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		defer f.Close()
+
+		decoder := json.NewDecoder(f)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate reports every invalid setting
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must not be empty")
+	timeouts := []struct {
+		name     string
+		value    Duration
+		required bool
+	}{
+		{"server.readTimeout", c.Server.ReadTimeout, false},
+		{"server.writeTimeout", c.Server.WriteTimeout, false},
+		{"server.idleTimeout", c.Server.IdleTimeout, false},
+		{"server.shutdownTimeout", c.Server.ShutdownTimeout, false},
+		{"background.rembgTimeout", c.Background.RembgTimeout, true},
+		{"document.timeout", c.Document.Timeout, true},
+		{"proxy.timeout", c.Proxy.Timeout, true},
+		{"api.resultTTL", c.API.ResultTTL, true},
+		{"api.fetchTimeout", c.API.FetchTimeout, true},
+		{"jobs.ttl", c.Jobs.TTL, true},
+		{"webhooks.backoff", c.Webhooks.Backoff, false},
+		{"webhooks.timeout", c.Webhooks.Timeout, true},
+	}
+	for _, t := range timeouts {
+		if t.required {
+			check(t.value > 0, "%s must be positive", t.name)
+		} else {
+			check(t.value >= 0, "%s must not be negative", t.name)
+		}
+	}
+	if c.Server.TempDir != "" {
+		info, err := os.Stat(c.Server.TempDir)
+		check(err == nil && info.IsDir(), "server.tempDir %s is not a directory", c.Server.TempDir)
+	}
+
+	upload := c.Limits.UploadLimits
+	check(upload.MaxFileSizeMB > 0, "limits.maxFileSizeMB must be positive")
+	check(upload.MaxUploadMB > 0, "limits.maxUploadMB must be positive")
+	check(upload.MaxFiles > 0, "limits.maxFiles must be positive")
+	for name, override := range c.Limits.Endpoints {
+		check(knownEndpoint(name), "limits.endpoints: unknown endpoint %s", name)
+		check(override.MaxFileSizeMB >= 0 && override.MaxUploadMB >= 0 && override.MaxFiles >= 0,
+			"limits.endpoints.%s: limits must not be negative", name)
+	}
+	check(c.Limits.MaxWidth > 0 && c.Limits.MaxHeight > 0, "limits.maxWidth and limits.maxHeight must be positive")
+	check(c.Limits.MaxMegapixels > 0, "limits.maxMegapixels must be positive")
+	check(c.Limits.MaxArchiveEntries > 0, "limits.maxArchiveEntries must be positive")
+	check(c.Limits.MaxArchiveMB > 0, "limits.maxArchiveMB must be positive")
+	check(c.Limits.MaxArchiveDepth > 0, "limits.maxArchiveDepth must be positive")
+
+	check(processor.IsValidFormat(c.Defaults.Format), "defaults.format: unsupported format %s", c.Defaults.Format)
+	check(c.Defaults.Quality >= 1 && c.Defaults.Quality <= 100, "defaults.quality must be between 1 and 100")
+	check(c.Defaults.PDFQuality >= 1 && c.Defaults.PDFQuality <= 100, "defaults.pdfQuality must be between 1 and 100")
+	_, err := resize.ParseResizeMode(c.Defaults.ResizeMode)
+	check(err == nil, "defaults.resizeMode: %v", err)
+
+	switch strings.ToLower(c.Cache.Backend) {
+	case cache.BackendMemory, cache.BackendDisk, cache.BackendNone, "off", "":
+	default:
+		check(false, "cache.backend: unknown backend %s", c.Cache.Backend)
+	}
+	check(c.Cache.SizeMB >= 0, "cache.sizeMB must not be negative")
+
+	switch strings.ToLower(c.Background.Remover) {
+	case background.BackendNative, background.BackendRembg, "":
+	default:
+		check(false, "background.remover: unknown remover %s", c.Background.Remover)
+	}
+	check(c.Batch.Workers > 0, "batch.workers must be positive")
+	check(c.Document.OfficeCommand != "", "document.officeCommand must not be empty")
+
+	if c.API.BaseURL != "" {
+		base, err := url.Parse(c.API.BaseURL)
+		check(err == nil && (base.Scheme == "http" || base.Scheme == "https") && base.Host != "",
+			"api.baseURL must be an absolute http or https URL")
+	}
+	check(c.Jobs.Workers > 0, "jobs.workers must be positive")
+	check(c.Jobs.QueueSize >= 0, "jobs.queueSize must not be negative")
+	check(c.Webhooks.Attempts > 0, "webhooks.attempts must be positive")
+
+	return stderrors.Join(errs...)
+}
+
+func knownEndpoint(name string) bool {
+	for _, endpoint := range Endpoints {
+		if endpoint == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration written as a string such as "15s" in JSON
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"15s\"")
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Secret is a setting that is never written out, so the effective
+// configuration can be shown without leaking it
+type Secret string
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return json.Marshal("")
+	}
+	return json.Marshal("[redacted]")
+}
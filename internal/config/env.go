@@ -0,0 +1,139 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// envVar maps an environment variable onto a setting
+type envVar struct {
+	name string
+	set  func(value string) error
+}
+
+// applyEnv overrides settings with the environment variables lookup finds
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	vars := []envVar{
+		{"PORT", func(v string) error { c.Server.Addr = ":" + v; return nil }},
+		{"REUBAH_ADDR", setString(&c.Server.Addr)},
+		{"REUBAH_READ_TIMEOUT", setDuration(&c.Server.ReadTimeout)},
+		{"REUBAH_WRITE_TIMEOUT", setDuration(&c.Server.WriteTimeout)},
+		{"REUBAH_IDLE_TIMEOUT", setDuration(&c.Server.IdleTimeout)},
+		{"REUBAH_SHUTDOWN_TIMEOUT", setDuration(&c.Server.ShutdownTimeout)},
+		{"REUBAH_TEMP_DIR", setString(&c.Server.TempDir)},
+
+		{"REUBAH_MAX_FILE_MB", setInt64(&c.Limits.MaxFileSizeMB)},
+		{"REUBAH_MAX_UPLOAD_MB", setInt64(&c.Limits.MaxUploadMB)},
+		{"REUBAH_MAX_FILES", setInt(&c.Limits.MaxFiles)},
+		{"REUBAH_MAX_WIDTH", setInt(&c.Limits.MaxWidth)},
+		{"REUBAH_MAX_HEIGHT", setInt(&c.Limits.MaxHeight)},
+		{"REUBAH_MAX_MEGAPIXELS", setFloat(&c.Limits.MaxMegapixels)},
+		{"REUBAH_MAX_ARCHIVE_ENTRIES", setInt(&c.Limits.MaxArchiveEntries)},
+		{"REUBAH_MAX_ARCHIVE_MB", setInt64(&c.Limits.MaxArchiveMB)},
+		{"REUBAH_MAX_ARCHIVE_DEPTH", setInt(&c.Limits.MaxArchiveDepth)},
+
+		{"REUBAH_DEFAULT_FORMAT", setString(&c.Defaults.Format)},
+		{"REUBAH_DEFAULT_QUALITY", setInt(&c.Defaults.Quality)},
+		{"REUBAH_DEFAULT_RESIZE_MODE", setString(&c.Defaults.ResizeMode)},
+		{"REUBAH_PDF_QUALITY", setInt(&c.Defaults.PDFQuality)},
+
+		{"REUBAH_CACHE", setString(&c.Cache.Backend)},
+		{"REUBAH_CACHE_DIR", setString(&c.Cache.Dir)},
+		{"REUBAH_CACHE_SIZE_MB", setInt64(&c.Cache.SizeMB)},
+
+		{"REUBAH_BG_REMOVER", setString(&c.Background.Remover)},
+		{"REUBAH_REMBG_COMMAND", setString(&c.Background.RembgCommand)},
+		{"REUBAH_REMBG_URL", setString(&c.Background.RembgURL)},
+		{"REUBAH_REMBG_TIMEOUT", setDuration(&c.Background.RembgTimeout)},
+
+		{"REUBAH_BATCH_WORKERS", setInt(&c.Batch.Workers)},
+
+		{"REUBAH_OFFICE_COMMAND", setString(&c.Document.OfficeCommand)},
+		{"REUBAH_OFFICE_TIMEOUT", setDuration(&c.Document.Timeout)},
+
+		{"REUBAH_ORIGIN", setString(&c.Proxy.Origin)},
+		{"REUBAH_SIGNING_KEY", setSecret(&c.Proxy.SigningKey)},
+		{"REUBAH_ORIGIN_TIMEOUT", setDuration(&c.Proxy.Timeout)},
+
+		{"REUBAH_ADMIN_TOKEN", setSecret(&c.Admin.Token)},
+
+		{"REUBAH_API_BASE_URL", setString(&c.API.BaseURL)},
+		{"REUBAH_RESULT_DIR", setString(&c.API.ResultDir)},
+		{"REUBAH_RESULT_TTL", setDuration(&c.API.ResultTTL)},
+		{"REUBAH_URL_SOURCES", setBool(&c.API.URLSources)},
+		{"REUBAH_PRIVATE_URLS", setBool(&c.API.PrivateURLs)},
+		{"REUBAH_FETCH_TIMEOUT", setDuration(&c.API.FetchTimeout)},
+
+		{"REUBAH_JOB_WORKERS", setInt(&c.Jobs.Workers)},
+		{"REUBAH_JOB_QUEUE_SIZE", setInt(&c.Jobs.QueueSize)},
+		{"REUBAH_JOB_TTL", setDuration(&c.Jobs.TTL)},
+
+		{"REUBAH_WEBHOOK_SECRET", setSecret(&c.Webhooks.Secret)},
+		{"REUBAH_WEBHOOK_ATTEMPTS", setInt(&c.Webhooks.Attempts)},
+		{"REUBAH_WEBHOOK_BACKOFF", setDuration(&c.Webhooks.Backoff)},
+		{"REUBAH_WEBHOOK_TIMEOUT", setDuration(&c.Webhooks.Timeout)},
+		{"REUBAH_WEBHOOK_PRIVATE_URLS", setBool(&c.Webhooks.PrivateURLs)},
+	}
+
+	for _, v := range vars {
+		value, ok := lookup(v.name)
+		if !ok || value == "" {
+			continue
+		}
+		if err := v.set(value); err != nil {
+			return fmt.Errorf("invalid %s: %s", v.name, value)
+		}
+	}
+	return nil
+}
+
+func setString(dst *string) func(string) error {
+	return func(v string) error {
+		*dst = v
+		return nil
+	}
+}
+
+func setSecret(dst *Secret) func(string) error {
+	return func(v string) error {
+		*dst = Secret(v)
+		return nil
+	}
+}
+
+func setInt(dst *int) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.Atoi(v)
+		return err
+	}
+}
+
+func setInt64(dst *int64) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.ParseInt(v, 10, 64)
+		return err
+	}
+}
+
+func setFloat(dst *float64) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.ParseFloat(v, 64)
+		return err
+	}
+}
+
+func setBool(dst *bool) func(string) error {
+	return func(v string) (err error) {
+		*dst, err = strconv.ParseBool(v)
+		return err
+	}
+}
+
+func setDuration(dst *Duration) func(string) error {
+	return func(v string) error {
+		d, err := time.ParseDuration(v)
+		*dst = Duration(d)
+		return err
+	}
+}
@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// AdminHandler serves administrative information to requests that carry the
+// admin token as a bearer token
+type AdminHandler struct {
+	token    string
+	settings interface{}
+}
+
+// NewAdminHandler returns a handler guarded by token. settings is served as
+// the effective configuration and must not contain secrets.
+func NewAdminHandler(token string, settings interface{}) *AdminHandler {
+	return &AdminHandler{token: token, settings: settings}
+}
+
+// Config reports the effective configuration
+func (h *AdminHandler) Config(w http.ResponseWriter, r *http.Request) {
+	if !h.authorized(r) {
+		errors.SendError(w, errors.New(errors.ErrUnauthorized, "Invalid or missing admin token", nil))
+		return
+	}
+	response.JSON(w, http.StatusOK, h.settings)
+}
+
+func (h *AdminHandler) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) == 1
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// APIPrefix is the path prefix of the versioned JSON API
+const APIPrefix = "/api/v1"
+
+// Values of the response field, which selects how results are returned
+const (
+	responseLink   = "link"
+	responseInline = "inline"
+)
+
+// APIResult is the JSON body returned by the API endpoints. Results are
+// either stored for download from URL until ExpiresAt or returned inline as
+// a data URI in Data.
+type APIResult struct {
+	Filename    string     `json:"filename"`
+	ContentType string     `json:"contentType"`
+	Size        int64      `json:"size"`
+	URL         string     `json:"url,omitempty" doc:"Download link, set unless the result is inline"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty" doc:"When the download link stops working"`
+	Data        string     `json:"data,omitempty" doc:"The result as a data URI, set for inline results"`
+	// Image results only
+	Format string `json:"format,omitempty" doc:"Output format of image results"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	Choice string `json:"choice,omitempty" doc:"Which encoding the smallest format picked"`
+}
+
+// APIHandler serves the versioned JSON API. Its endpoints accept either a
+// multipart upload with the fields of the classic endpoints or a JSON body
+// giving sources as base64 data or URLs, and answer with an APIResult.
+type APIHandler struct {
+	results *storage.Store
+	fetcher *upload.Fetcher
+	baseURL string
+	openAPI []byte
+	mux     *http.ServeMux
+}
+
+// APIOptions configure an APIHandler
+type APIOptions struct {
+	// BaseURL prefixes download links and the server URL of the OpenAPI
+	// document, empty to derive links from each request
+	BaseURL string
+	// Fetcher downloads sources given by URL, nil to refuse them
+	Fetcher *upload.Fetcher
+}
+
+// NewAPIHandler returns the API handler, keeping linked results in results
+func NewAPIHandler(results *storage.Store, opts APIOptions) (*APIHandler, error) {
+	h := &APIHandler{
+		results: results,
+		fetcher: opts.Fetcher,
+		baseURL: strings.TrimSuffix(opts.BaseURL, "/"),
+	}
+
+	var err error
+	if h.openAPI, err = openAPIDocument(h.baseURL); err != nil {
+		return nil, fmt.Errorf("generating OpenAPI document: %w", err)
+	}
+
+	h.mux = http.NewServeMux()
+	h.mux.HandleFunc("POST "+APIPrefix+"/images/process", h.ProcessImage)
+	h.mux.HandleFunc("POST "+APIPrefix+"/documents/convert", h.ConvertDocument)
+	h.mux.HandleFunc("POST "+APIPrefix+"/pdf/merge", h.MergePDF)
+	h.mux.HandleFunc("GET "+APIPrefix+"/results/{id}", h.Result)
+	h.mux.HandleFunc("GET "+APIPrefix+"/openapi.json", h.OpenAPI)
+	h.mux.HandleFunc("GET "+APIPrefix+"/docs", h.Docs)
+	h.mux.HandleFunc(APIPrefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		errors.SendError(w, errors.New(errors.ErrNotFound, fmt.Sprintf("No endpoint %s %s", r.Method, r.URL.Path), nil))
+	})
+	return h, nil
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// ProcessImage processes the "image" source with the options of /process
+func (h *APIHandler) ProcessImage(w http.ResponseWriter, r *http.Request) {
+	form, mode, err := h.parseRequest(w, r, "process", &ProcessRequest{})
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	archived, err := hasArchive(form, "image")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if archived {
+		h.processArchive(w, r, mode, form)
+		return
+	}
+
+	opts, data, err := parseRequest(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if opts.OutputFormat == processor.FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	rendered, err := renderImage(processor.CacheKey(data, opts), data, r.FormValue("sourceFormat"), opts)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	result := &APIResult{
+		Filename:    "processed." + rendered.Format,
+		ContentType: "image/" + rendered.Format,
+		Format:      rendered.Format,
+		Choice:      rendered.Choice,
+	}
+	// Not every output format has a registered decoder
+	if config, _, err := image.DecodeConfig(bytes.NewReader(rendered.Data)); err == nil {
+		result.Width, result.Height = config.Width, config.Height
+	}
+	h.sendResult(w, r, mode, result, bytes.NewReader(rendered.Data))
+}
+
+// processArchive processes the entries of an archived "image" source like a
+// batch, the result being the ZIP of their outputs and manifest
+func (h *APIHandler) processArchive(w http.ResponseWriter, r *http.Request, mode string, form *upload.Form) {
+	if err := expandUploads(form, "image", false); err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	files := form.File["image"]
+	if len(files) == 0 {
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No images in archive", nil))
+		return
+	}
+	opts, err := parseOptions(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if opts.OutputFormat == processor.FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	zipped, err := batchToTempFile(r.Context(), files, opts)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer os.Remove(zipped.Name())
+	defer zipped.Close()
+	h.sendResult(w, r, mode, &APIResult{Filename: "processed.zip", ContentType: "application/zip"}, zipped)
+}
+
+// ConvertDocument converts the "document" source to the format option
+func (h *APIHandler) ConvertDocument(w http.ResponseWriter, r *http.Request) {
+	form, mode, err := h.parseRequest(w, r, "document", &DocumentRequest{})
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if isAsync(r) {
+		submitJob(w, r, "document", form, documentJob)
+		return
+	}
+	defer form.RemoveAll()
+
+	converted, filename, err := convertUploadedDocument(r, form, nil)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	result := &APIResult{
+		Filename:    filename,
+		ContentType: getContentType(strings.TrimPrefix(filepath.Ext(filename), ".")),
+	}
+	h.sendResult(w, r, mode, result, bytes.NewReader(converted))
+}
+
+// MergePDF merges the "images" sources into a PDF
+func (h *APIHandler) MergePDF(w http.ResponseWriter, r *http.Request) {
+	form, mode, err := h.parseRequest(w, r, "merge-pdf", &MergeRequest{})
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if isAsync(r) {
+		submitJob(w, r, "merge-pdf", form, mergeJob)
+		return
+	}
+	defer form.RemoveAll()
+
+	pdf, err := mergeToTempFile(r, form, nil)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer os.Remove(pdf.Name())
+	defer pdf.Close()
+
+	h.sendResult(w, r, mode, &APIResult{Filename: "merged.pdf", ContentType: "application/pdf"}, pdf)
+}
+
+// Result serves a stored result until it expires
+func (h *APIHandler) Result(w http.ResponseWriter, r *http.Request) {
+	serveResult(w, r, h.results, r.PathValue("id"))
+}
+
+// serveResult serves the result id from store
+func serveResult(w http.ResponseWriter, r *http.Request, store *storage.Store, id string) {
+	result, f, err := store.Open(id)
+	if err == storage.ErrNotFound {
+		errors.SendError(w, errors.New(errors.ErrNotFound, "Result not found or expired", nil))
+		return
+	}
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to read result", err))
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Type", result.ContentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": result.Filename}))
+	w.Header().Set("Expires", result.Expires.UTC().Format(http.TimeFormat))
+	http.ServeContent(w, r, result.Filename, result.Created, f)
+}
+
+// parseRequest reads a JSON or multipart request into a form, the JSON body
+// being decoded into body. It returns how the result should be returned.
+func (h *APIHandler) parseRequest(w http.ResponseWriter, r *http.Request, endpoint string, body apiRequest) (*upload.Form, string, error) {
+	var form *upload.Form
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		form, err = h.parseJSON(w, r, endpoint, body)
+	} else {
+		form, err = parseUpload(w, r, endpoint)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	mode := r.FormValue("response")
+	switch mode {
+	case "":
+		mode = responseLink
+	case responseLink, responseInline:
+	default:
+		form.RemoveAll()
+		return nil, "", errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Unsupported response: %s", mode), nil)
+	}
+	return form, mode, nil
+}
+
+// sendResult completes result with content, stored for download or inline
+// depending on mode, and sends it
+func (h *APIHandler) sendResult(w http.ResponseWriter, r *http.Request, mode string, result *APIResult, content io.Reader) {
+	if mode == responseInline {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to read result", err))
+			return
+		}
+		result.Size = int64(len(data))
+		result.Data = fmt.Sprintf("data:%s;base64,%s", result.ContentType, base64.StdEncoding.EncodeToString(data))
+		response.JSON(w, http.StatusOK, result)
+		return
+	}
+
+	stored, err := h.results.Put(result.Filename, result.ContentType, content)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to store result", err))
+		return
+	}
+	result.Size = stored.Size
+	result.URL = h.link(r, APIPrefix+"/results/"+stored.ID)
+	result.ExpiresAt = &stored.Expires
+	response.JSON(w, http.StatusOK, result)
+}
+
+// link returns an absolute URL for path
+func (h *APIHandler) link(r *http.Request, path string) string {
+	return absoluteURL(h.baseURL, r, path)
+}
+
+// absoluteURL returns an absolute URL for path, based on base or, when base
+// is empty, on the request
+func absoluteURL(base string, r *http.Request, path string) string {
+	if base != "" {
+		return strings.TrimSuffix(base, "/") + path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + path
+}
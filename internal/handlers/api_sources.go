@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// jsonOverhead is allowed on top of the upload limits for the JSON syntax
+// and options of a request body
+const jsonOverhead = 1 << 20
+
+// APISource is a file given in a JSON request, either as base64 data or as a
+// URL the server downloads
+type APISource struct {
+	Base64   string `json:"base64,omitempty" doc:"File contents in base64, optionally as a data URI"`
+	URL      string `json:"url,omitempty" doc:"http or https URL to download the file from"`
+	Filename string `json:"filename,omitempty" doc:"Name of the file, its extension is the input format of documents"`
+}
+
+// apiFields are part of every JSON request
+type apiFields struct {
+	Options  map[string]interface{} `json:"options,omitempty"`
+	Response string                 `json:"response,omitempty" doc:"link (default) stores the result for download, inline returns it as a data URI" enum:"link,inline"`
+}
+
+// ProcessRequest is the JSON body of the image processing endpoint
+type ProcessRequest struct {
+	Image    *APISource `json:"image"`
+	Backdrop *APISource `json:"backdrop,omitempty" doc:"Backdrop image used with bgFill=image"`
+	apiFields
+}
+
+// DocumentRequest is the JSON body of the document conversion endpoint
+type DocumentRequest struct {
+	Document *APISource `json:"document"`
+	apiFields
+}
+
+// MergeRequest is the JSON body of the PDF merge endpoint
+type MergeRequest struct {
+	Images []*APISource `json:"images" doc:"Images in page order"`
+	apiFields
+}
+
+// apiRequest is implemented by the JSON request bodies
+type apiRequest interface {
+	fields() *apiFields
+	// sources returns the files of the request by upload field name
+	sources() []namedSource
+	// options returns the options the endpoint accepts
+	options() []apiOption
+}
+
+type namedSource struct {
+	field  string
+	source *APISource
+}
+
+func (p *ProcessRequest) fields() *apiFields {
+	return &p.apiFields
+}
+
+func (p *ProcessRequest) options() []apiOption {
+	return processOptions
+}
+
+func (p *ProcessRequest) sources() []namedSource {
+	return []namedSource{{"image", p.Image}, {"backdrop", p.Backdrop}}
+}
+
+func (d *DocumentRequest) fields() *apiFields {
+	return &d.apiFields
+}
+
+func (d *DocumentRequest) options() []apiOption {
+	return documentOptions
+}
+
+func (d *DocumentRequest) sources() []namedSource {
+	return []namedSource{{"document", d.Document}}
+}
+
+func (m *MergeRequest) fields() *apiFields {
+	return &m.apiFields
+}
+
+func (m *MergeRequest) options() []apiOption {
+	return mergeOptions
+}
+
+func (m *MergeRequest) sources() []namedSource {
+	sources := make([]namedSource, len(m.Images))
+	for i, image := range m.Images {
+		sources[i] = namedSource{"images", image}
+	}
+	return sources
+}
+
+// parseJSON decodes a JSON request into body and builds the form the
+// multipart endpoints would have parsed: sources are spooled as uploads
+// within the limits of endpoint, and options become form fields, so
+// r.FormValue reads them.
+func (h *APIHandler) parseJSON(w http.ResponseWriter, r *http.Request, endpoint string, body apiRequest) (*upload.Form, error) {
+	limits := limitsFor(endpoint)
+	// The body is decoded whole, so its base64 sources are held in memory
+	// together: they may add up to one file, base64 taking four bytes for
+	// every three. Larger files are given as URLs or uploaded as multipart.
+	r.Body = http.MaxBytesReader(w, r.Body, min(limits.MaxFileSize, limits.MaxTotalSize)/3*4+limits.MaxValueSize+jsonOverhead)
+
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	decoder.UseNumber()
+	if err := decoder.Decode(body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if stderrors.As(err, &tooLarge) {
+			return nil, errors.New(errors.ErrInvalidSize, "Request body too large", err)
+		}
+		return nil, errors.New(errors.ErrInvalidFormat, "Invalid JSON body: "+err.Error(), err)
+	}
+
+	values, err := optionValues(body.fields().Options, body.options())
+	if err != nil {
+		return nil, err
+	}
+	if body.fields().Response != "" {
+		values.Set("response", body.fields().Response)
+	}
+
+	form, err := upload.NewForm(limits)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range body.sources() {
+		if s.source == nil {
+			continue
+		}
+		if err := h.addSource(r.Context(), form, s.field, s.source); err != nil {
+			form.RemoveAll()
+			return nil, err
+		}
+		// Spooled, the encoded data needn't be kept until the last source
+		s.source.Base64 = ""
+	}
+
+	if err := r.ParseForm(); err != nil {
+		form.RemoveAll()
+		return nil, errors.New(errors.ErrInvalidFormat, "Unable to parse query", err)
+	}
+	// Body fields come first, as with multipart requests
+	form.Value = values
+	r.PostForm = values
+	for name, v := range values {
+		r.Form[name] = append(v, r.Form[name]...)
+	}
+	return form, nil
+}
+
+// addSource spools src into form as a file uploaded as field
+func (h *APIHandler) addSource(ctx context.Context, form *upload.Form, field string, src *APISource) error {
+	switch {
+	case src.Base64 != "" && src.URL != "":
+		return errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Source %s must have either base64 or url, not both", field), nil)
+
+	case src.URL != "":
+		if h.fetcher == nil {
+			return errors.New(errors.ErrInvalidFormat, "URL sources are disabled", nil)
+		}
+		return h.fetcher.Fetch(ctx, form, field, src.URL, src.Filename)
+
+	case src.Base64 != "":
+		header := textproto.MIMEHeader{}
+		encoded := src.Base64
+		if rest, ok := strings.CutPrefix(encoded, "data:"); ok {
+			meta, payload, _ := strings.Cut(rest, ",")
+			mediaType, isBase64 := strings.CutSuffix(meta, ";base64")
+			if !isBase64 {
+				return errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Source %s is not a base64 data URI", field), nil)
+			}
+			if mediaType != "" {
+				header.Set("Content-Type", mediaType)
+			}
+			encoded = payload
+		}
+		filename := src.Filename
+		if filename == "" {
+			filename = field
+		}
+		// Decoded while spooled rather than copied whole first
+		decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(encoded))
+		return form.Add(field, filename, header, &base64Source{r: decoder, field: field})
+
+	default:
+		return errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Source %s needs base64 or url", field), nil)
+	}
+}
+
+// base64Source reports invalid base64 in the source field as such rather
+// than as a failed upload
+type base64Source struct {
+	r     io.Reader
+	field string
+}
+
+func (b *base64Source) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	var corrupt base64.CorruptInputError
+	if stderrors.As(err, &corrupt) {
+		return n, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Source %s is not valid base64", b.field), err)
+	}
+	return n, err
+}
+
+// optionValues converts JSON options to form values, rejecting options the
+// endpoint doesn't know
+func optionValues(options map[string]interface{}, known []apiOption) (url.Values, error) {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	// Sorted so the same request always reports the same error
+	sort.Strings(names)
+
+	values := url.Values{}
+	for _, name := range names {
+		if !hasOption(known, name) {
+			return nil, errors.New(errors.ErrInvalidFormat, "Unknown option: "+name, nil)
+		}
+		switch v := options[name].(type) {
+		case string:
+			values.Set(name, v)
+		case json.Number:
+			values.Set(name, v.String())
+		case bool:
+			values.Set(name, strconv.FormatBool(v))
+		case nil:
+		default:
+			return nil, errors.New(errors.ErrInvalidFormat,
+				fmt.Sprintf("Option %s must be a string, number or boolean", name), nil)
+		}
+	}
+	return values, nil
+}
+
+func hasOption(options []apiOption, name string) bool {
+	for _, o := range options {
+		if o.name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,232 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dendianugerah/reubah/internal/processor/background"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Limits of the background removal and fill parameters
+const (
+	maxFeather      = 50
+	maxBlurSigma    = 100
+	maxShadowBlur   = 50
+	maxShadowOffset = 500
+	maxPadding      = 2000
+	maxTolerance    = 100
+)
+
+// bgRemover is the backend used when a request asks for background removal
+var bgRemover background.Remover = background.Native{}
+
+// SetBackgroundRemover sets the background removal backend
+func SetBackgroundRemover(r background.Remover) {
+	bgRemover = r
+}
+
+// parseBackgroundRemoval parses the bgMethod, bgTolerance, bgColor and
+// bgFeather fields, falling back to the defaults for missing ones
+func parseBackgroundRemoval(r *http.Request) (background.Options, error) {
+	opts := background.DefaultOptions()
+
+	var err error
+	if value := r.FormValue("bgMethod"); value != "" {
+		if opts.Method, err = background.ParseMethod(value); err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid bgMethod value", err)
+		}
+	}
+	if value := r.FormValue("bgTolerance"); value != "" {
+		if opts.Tolerance, err = parseTolerance(value); err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid bgTolerance value", err)
+		}
+	}
+	if value := r.FormValue("bgColor"); value != "" {
+		if opts.KeyColor, err = background.ParseColor(value); err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid bgColor value", err)
+		}
+	}
+	if value := r.FormValue("bgFeather"); value != "" {
+		if opts.Feather, err = parseFeather(value); err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid bgFeather value", err)
+		}
+	}
+
+	if value := r.FormValue("bgModel"); value != "" {
+		if opts.Model, err = background.ParseModel(value); err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid bgModel value", err)
+		}
+	}
+	opts.AlphaMatting = r.FormValue("bgAlphaMatting") == "true"
+	thresholds := []struct {
+		name string
+		dst  *int
+	}{
+		{"bgMattingForeground", &opts.Matting.Foreground},
+		{"bgMattingBackground", &opts.Matting.Background},
+		{"bgMattingErode", &opts.Matting.Erode},
+	}
+	for _, t := range thresholds {
+		if value := r.FormValue(t.name); value != "" {
+			if *t.dst, err = parseMattingValue(value); err != nil {
+				return opts, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Invalid %s value", t.name), err)
+			}
+		}
+	}
+	return opts, nil
+}
+
+// parseBackgroundFill parses the bgFill field and the settings that go with
+// it. With bgFill=image the backdrop is read from the "backdrop" upload.
+func parseBackgroundFill(r *http.Request, form *upload.Form) (background.Fill, error) {
+	fill := background.DefaultFill()
+
+	if value := r.FormValue("bgFill"); value != "" {
+		mode, c, err := background.ParseFillMode(value)
+		if err != nil {
+			return fill, errors.New(errors.ErrInvalidFormat, "Invalid bgFill value", err)
+		}
+		fill.Mode = mode
+		if c != nil {
+			fill.Color = *c
+		}
+	}
+
+	// Numeric and color settings are validated even when their mode is
+	// not selected, so typos don't go unnoticed
+	fields := []struct {
+		name string
+		dst  *float64
+		lo   float64
+		hi   float64
+	}{
+		{"bgBlur", &fill.BlurSigma, 0, maxBlurSigma},
+		{"shadowBlur", &fill.Shadow.Blur, 0, maxShadowBlur},
+		{"shadowOpacity", &fill.Shadow.Opacity, 0, 1},
+	}
+	for _, f := range fields {
+		if value := r.FormValue(f.name); value != "" {
+			v, err := parseRange(value, f.lo, f.hi)
+			if err != nil {
+				return fill, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Invalid %s value", f.name), err)
+			}
+			*f.dst = v
+		}
+	}
+
+	ints := []struct {
+		name string
+		dst  *int
+		lo   float64
+		hi   float64
+	}{
+		{"shadowOffsetX", &fill.Shadow.OffsetX, -maxShadowOffset, maxShadowOffset},
+		{"shadowOffsetY", &fill.Shadow.OffsetY, -maxShadowOffset, maxShadowOffset},
+		{"padding", &fill.Padding, 0, maxPadding},
+	}
+	for _, f := range ints {
+		if value := r.FormValue(f.name); value != "" {
+			v, err := parseRange(value, f.lo, f.hi)
+			if err != nil || v != float64(int(v)) {
+				return fill, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Invalid %s value", f.name), err)
+			}
+			*f.dst = int(v)
+		}
+	}
+
+	if value := r.FormValue("bgFillColor"); value != "" {
+		c, err := background.ParseColor(value)
+		if err != nil {
+			return fill, errors.New(errors.ErrInvalidFormat, "Invalid bgFillColor value", err)
+		}
+		fill.Color = c
+	}
+	fill.Shadow.Enabled = r.FormValue("shadow") == "true"
+
+	if fill.Mode == background.FillImage {
+		data, err := readImageUpload(form, "backdrop")
+		if err != nil {
+			return fill, err
+		}
+		fill.Backdrop, err = decodeImageData(data, "")
+		if err != nil {
+			return fill, err
+		}
+		sum := sha256.Sum256(data)
+		fill.BackdropID = hex.EncodeToString(sum[:])
+	}
+	return fill, nil
+}
+
+// parseTolerance parses a color tolerance in percent
+func parseTolerance(value string) (float64, error) {
+	return parseRange(value, 0, maxTolerance)
+}
+
+// parseFeather parses an edge softening radius in pixels
+func parseFeather(value string) (float64, error) {
+	return parseRange(value, 0, maxFeather)
+}
+
+// parsePadding parses a padding in pixels
+func parsePadding(value string) (int, error) {
+	padding, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if padding < 0 || padding > maxPadding {
+		return 0, fmt.Errorf("padding must be between 0 and %d", maxPadding)
+	}
+	return padding, nil
+}
+
+// parseMattingValue parses an alpha matting threshold or erode size
+func parseMattingValue(value string) (int, error) {
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if v < 0 || v > 255 {
+		return 0, fmt.Errorf("must be between 0 and 255")
+	}
+	return v, nil
+}
+
+// parseRange parses a number between lo and hi inclusive
+func parseRange(value string, lo, hi float64) (float64, error) {
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v < lo || v > hi {
+		return 0, fmt.Errorf("must be between %g and %g", lo, hi)
+	}
+	return v, nil
+}
+
+// parseTransformFill parses the proxy bg option, which takes a fill name or
+// a hex color. Uploaded backdrops are not available through the proxy.
+func parseTransformFill(fill *background.Fill, value string) error {
+	mode, c, err := background.ParseFillMode(value)
+	if err != nil {
+		color, colorErr := background.ParseColor(value)
+		if colorErr != nil {
+			return err
+		}
+		mode, c = background.FillColor, &color
+	}
+	if mode == background.FillImage {
+		return fmt.Errorf("backdrop images are not supported here")
+	}
+
+	fill.Mode = mode
+	if c != nil {
+		fill.Color = *c
+	}
+	return nil
+}
@@ -0,0 +1,315 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// batchWorkers bounds the images of a batch processed at the same time
+var batchWorkers = runtime.NumCPU()
+
+// SetBatchWorkers sets how many images of a batch are processed at the same
+// time
+func SetBatchWorkers(n int) {
+	batchWorkers = n
+}
+
+// batchManifestName is the archive entry listing the outcome of every file
+const batchManifestName = "manifest.json"
+
+// batchEntryTimeout is how long each entry of a batch may take to be
+// processed and written. The response as a whole may take longer than the
+// server's write timeout.
+const batchEntryTimeout = 2 * time.Minute
+
+// BatchManifest is the manifest.json of a batch archive
+type BatchManifest struct {
+	Files     []BatchFile `json:"files"`
+	Succeeded int         `json:"succeeded"`
+	Failed    int         `json:"failed"`
+}
+
+// BatchFile is the outcome of one file of a batch. Output names its entry
+// in the archive when it succeeded, Error why it failed otherwise.
+type BatchFile struct {
+	Input  string           `json:"input"`
+	Output string           `json:"output,omitempty"`
+	Format string           `json:"format,omitempty"`
+	Size   int              `json:"size,omitempty"`
+	Choice string           `json:"choice,omitempty"`
+	Error  *errors.AppError `json:"error,omitempty"`
+}
+
+type batchResult struct {
+	file     *upload.File
+	rendered *renderedImage
+	err      error
+}
+
+// ProcessBatch applies one set of /process options to every uploaded image,
+// archives contributing their entries, and streams back a ZIP of the results
+// in upload order with a manifest of the outcome of each file. A file that
+// fails is listed in the manifest without failing the batch.
+func ProcessBatch(w http.ResponseWriter, r *http.Request) {
+	form, err := parseUpload(w, r, "batch")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	if err := expandUploads(form, "images", false); err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	sendBatch(w, r, form, form.File["images"])
+}
+
+// sendBatch processes files with the /process options of r and streams the
+// ZIP of the results
+func sendBatch(w http.ResponseWriter, r *http.Request, form *upload.Form, files []*upload.File) {
+	if len(files) == 0 {
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No images uploaded", nil))
+		return
+	}
+	opts, err := parseOptions(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", "attachment; filename=processed.zip")
+	if opts.OutputFormat == processor.FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+
+	controller := http.NewResponseController(w)
+	err = writeBatch(r.Context(), w, files, opts, func() {
+		controller.SetWriteDeadline(time.Now().Add(batchEntryTimeout))
+	})
+	if err != nil {
+		// The client is gone or the archive is broken, either way it can't
+		// be completed
+		log.Printf("Batch aborted: %v", err)
+	}
+}
+
+// batchToTempFile processes files with opts into a ZIP in a temporary file,
+// returned open at its start. The caller closes and removes the file.
+func batchToTempFile(ctx context.Context, files []*upload.File, opts processor.ProcessOptions) (*os.File, error) {
+	out, err := os.CreateTemp(uploadLimits.Dir, "reubah-batch-*.zip")
+	if err != nil {
+		return nil, errors.New(errors.ErrProcessingFailed, "Failed to create archive", err)
+	}
+	err = writeBatch(ctx, out, files, opts, nil)
+	if err == nil {
+		_, err = out.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		return nil, errors.New(errors.ErrProcessingFailed, "Failed to create archive", err)
+	}
+	return out, nil
+}
+
+// writeBatch processes files with opts on the batch workers and writes the
+// ZIP of the results to w. beforeEntry, if set, is called before waiting for
+// each result.
+func writeBatch(ctx context.Context, w io.Writer, files []*upload.File, opts processor.ProcessOptions, beforeEntry func()) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	pool := newBatchPool(ctx, files, opts)
+
+	out := newBatchArchive(w)
+	for i := range files {
+		if beforeEntry != nil {
+			beforeEntry()
+		}
+		result, ok := pool.result(i)
+		if !ok {
+			return ctx.Err()
+		}
+		if result.err != nil {
+			out.fail(result.file.Filename, errors.Wrap(errors.ErrProcessingFailed, "Failed to process image", result.err))
+			continue
+		}
+		entry := BatchFile{
+			Input:  result.file.Filename,
+			Output: outputName(result.file.Filename, result.rendered.Format),
+			Format: result.rendered.Format,
+			Choice: result.rendered.Choice,
+		}
+		// Images are compressed already
+		if err := out.add(entry, zip.Store, result.rendered.Data); err != nil {
+			return err
+		}
+	}
+	return out.close()
+}
+
+// batchArchive writes the results of a batch to a ZIP, followed by the
+// manifest of the outcome of every file
+type batchArchive struct {
+	zw       *zip.Writer
+	names    map[string]bool
+	manifest BatchManifest
+}
+
+func newBatchArchive(w io.Writer) *batchArchive {
+	return &batchArchive{
+		zw:       zip.NewWriter(w),
+		names:    map[string]bool{batchManifestName: true},
+		manifest: BatchManifest{Files: []BatchFile{}},
+	}
+}
+
+// add writes data as the entry of a file that succeeded, renaming it when its
+// output name is taken
+func (a *batchArchive) add(entry BatchFile, method uint16, data []byte) error {
+	entry.Output = uniqueName(a.names, entry.Output)
+	entry.Size = len(data)
+	if err := writeBatchEntry(a.zw, entry.Output, method, data); err != nil {
+		return err
+	}
+	a.manifest.Files = append(a.manifest.Files, entry)
+	a.manifest.Succeeded++
+	return nil
+}
+
+// fail lists a file that failed in the manifest
+func (a *batchArchive) fail(input string, err *errors.AppError) {
+	a.manifest.Files = append(a.manifest.Files, BatchFile{Input: input, Error: err})
+	a.manifest.Failed++
+}
+
+// close writes the manifest and finishes the archive
+func (a *batchArchive) close() error {
+	data, err := json.MarshalIndent(a.manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeBatchEntry(a.zw, batchManifestName, zip.Deflate, data); err != nil {
+		return err
+	}
+	return a.zw.Close()
+}
+
+// batchPool renders the files of a batch on batchWorkers workers. At most
+// twice as many results as there are workers are held waiting to be
+// written, so memory use doesn't grow with the size of the batch.
+type batchPool struct {
+	ctx     context.Context
+	results []chan batchResult
+	// slots has room for the files started but not yet taken
+	slots chan struct{}
+}
+
+func newBatchPool(ctx context.Context, files []*upload.File, opts processor.ProcessOptions) *batchPool {
+	workers := max(1, min(batchWorkers, len(files)))
+	p := &batchPool{
+		ctx:     ctx,
+		results: make([]chan batchResult, len(files)),
+		slots:   make(chan struct{}, 2*workers),
+	}
+	for i := range p.results {
+		p.results[i] = make(chan batchResult, 1)
+	}
+
+	indexes := make(chan int)
+	go func() {
+		defer close(indexes)
+		for i := range files {
+			select {
+			case p.slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case indexes <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for n := 0; n < workers; n++ {
+		go func() {
+			for i := range indexes {
+				p.results[i] <- renderBatchFile(files[i], opts)
+			}
+		}()
+	}
+	return p
+}
+
+// result waits for the result of file i, false when the batch was cancelled
+func (p *batchPool) result(i int) (batchResult, bool) {
+	select {
+	case result := <-p.results[i]:
+		<-p.slots
+		return result, true
+	case <-p.ctx.Done():
+		return batchResult{}, false
+	}
+}
+
+func renderBatchFile(file *upload.File, opts processor.ProcessOptions) batchResult {
+	data, err := readUploadedImage(file)
+	if err != nil {
+		return batchResult{file: file, err: err}
+	}
+	sourceFormat := ""
+	if strings.EqualFold(path.Ext(file.Filename), ".ico") {
+		sourceFormat = "ico"
+	}
+	rendered, err := renderImage(processor.CacheKey(data, opts), data, sourceFormat, opts)
+	return batchResult{file: file, rendered: rendered, err: err}
+}
+
+func writeBatchEntry(zw *zip.Writer, name string, method uint16, data []byte) error {
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+	if err != nil {
+		return err
+	}
+	_, err = entry.Write(data)
+	return err
+}
+
+// outputName names the result of an input file after it with the extension
+// of format, without the directories of an archive entry
+func outputName(input, format string) string {
+	base := path.Base(strings.ReplaceAll(input, "\\", "/"))
+	base = strings.TrimSuffix(base, path.Ext(base))
+	if base == "" || base == "." || base == "/" {
+		base = "image"
+	}
+	return base + "." + format
+}
+
+// uniqueName returns name, or name with a counter when it is taken, and
+// marks it taken
+func uniqueName(taken map[string]bool, name string) string {
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	unique := name
+	for n := 2; taken[unique]; n++ {
+		unique = stem + "-" + strconv.Itoa(n) + ext
+	}
+	taken[unique] = true
+	return unique
+}
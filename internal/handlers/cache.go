@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/cache"
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// resultCache holds encoded results keyed by processor.CacheKey
+var resultCache cache.Cache = cache.Nop{}
+
+// SetCache sets the cache used for processed images
+func SetCache(c cache.Cache) {
+	resultCache = c
+}
+
+// renderedImage is an encoded processing result
+type renderedImage struct {
+	Data   []byte
+	Format string
+	// Choice explains which encoding FormatSmallest picked
+	Choice string
+}
+
+// renderImage decodes, processes and encodes data, serving repeated
+// requests for the same key from the result cache. The source format is not
+// part of the key because it only selects a decoder for the same bytes.
+// The returned format differs from the requested one when it was negotiated.
+func renderImage(key string, data []byte, sourceFormat string, opts processor.ProcessOptions) (*renderedImage, error) {
+	if record, ok := resultCache.Get(key); ok {
+		if cached, ok := decodeCachedImage(record); ok {
+			return cached, nil
+		}
+	}
+
+	img, err := decodeImageData(data, sourceFormat)
+	if err != nil {
+		return nil, err
+	}
+
+	processedImage, err := processImage(img, opts)
+	if err != nil {
+		log.Printf("Failed to process image: %v", err)
+		return nil, errors.Wrap(errors.ErrProcessingFailed, "Failed to process image", err)
+	}
+
+	var buf bytes.Buffer
+	if err := processedImage.Write(&buf); err != nil {
+		return nil, errors.New(errors.ErrProcessingFailed, "Failed to encode image", err)
+	}
+
+	rendered := &renderedImage{Data: buf.Bytes(), Format: processedImage.Format, Choice: processedImage.Choice}
+	resultCache.Set(key, encodeCachedImage(rendered))
+
+	return rendered, nil
+}
+
+// cachedImageHeader describes the encoded image of a cache record. The
+// format can't be told from the bytes reliably: sniffing finds no image
+// type for PDF or HEIC and names jpg jpeg. The choice is kept in the same
+// record so it can't be evicted apart from the image.
+type cachedImageHeader struct {
+	Format string `json:"format"`
+	Choice string `json:"choice,omitempty"`
+}
+
+// encodeCachedImage returns the cache record of rendered, its header as a
+// line of JSON followed by the encoded image
+func encodeCachedImage(rendered *renderedImage) []byte {
+	header, _ := json.Marshal(cachedImageHeader{Format: rendered.Format, Choice: rendered.Choice})
+	record := make([]byte, 0, len(header)+1+len(rendered.Data))
+	record = append(record, header...)
+	record = append(record, '\n')
+	return append(record, rendered.Data...)
+}
+
+// decodeCachedImage parses a cache record, false when it is not one, such as
+// an entry left by an older version in a disk cache
+func decodeCachedImage(record []byte) (*renderedImage, bool) {
+	line, data, found := bytes.Cut(record, []byte("\n"))
+	if !found {
+		return nil, false
+	}
+	var header cachedImageHeader
+	if err := json.Unmarshal(line, &header); err != nil || header.Format == "" {
+		return nil, false
+	}
+	return &renderedImage{Data: data, Format: header.Format, Choice: header.Choice}, true
+}
+
+// notModified reports whether the request's If-None-Match matches etag
+func notModified(r *http.Request, etag string) bool {
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func sendNotModified(w http.ResponseWriter, etag string) {
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusNotModified)
+}
@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/png"
+	"math"
+	"net/http"
+
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/processor/optimize"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+	"github.com/disintegration/imaging"
+)
+
+// CompareResult is the JSON body returned by CompareImages
+type CompareResult struct {
+	SSIM float64 `json:"ssim"`
+	// PSNR is null when the images are identical
+	PSNR    *float64 `json:"psnr"`
+	MSE     float64  `json:"mse"`
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Resized bool     `json:"resized"`
+	// Format and Size describe the processed output when comparing against
+	// processing options instead of a second image
+	Format  string `json:"format,omitempty"`
+	Size    int    `json:"size,omitempty"`
+	Heatmap string `json:"heatmap"`
+}
+
+// CompareImages measures the visual loss between an image and a reference.
+// With a "reference" upload the two images are compared directly; otherwise
+// "image" is processed with the regular /process options and the result is
+// compared against the original put through the same steps losslessly, so
+// cropping, padding and trimming line up and only the encoding counts as
+// loss.
+func CompareImages(w http.ResponseWriter, r *http.Request) {
+	form, err := parseUpload(w, r, "compare")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	img, data, err := getAndValidateImage(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	var reference, distorted image.Image
+	result := &CompareResult{}
+
+	if len(form.File["reference"]) > 0 {
+		refData, err := readImageUpload(form, "reference")
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		reference, err = decodeImageData(refData, "")
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		distorted = img
+	} else {
+		opts, err := parseOptions(r, form)
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+
+		output, err := renderImage(processor.CacheKey(data, opts), data, r.FormValue("sourceFormat"), opts)
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		distorted, _, err = image.Decode(bytes.NewReader(output.Data))
+		if err != nil {
+			errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to decode processed image", err))
+			return
+		}
+		reference, err = losslessReference(img, opts)
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		result.Format = output.Format
+		result.Size = len(output.Data)
+	}
+
+	// Compare at the distorted size so resizing a second image doesn't count
+	// as loss
+	size := distorted.Bounds().Size()
+	if reference.Bounds().Size() != size {
+		reference = imaging.Resize(reference, size.X, size.Y, imaging.Lanczos)
+		result.Resized = true
+	}
+
+	metrics, err := optimize.Compare(reference, distorted)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to compare images", err))
+		return
+	}
+
+	heatmap, err := optimize.DiffHeatmap(reference, distorted)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to render heatmap", err))
+		return
+	}
+	var heatmapBuf bytes.Buffer
+	if err := png.Encode(&heatmapBuf, heatmap); err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to encode heatmap", err))
+		return
+	}
+
+	result.SSIM = metrics.SSIM
+	result.MSE = metrics.MSE
+	if !math.IsInf(metrics.PSNR, 1) {
+		result.PSNR = &metrics.PSNR
+	}
+	result.Width, result.Height = size.X, size.Y
+	result.Heatmap = "data:image/png;base64," + base64.StdEncoding.EncodeToString(heatmapBuf.Bytes())
+
+	response.JSON(w, http.StatusOK, result)
+}
+
+// losslessReference applies the geometry and background steps of opts to
+// img without the lossy encoding, giving the pixels the processed result
+// should match
+func losslessReference(img image.Image, opts processor.ProcessOptions) (image.Image, error) {
+	opts.OutputFormat = "png"
+	opts.Quality = 100
+	opts.OptimizeImage = false
+	opts.Colors = 0
+	processed, err := processImage(img, opts)
+	if err != nil {
+		return nil, errors.Wrap(errors.ErrProcessingFailed, "Failed to process reference image", err)
+	}
+	return processed.Image, nil
+}
@@ -1,73 +1,141 @@
 package handlers
 
 import (
+	"archive/zip"
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
 	"path/filepath"
 	"strings"
 
 	"github.com/dendianugerah/reubah/internal/processor/document"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
 	"github.com/dendianugerah/reubah/pkg/errors"
 )
 
 func ConvertDocument(w http.ResponseWriter, r *http.Request) {
-	// Parse multipart form
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Unable to parse form", err))
+	form, err := parseUpload(w, r, "document")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if isAsync(r) {
+		submitJob(w, r, "document", form, documentJob)
 		return
 	}
+	defer form.RemoveAll()
 
-	// Get the uploaded file
-	file, header, err := r.FormFile("document")
+	convertedContent, filename, err := convertUploadedDocument(r, form, nil)
 	if err != nil {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No file uploaded", err))
+		errors.SendError(w, err)
 		return
 	}
-	defer file.Close()
 
-	// Check file size (32MB limit)
-	if header.Size > 32<<20 {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "File size exceeds 32MB limit", nil))
+	// Set response headers
+	w.Header().Set("Content-Type", getContentType(strings.TrimPrefix(filepath.Ext(filename), ".")))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+
+	// Write the converted content
+	if _, err := w.Write(convertedContent); err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to send converted document", err))
 		return
 	}
+}
+
+// documentJob converts the uploaded document into the job result store
+func documentJob(r *http.Request, form *upload.Form, progress func(percent int)) (*storage.Result, error) {
+	converted, filename, err := convertUploadedDocument(r, form, progress)
+	if err != nil {
+		return nil, err
+	}
+	return jobResults.Put(filename, getContentType(strings.TrimPrefix(filepath.Ext(filename), ".")), bytes.NewReader(converted))
+}
+
+// convertUploadedDocument converts the "document" upload to the format
+// field, returning the converted content and its filename. An archive has
+// each of its entries converted into a ZIP with a manifest, progress, if
+// set, being told the share of entries done in percent.
+func convertUploadedDocument(r *http.Request, form *upload.Form, progress func(percent int)) ([]byte, string, error) {
+	archived, err := hasArchive(form, "document")
+	if err != nil {
+		return nil, "", err
+	}
+	if archived {
+		if err := expandUploads(form, "document", false); err != nil {
+			return nil, "", err
+		}
+	}
+
+	// Get the uploaded file
+	files := form.File["document"]
+	if len(files) == 0 {
+		return nil, "", errors.New(errors.ErrInvalidFormat, "No file uploaded", nil)
+	}
 
 	// Get the output format
 	outputFormat := r.FormValue("format")
 	if outputFormat == "" {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No output format specified", nil))
-		return
+		return nil, "", errors.New(errors.ErrInvalidFormat, "No output format specified", nil)
 	}
 
+	if !archived {
+		return convertDocumentFile(r.Context(), files[0], outputFormat)
+	}
+
+	var buf bytes.Buffer
+	out := newBatchArchive(&buf)
+	for i, file := range files {
+		if err := r.Context().Err(); err != nil {
+			return nil, "", errors.New(errors.ErrProcessingFailed, "Document conversion cancelled", err)
+		}
+		if progress != nil {
+			progress(i * 100 / len(files))
+		}
+		converted, _, err := convertDocumentFile(r.Context(), file, outputFormat)
+		if err != nil {
+			out.fail(file.Filename, errors.Wrap(errors.ErrProcessingFailed, "Document conversion failed", err))
+			continue
+		}
+		entry := BatchFile{Input: file.Filename, Output: outputName(file.Filename, outputFormat), Format: outputFormat}
+		if err := out.add(entry, zip.Deflate, converted); err != nil {
+			return nil, "", errors.New(errors.ErrProcessingFailed, "Failed to create archive", err)
+		}
+	}
+	if err := out.close(); err != nil {
+		return nil, "", errors.New(errors.ErrProcessingFailed, "Failed to create archive", err)
+	}
+	return buf.Bytes(), "converted.zip", nil
+}
+
+// convertDocumentFile converts one uploaded document to outputFormat, its
+// input format being its extension, giving up when ctx ends
+func convertDocumentFile(ctx context.Context, header *upload.File, outputFormat string) ([]byte, string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, "", errors.New(errors.ErrInvalidFormat, "Failed to open file", err)
+	}
+	defer file.Close()
+
 	// Get input format from file extension
 	inputFormat := strings.TrimPrefix(filepath.Ext(header.Filename), ".")
-	
+
 	// Validate formats
 	if !document.IsFormatSupported(inputFormat, outputFormat) {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, 
-			fmt.Sprintf("Conversion from %s to %s is not supported", inputFormat, outputFormat), nil))
-		return
+		return nil, "", errors.New(errors.ErrInvalidFormat,
+			fmt.Sprintf("Conversion from %s to %s is not supported", inputFormat, outputFormat), nil)
 	}
 
 	// Convert document directly from the uploaded file
-	convertedContent, err := document.ConvertDocument(file, inputFormat, outputFormat)
+	convertedContent, err := document.ConvertDocument(ctx, file, inputFormat, outputFormat)
 	if err != nil {
 		fmt.Printf("Document conversion error: %v\n", err)
-		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Document conversion failed", err))
-		return
+		return nil, "", errors.New(errors.ErrProcessingFailed, "Document conversion failed", err)
 	}
 
-	// Set response headers
-	w.Header().Set("Content-Type", getContentType(outputFormat))
-	w.Header().Set("Content-Disposition", 
-		fmt.Sprintf(`attachment; filename="%s.%s"`, 
-			strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename)), 
-			outputFormat))
-
-	// Write the converted content
-	if _, err := w.Write(convertedContent); err != nil {
-		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to send converted document", err))
-		return
-	}
+	filename := strings.TrimSuffix(header.Filename, filepath.Ext(header.Filename)) + "." + outputFormat
+	return convertedContent, filename, nil
 }
 
 func getContentType(format string) string {
@@ -78,10 +146,11 @@ func getContentType(format string) string {
 		"odt":  "application/vnd.oasis.opendocument.text",
 		"txt":  "text/plain",
 		"rtf":  "application/rtf",
+		"zip":  "application/zip",
 	}
-	
+
 	if ct, ok := contentTypes[format]; ok {
 		return ct
 	}
 	return "application/octet-stream"
-} 
\ No newline at end of file
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/processor/phash"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// defaultDuplicateThreshold is the largest pHash distance still treated as
+// the same picture. Rescaled and recompressed copies stay well below it.
+const defaultDuplicateThreshold = 10
+
+// ImageHash is the hash entry of one uploaded image
+type ImageHash struct {
+	Filename string `json:"filename"`
+	phash.Hashes
+}
+
+// HashResult is the JSON body returned by HashImages
+type HashResult struct {
+	Images []ImageHash `json:"images"`
+	// Duplicates lists groups of near-duplicates as indices into Images
+	Duplicates [][]int `json:"duplicates,omitempty"`
+	Threshold  int     `json:"threshold,omitempty"`
+}
+
+// HashImages returns aHash, dHash and pHash of every uploaded image. With
+// group=true, images whose pHashes are within threshold bits are grouped as
+// near-duplicates.
+func HashImages(w http.ResponseWriter, r *http.Request) {
+	form, err := parseUpload(w, r, "hash")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	files := append(form.File["images"], form.File["image"]...)
+	if len(files) == 0 {
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No files uploaded", nil))
+		return
+	}
+
+	result := HashResult{Images: make([]ImageHash, 0, len(files))}
+	for _, fileHeader := range files {
+		hashes, err := hashUploadedFile(fileHeader)
+		if err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		result.Images = append(result.Images, ImageHash{Filename: fileHeader.Filename, Hashes: hashes})
+	}
+
+	if r.FormValue("group") == "true" {
+		threshold := defaultDuplicateThreshold
+		if v := r.FormValue("threshold"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 || n > 64 {
+				errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Threshold must be between 0 and 64", err))
+				return
+			}
+			threshold = n
+		}
+
+		hashes := make([]phash.Hashes, len(result.Images))
+		for i, img := range result.Images {
+			hashes[i] = img.Hashes
+		}
+		result.Duplicates = phash.Group(hashes, threshold)
+		result.Threshold = threshold
+	}
+
+	response.JSON(w, http.StatusOK, result)
+}
+
+func hashUploadedFile(file *upload.File) (phash.Hashes, error) {
+	data, err := readUploadedImage(file)
+	if err != nil {
+		return phash.Hashes{}, err
+	}
+
+	sourceFormat := strings.TrimPrefix(strings.ToLower(filepath.Ext(file.Filename)), ".")
+	img, err := decodeImageData(data, sourceFormat)
+	if err != nil {
+		return phash.Hashes{}, err
+	}
+
+	return phash.Compute(img), nil
+}
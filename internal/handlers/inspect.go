@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/dendianugerah/reubah/internal/processor/metadata"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// InspectResult is the JSON body returned by InspectImage
+type InspectResult struct {
+	Filename string `json:"filename"`
+	*metadata.Info
+}
+
+// InspectImage reports dimensions, format, color information, frame count,
+// EXIF and ICC details of an uploaded image without transforming it
+func InspectImage(w http.ResponseWriter, r *http.Request) {
+	form, err := parseUpload(w, r, "inspect")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	img, data, err := getAndValidateImage(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, InspectResult{
+		Filename: form.File["image"][0].Filename,
+		Info:     metadata.Inspect(data, img),
+	})
+}
@@ -0,0 +1,208 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/jobs"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/internal/webhook"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+	"github.com/gorilla/mux"
+)
+
+// jobQueue runs the requests sent with async=true and jobResults keeps
+// their results. jobBaseURL prefixes the links to both, empty to derive
+// them from the request.
+var (
+	jobQueue   *jobs.Queue
+	jobResults *storage.Store
+	jobBaseURL string
+)
+
+// SetJobs sets the queue for asynchronous requests, the store for their
+// results and the base of the links to them
+func SetJobs(queue *jobs.Queue, results *storage.Store, baseURL string) {
+	jobQueue = queue
+	jobResults = results
+	jobBaseURL = baseURL
+}
+
+// jobWebhooks sends the callbacks of jobs, nil when callbacks are disabled
+var jobWebhooks *webhook.Dispatcher
+
+// SetWebhooks sets the dispatcher of job callbacks
+func SetWebhooks(dispatcher *webhook.Dispatcher) {
+	jobWebhooks = dispatcher
+}
+
+// Events posted to the callback URL of a job
+const (
+	eventJobDone   = "job.done"
+	eventJobFailed = "job.failed"
+)
+
+// JobStatus is the JSON body describing a job
+type JobStatus struct {
+	ID     string      `json:"id"`
+	Kind   string      `json:"kind"`
+	Status jobs.Status `json:"status" enum:"queued,running,done,failed"`
+	// Progress is the share of the work done in percent
+	Progress  int    `json:"progress"`
+	StatusURL string `json:"statusURL"`
+	// ResultURL and Result are set when the job is done, Error when it
+	// failed
+	ResultURL string           `json:"resultURL,omitempty"`
+	Result    *storage.Result  `json:"result,omitempty"`
+	Error     *errors.AppError `json:"error,omitempty"`
+	Created   time.Time        `json:"created"`
+	Started   *time.Time       `json:"started,omitempty"`
+	Finished  *time.Time       `json:"finished,omitempty"`
+}
+
+// JobEvent is the JSON body posted to the callback URL of a job when it
+// ends. Failed jobs carry the error code and message in error.
+type JobEvent struct {
+	Event string `json:"event" enum:"job.done,job.failed"`
+	JobStatus
+}
+
+// jobWork does the work of an asynchronous request, storing its result in
+// jobResults
+type jobWork func(r *http.Request, form *upload.Form, progress func(percent int)) (*storage.Result, error)
+
+// isAsync reports whether r asks to run as a job, which a callback URL
+// implies
+func isAsync(r *http.Request) bool {
+	return r.FormValue("async") == "true" || r.FormValue("callbackURL") != ""
+}
+
+// submitJob queues work as a job of kind and answers with its status. The
+// job takes over form and removes it when it ends, then posts to the
+// callback URL of the request if it has one.
+func submitJob(w http.ResponseWriter, r *http.Request, kind string, form *upload.Form, work jobWork) {
+	if jobQueue == nil {
+		form.RemoveAll()
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Asynchronous processing is not available", nil))
+		return
+	}
+	callbackURL := r.FormValue("callbackURL")
+	if callbackURL != "" {
+		err := webhook.ValidateURL(callbackURL)
+		if err == nil && jobWebhooks == nil {
+			err = errors.New(errors.ErrInvalidFormat, "Callbacks are not configured on this server", nil)
+		}
+		if err != nil {
+			form.RemoveAll()
+			errors.SendError(w, err)
+			return
+		}
+	}
+
+	// The job outlives the request, so it gets a copy of the parsed fields
+	// that isn't cancelled with it
+	detached := r.Clone(context.Background())
+	job, err := jobQueue.Submit(kind, func(ctx context.Context, progress func(int)) (*storage.Result, error) {
+		defer form.RemoveAll()
+		if err := ctx.Err(); err != nil {
+			return nil, errors.New(errors.ErrProcessingFailed, "The server shut down before the job ran", err)
+		}
+		return work(detached.WithContext(ctx), form, progress)
+	}, func(job jobs.Job) {
+		if callbackURL != "" {
+			notifyJob(detached, callbackURL, job)
+		}
+	})
+	if err != nil {
+		form.RemoveAll()
+		errors.SendError(w, err)
+		return
+	}
+
+	status := newJobStatus(r, job)
+	w.Header().Set("Location", status.StatusURL)
+	response.JSON(w, http.StatusAccepted, status)
+}
+
+// GetJob reports the status and progress of a job
+func GetJob(w http.ResponseWriter, r *http.Request) {
+	job, err := findJob(mux.Vars(r)["id"])
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	response.JSON(w, http.StatusOK, newJobStatus(r, job))
+}
+
+// GetJobResult serves the result of a finished job
+func GetJobResult(w http.ResponseWriter, r *http.Request) {
+	job, err := findJob(mux.Vars(r)["id"])
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if job.Status != jobs.StatusDone {
+		errors.SendError(w, errors.New(errors.ErrNotFound, "Job "+job.ID+" has no result, it is "+string(job.Status), nil))
+		return
+	}
+	serveResult(w, r, jobResults, job.Result.ID)
+}
+
+// GetJobDeliveries lists the callbacks posted for a job and their attempts
+func GetJobDeliveries(w http.ResponseWriter, r *http.Request) {
+	job, err := findJob(mux.Vars(r)["id"])
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	deliveries := []webhook.Delivery{}
+	if jobWebhooks != nil {
+		deliveries = jobWebhooks.Deliveries(job.ID)
+	}
+	response.JSON(w, http.StatusOK, deliveries)
+}
+
+// notifyJob posts the outcome of job to callbackURL, r being the request that
+// submitted it
+func notifyJob(r *http.Request, callbackURL string, job jobs.Job) {
+	event := eventJobDone
+	if job.Status == jobs.StatusFailed {
+		event = eventJobFailed
+	}
+	jobWebhooks.Send(job.ID, callbackURL, event, &JobEvent{Event: event, JobStatus: *newJobStatus(r, job)})
+}
+
+func findJob(id string) (jobs.Job, error) {
+	if jobQueue != nil {
+		if job, ok := jobQueue.Get(id); ok {
+			return job, nil
+		}
+	}
+	return jobs.Job{}, errors.New(errors.ErrNotFound, "Job not found or expired", nil)
+}
+
+func newJobStatus(r *http.Request, job jobs.Job) *JobStatus {
+	status := &JobStatus{
+		ID:        job.ID,
+		Kind:      job.Kind,
+		Status:    job.Status,
+		Progress:  job.Progress,
+		StatusURL: absoluteURL(jobBaseURL, r, "/jobs/"+job.ID),
+		Error:     job.Error,
+		Created:   job.Created,
+	}
+	if !job.Started.IsZero() {
+		status.Started = &job.Started
+	}
+	if !job.Finished.IsZero() {
+		status.Finished = &job.Finished
+	}
+	if job.Result != nil {
+		status.Result = job.Result
+		status.ResultURL = status.StatusURL + "/result"
+	}
+	return status
+}
@@ -1,103 +1,132 @@
 package handlers
 
 import (
-	"bytes"
+	"context"
 	"image"
 	"io"
-	"mime/multipart"
 	"net/http"
+	"os"
 	"strconv"
 	"time"
 
 	"github.com/dendianugerah/reubah/internal/processor/document"
-	"github.com/dendianugerah/reubah/internal/validator"
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/internal/upload"
 	"github.com/dendianugerah/reubah/pkg/errors"
 )
 
-// seekableReader wraps a *bytes.Reader to implement io.ReadSeeker
-type seekableReader struct {
-	*bytes.Reader
-}
-
 func MergePDF(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Unable to parse form", err))
+	form, err := parseUpload(w, r, "merge-pdf")
+	if err != nil {
+		errors.SendError(w, err)
 		return
 	}
-
-	// Get all uploaded files
-	files := r.MultipartForm.File["images"]
-	if len(files) == 0 {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "No files uploaded", nil))
+	if isAsync(r) {
+		submitJob(w, r, "merge-pdf", form, mergeJob)
 		return
 	}
+	defer form.RemoveAll()
 
-	// Process images
-	images, err := processUploadedFiles(files)
+	pdf, err := mergeToTempFile(r, form, nil)
 	if err != nil {
 		errors.SendError(w, err)
 		return
 	}
+	defer os.Remove(pdf.Name())
+	defer pdf.Close()
 
-	// Get PDF options from form
-	opts := document.PDFOptions{
-		PageSize:      r.FormValue("pageSize"),
-		Orientation:   r.FormValue("orientation"),
-		ImagesPerPage: getImagesPerPage(r.FormValue("imagesPerPage")),
-		Quality:       85, // Default quality
-	}
+	// Send response
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "attachment; filename=merged.pdf")
+	http.ServeContent(w, r, "merged.pdf", time.Now(), pdf)
+}
 
-	// Generate PDF
-	pdfReader, err := document.MergeToPDF(images, opts)
+// mergeJob merges the uploaded images into the job result store
+func mergeJob(r *http.Request, form *upload.Form, progress func(percent int)) (*storage.Result, error) {
+	pdf, err := mergeToTempFile(r, form, progress)
 	if err != nil {
-		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to generate PDF", err))
-		return
+		return nil, err
 	}
+	defer os.Remove(pdf.Name())
+	defer pdf.Close()
+	return jobResults.Put("merged.pdf", "application/pdf", pdf)
+}
 
-	// Convert io.Reader to []byte
-	pdfBytes, err := io.ReadAll(pdfReader)
+// mergeToTempFile generates the PDF into a temporary file, returned open at
+// its start, so the images are decoded one at a time while it is written.
+// The caller closes and removes the file.
+func mergeToTempFile(r *http.Request, form *upload.Form, progress func(percent int)) (*os.File, error) {
+	pdf, err := os.CreateTemp(uploadLimits.Dir, "reubah-merge-*.pdf")
 	if err != nil {
-		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to read PDF", err))
-		return
+		return nil, errors.New(errors.ErrProcessingFailed, "Failed to generate PDF", err)
 	}
-
-	// Create seekable reader from bytes
-	seeker := &seekableReader{bytes.NewReader(pdfBytes)}
-
-	// Send response
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", "attachment; filename=merged.pdf")
-	http.ServeContent(w, r, "merged.pdf", time.Now(), seeker)
+	if err := mergeUploadedImages(pdf, r, form, progress); err != nil {
+		pdf.Close()
+		os.Remove(pdf.Name())
+		return nil, err
+	}
+	if _, err := pdf.Seek(0, io.SeekStart); err != nil {
+		pdf.Close()
+		os.Remove(pdf.Name())
+		return nil, errors.New(errors.ErrProcessingFailed, "Failed to generate PDF", err)
+	}
+	return pdf, nil
 }
 
-func processUploadedFiles(files []*multipart.FileHeader) ([]image.Image, error) {
-	images := make([]image.Image, 0, len(files))
+// mergeUploadedImages writes the "images" uploads to w as a PDF laid out by
+// the pageSize, orientation and imagesPerPage fields. Archives contribute
+// their entries in natural filename order. progress, if set, is told the
+// share of images merged so far in percent. Merging stops between images
+// once the request context ends.
+func mergeUploadedImages(w io.Writer, r *http.Request, form *upload.Form, progress func(percent int)) error {
+	if err := expandUploads(form, "images", true); err != nil {
+		return err
+	}
 
-	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
-		if err != nil {
-			return nil, errors.New(errors.ErrInvalidFormat, "Failed to open file", err)
-		}
-		defer file.Close()
+	// Get all uploaded files
+	files := form.File["images"]
+	if len(files) == 0 {
+		return errors.New(errors.ErrInvalidFormat, "No files uploaded", nil)
+	}
 
-		if err := validator.ValidateMIMEType(file); err != nil {
-			return nil, errors.New(errors.ErrInvalidMIME, "Invalid file type", err)
-		}
+	// Get PDF options from form
+	opts := document.PDFOptions{
+		PageSize:      r.FormValue("pageSize"),
+		Orientation:   r.FormValue("orientation"),
+		ImagesPerPage: getImagesPerPage(r.FormValue("imagesPerPage")),
+		Quality:       defaults.PDFQuality,
+	}
 
-		// Reset file pointer after MIME check
-		if _, err := file.Seek(0, 0); err != nil {
-			return nil, errors.New(errors.ErrInvalidFormat, "Failed to process file", err)
-		}
+	if err := document.MergeToPDF(w, &uploadedImages{ctx: r.Context(), files: files, progress: progress}, opts); err != nil {
+		return errors.Wrap(errors.ErrProcessingFailed, "Failed to generate PDF", err)
+	}
+	return nil
+}
 
-		img, _, err := image.Decode(file)
-		if err != nil {
-			return nil, errors.New(errors.ErrInvalidFormat, "Invalid image file", err)
-		}
+// uploadedImages decodes spooled uploads on demand for document.MergeToPDF,
+// failing once ctx ends
+type uploadedImages struct {
+	ctx      context.Context
+	files    []*upload.File
+	progress func(percent int)
+}
 
-		images = append(images, img)
-	}
+func (u *uploadedImages) Len() int {
+	return len(u.files)
+}
 
-	return images, nil
+func (u *uploadedImages) Image(i int) (image.Image, error) {
+	if err := u.ctx.Err(); err != nil {
+		return nil, errors.New(errors.ErrProcessingFailed, "Merge cancelled", err)
+	}
+	if u.progress != nil {
+		u.progress(i * 100 / len(u.files))
+	}
+	data, err := readUploadedImage(u.files[i])
+	if err != nil {
+		return nil, err
+	}
+	return decodeImageData(data, "")
 }
 
 func getImagesPerPage(value string) int {
@@ -109,4 +138,4 @@ func getImagesPerPage(value string) int {
 		return 1
 	}
 	return n
-} 
\ No newline at end of file
+}
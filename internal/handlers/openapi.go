@@ -0,0 +1,458 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/webhook"
+)
+
+// apiOption documents an option of an API endpoint. JSON requests may only
+// use the options listed for their endpoint.
+type apiOption struct {
+	name string
+	// typ is the OpenAPI type of the value
+	typ  string
+	doc  string
+	enum []string
+}
+
+// processOptions are the fields of /process accepted by the API
+var processOptions = []apiOption{
+	{"format", "string", "Output format, auto negotiates with the Accept header and smallest picks the smallest encoding",
+		[]string{"jpeg", "jpg", "png", "webp", "gif", "bmp", "heic", "heif", "pdf", "ico", "auto", "smallest"}},
+	{"quality", "string", "Encoding quality", []string{"low", "medium", "high", "lossless"}},
+	{"optimize", "boolean", "Optimize the encoded image", nil},
+	{"minSSIM", "number", "Lowest similarity to the original the smallest format may pick, in (0, 1]", nil},
+	{"colors", "integer", "Palette size of PNG and GIF output, 2 to 256", nil},
+	{"dither", "boolean", "Dither when reducing colors, true by default", nil},
+	{"sourceFormat", "string", "Format of the input when it can't be detected", []string{"ico"}},
+
+	{"width", "integer", "Target width in pixels", nil},
+	{"height", "integer", "Target height in pixels", nil},
+	{"scale", "string", "Size relative to the source, such as 50%, up to 1000%", nil},
+	{"longEdge", "integer", "Length of the longer side, keeping the aspect ratio", nil},
+	{"shortEdge", "integer", "Length of the shorter side, keeping the aspect ratio", nil},
+	{"maxMegapixels", "number", "Upper bound of the output pixel count in millions", nil},
+	{"resizeMode", "string", "How the image is fitted to width and height", []string{"fit", "fill", "stretch", "pad"}},
+	{"anchor", "string", "Placement on the canvas and the part kept by fill",
+		[]string{"center", "top", "bottom", "left", "right", "topleft", "topright", "bottomleft", "bottomright"}},
+	{"padColor", "string", "Canvas color of pad, a hex color or transparent", nil},
+	{"filter", "string", "Resampling filter", []string{"lanczos", "catmullrom", "mitchell", "linear", "box", "nearest"}},
+	{"withoutEnlargement", "boolean", "Never upscale", nil},
+	{"dpr", "number", "Device pixel ratio multiplying width and height, 1 to 5", nil},
+
+	{"trim", "boolean", "Crop uniform or transparent borders", nil},
+	{"trimTolerance", "number", "How far in percent a border pixel may differ", nil},
+	{"trimPadding", "integer", "Pixels of border added back after trimming", nil},
+
+	{"removeBackground", "boolean", "Make the background transparent", nil},
+	{"bgMethod", "string", "Background removal method", []string{"auto", "chroma"}},
+	{"bgTolerance", "number", "Color distance still counted as background, in percent", nil},
+	{"bgColor", "string", "Key color of chroma, a hex color", nil},
+	{"bgFeather", "number", "Softens the cut-out edge over this many pixels", nil},
+	{"bgModel", "string", "rembg model", []string{"u2net", "u2netp", "u2net_human_seg", "isnet", "isnet-general-use", "isnet-anime", "silueta"}},
+	{"bgAlphaMatting", "boolean", "Refine fine edges with rembg", nil},
+	{"bgMattingForeground", "integer", "Alpha matting foreground threshold", nil},
+	{"bgMattingBackground", "integer", "Alpha matting background threshold", nil},
+	{"bgMattingErode", "integer", "Alpha matting erode size", nil},
+	{"bgFill", "string", "Replaces the transparent background, image uses the backdrop source",
+		[]string{"none", "white", "color", "blur", "image"}},
+	{"bgFillColor", "string", "Color of the color fill, a hex color", nil},
+	{"bgBlur", "number", "Blur strength of the blur fill", nil},
+	{"shadow", "boolean", "Add a drop shadow under the subject", nil},
+	{"shadowBlur", "number", "Blur of the shadow", nil},
+	{"shadowOpacity", "number", "Opacity of the shadow, 0 to 1", nil},
+	{"shadowOffsetX", "integer", "Horizontal shadow offset in pixels", nil},
+	{"shadowOffsetY", "integer", "Vertical shadow offset in pixels", nil},
+	{"padding", "integer", "Crop to the subject and center it with this many pixels on every side", nil},
+}
+
+// documentOptions are the fields of /process/document accepted by the API
+var documentOptions = []apiOption{
+	{"format", "string", "Output format", []string{"pdf", "docx", "doc", "odt", "rtf", "txt"}},
+	asyncOption,
+	callbackOption,
+}
+
+// mergeOptions are the fields of /process/merge-pdf accepted by the API
+var mergeOptions = []apiOption{
+	{"pageSize", "string", "Page size", []string{"A3", "A4", "A5", "letter", "legal"}},
+	{"orientation", "string", "Page orientation, auto follows the first image", []string{"auto", "portrait", "landscape"}},
+	{"imagesPerPage", "integer", "Images per page, 1 to 4", nil},
+	asyncOption,
+	callbackOption,
+}
+
+// asyncOption runs a request as a job
+var asyncOption = apiOption{"async", "boolean", "Run as a job and answer at once with its status, to be polled at /jobs/{id}", nil}
+
+// callbackOption runs a request as a job and posts the outcome to a URL
+var callbackOption = apiOption{"callbackURL", "string",
+	"Run as a job and post a signed JobEvent to this URL when it ends", nil}
+
+func (o apiOption) schema() map[string]interface{} {
+	schema := map[string]interface{}{"type": o.typ, "description": o.doc}
+	if o.enum != nil {
+		schema["enum"] = o.enum
+	}
+	return schema
+}
+
+// OpenAPI serves the OpenAPI 3 document describing the API
+func (h *APIHandler) OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(h.openAPI)
+}
+
+// Docs serves Swagger UI for the OpenAPI document. Its assets are not
+// checked in: `npm run build` in templates copies them to static/swagger-ui,
+// as the Docker image does.
+func (h *APIHandler) Docs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(swaggerUIPage))
+}
+
+// swaggerUIPage loads Swagger UI from the static files, where the build
+// copies the pinned swagger-ui-dist package, and points it at the document,
+// relative to /api/v1/docs. Without the bundle it says how to build it.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8">
+  <title>Reubah API</title>
+  <link rel="stylesheet" href="/static/swagger-ui/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <p id="swagger-missing" hidden>
+    Swagger UI is not built. Run <code>npm install &amp;&amp; npm run build</code> in
+    <code>templates</code> to copy it to <code>static/swagger-ui</code>, or read the
+    <a href="openapi.json">OpenAPI document</a> directly.
+  </p>
+  <script src="/static/swagger-ui/swagger-ui-bundle.js"></script>
+  <script>
+    if (window.SwaggerUIBundle) {
+      window.ui = SwaggerUIBundle({ url: "openapi.json", dom_id: "#swagger-ui" });
+    } else {
+      document.getElementById("swagger-missing").hidden = false;
+    }
+  </script>
+</body>
+</html>
+`
+
+// uploadEndpoint describes a POST endpoint of the API for the document
+type uploadEndpoint struct {
+	path        string
+	summary     string
+	description string
+	request     apiRequest
+}
+
+var uploadEndpoints = []uploadEndpoint{
+	{
+		"/images/process", "Process an image",
+		"Resizes, converts, trims and removes backgrounds with the options of /process. A ZIP, tar or " +
+			"tar.gz image is processed entry by entry into a ZIP of the results with a manifest.json.",
+		&ProcessRequest{},
+	},
+	{
+		"/documents/convert", "Convert a document",
+		"Converts a document to the format option, the input format is taken from the file extension. " +
+			"A ZIP, tar or tar.gz document has every entry converted into a ZIP with a manifest.json.",
+		&DocumentRequest{},
+	},
+	{
+		"/pdf/merge", "Merge images into a PDF",
+		"Lays out the images in order, imagesPerPage to a page. ZIP, tar and tar.gz images contribute " +
+			"their entries in natural filename order.",
+		&MergeRequest{},
+	},
+}
+
+// openAPIDocument generates the OpenAPI document from the request and
+// result types and the option tables
+func openAPIDocument(baseURL string) ([]byte, error) {
+	paths := map[string]interface{}{}
+	for _, e := range uploadEndpoints {
+		requestType := reflect.TypeOf(e.request)
+
+		jsonSchema := schemaOf(requestType, false)
+		jsonSchema["properties"].(map[string]interface{})["options"] = map[string]interface{}{
+			"type":                 "object",
+			"properties":           optionSchemas(e.request.options()),
+			"additionalProperties": false,
+		}
+
+		// Multipart requests send the options as fields next to the files
+		multipartSchema := schemaOf(requestType, true)
+		properties := multipartSchema["properties"].(map[string]interface{})
+		delete(properties, "options")
+		for name, schema := range optionSchemas(e.request.options()) {
+			properties[name] = schema
+		}
+
+		responses := map[string]interface{}{
+			"200":     jsonResponse("The result", "#/components/schemas/Result"),
+			"default": jsonResponse("The request failed", "#/components/schemas/Error"),
+		}
+		if hasOption(e.request.options(), asyncOption.name) {
+			responses["202"] = jsonResponse("The job running the request", "#/components/schemas/Job")
+		}
+		operation := map[string]interface{}{
+			"summary":     e.summary,
+			"description": e.description,
+			"requestBody": map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json":    map[string]interface{}{"schema": jsonSchema},
+					"multipart/form-data": map[string]interface{}{"schema": multipartSchema},
+				},
+			},
+			"responses": responses,
+		}
+		if hasOption(e.request.options(), callbackOption.name) {
+			operation["callbacks"] = jobCallback
+		}
+		paths[e.path] = map[string]interface{}{"post": operation}
+	}
+
+	paths["/results/{id}"] = map[string]interface{}{
+		"get": map[string]interface{}{
+			"summary":     "Download a result",
+			"description": "Serves a result linked from a response until it expires.",
+			"parameters": []interface{}{map[string]interface{}{
+				"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+			}},
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The result file",
+					"content": map[string]interface{}{
+						"*/*": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+					},
+				},
+				"404": jsonResponse("The result doesn't exist or has expired", "#/components/schemas/Error"),
+			},
+		},
+	}
+
+	// Jobs are shared with the classic endpoints and live outside the API
+	rootServers := []interface{}{map[string]interface{}{"url": baseURL + "/"}}
+	jobID := []interface{}{map[string]interface{}{
+		"name": "id", "in": "path", "required": true, "schema": map[string]interface{}{"type": "string"},
+	}}
+	paths["/jobs/{id}"] = map[string]interface{}{
+		"servers": rootServers,
+		"get": map[string]interface{}{
+			"summary":    "Get the status of a job",
+			"parameters": jobID,
+			"responses": map[string]interface{}{
+				"200": jsonResponse("The job", "#/components/schemas/Job"),
+				"404": jsonResponse("The job doesn't exist or has expired", "#/components/schemas/Error"),
+			},
+		},
+	}
+	paths["/jobs/{id}/result"] = map[string]interface{}{
+		"servers": rootServers,
+		"get": map[string]interface{}{
+			"summary":    "Download the result of a job",
+			"parameters": jobID,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The result file",
+					"content": map[string]interface{}{
+						"*/*": map[string]interface{}{"schema": map[string]interface{}{"type": "string", "format": "binary"}},
+					},
+				},
+				"404": jsonResponse("The job isn't done, doesn't exist or has expired", "#/components/schemas/Error"),
+			},
+		},
+	}
+
+	paths["/jobs/{id}/deliveries"] = map[string]interface{}{
+		"servers": rootServers,
+		"get": map[string]interface{}{
+			"summary":     "List the callbacks of a job",
+			"description": "The callbacks posted for a job, with every attempt and its outcome.",
+			"parameters":  jobID,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The deliveries",
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{"schema": envelopeSchema("data", map[string]interface{}{
+							"type":  "array",
+							"items": map[string]interface{}{"$ref": "#/components/schemas/Delivery"},
+						})},
+					},
+				},
+				"404": jsonResponse("The job doesn't exist or has expired", "#/components/schemas/Error"),
+			},
+		},
+	}
+
+	server := baseURL + APIPrefix
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "Reubah API",
+			"version": "1.0.0",
+			"description": "Image processing, document conversion and PDF merging. Requests are either " +
+				"multipart uploads or JSON with sources given as base64 or URLs.",
+		},
+		"servers": []interface{}{map[string]interface{}{"url": server}},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Result":   envelopeSchema("data", schemaOf(reflect.TypeOf(APIResult{}), false)),
+				"Job":      envelopeSchema("data", schemaOf(reflect.TypeOf(JobStatus{}), false)),
+				"JobEvent": schemaOf(reflect.TypeOf(JobEvent{}), false),
+				"Delivery": schemaOf(reflect.TypeOf(webhook.Delivery{}), false),
+				"Error": envelopeSchema("error", map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"code":    map[string]interface{}{"type": "string"},
+						"message": map[string]interface{}{"type": "string"},
+					},
+				}),
+			},
+		},
+	}, "", "  ")
+}
+
+// jobCallback describes the request posted to the callback URL of a job
+var jobCallback = map[string]interface{}{
+	"jobEnded": map[string]interface{}{
+		"{$request.body#/options/callbackURL}": map[string]interface{}{
+			"post": map[string]interface{}{
+				"description": "Sent when the job is done or failed, retried with backoff until the receiver " +
+					"answers with a 2xx status. " + webhook.SignatureHeader + " holds sha256= and the hex " +
+					"HMAC-SHA256 of the " + webhook.TimestampHeader + " header, a dot and the body, keyed with " +
+					"the webhook secret of the server.",
+				"requestBody": map[string]interface{}{
+					"content": map[string]interface{}{
+						"application/json": map[string]interface{}{
+							"schema": map[string]interface{}{"$ref": "#/components/schemas/JobEvent"},
+						},
+					},
+				},
+				"responses": map[string]interface{}{
+					"2XX": map[string]interface{}{"description": "The callback was received"},
+				},
+			},
+		},
+	},
+}
+
+func optionSchemas(options []apiOption) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	for _, o := range options {
+		schemas[o.name] = o.schema()
+	}
+	return schemas
+}
+
+func jsonResponse(description, ref string) map[string]interface{} {
+	return map[string]interface{}{
+		"description": description,
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": map[string]interface{}{"$ref": ref}},
+		},
+	}
+}
+
+// envelopeSchema wraps schema in the {"success": ..., field: ...} body of
+// every JSON response
+func envelopeSchema(field string, schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"success": map[string]interface{}{"type": "boolean"},
+			field:     schema,
+		},
+	}
+}
+
+var (
+	sourceType = reflect.TypeOf(APISource{})
+	timeType   = reflect.TypeOf(time.Time{})
+)
+
+// schemaOf returns the JSON schema of t, taking property names from the json
+// tags and descriptions and enums from the doc and enum tags. Fields without
+// omitempty are required. With files set, sources are file uploads.
+func schemaOf(t reflect.Type, files bool) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == sourceType && files:
+		return map[string]interface{}{"type": "string", "format": "binary"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": schemaOf(t.Elem(), files)}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": true}
+	case reflect.Struct:
+		properties := map[string]interface{}{}
+		var required []string
+		addProperties(t, files, properties, &required)
+		schema := map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		return schema
+	}
+	return map[string]interface{}{}
+}
+
+func addProperties(t reflect.Type, files bool, properties map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		// Fields of embedded structs are promoted, as in encoding/json
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			addProperties(field.Type, files, properties, required)
+			continue
+		}
+		if !field.IsExported() {
+			continue
+		}
+
+		name, flags, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := schemaOf(field.Type, files)
+		if doc := field.Tag.Get("doc"); doc != "" {
+			schema["description"] = doc
+		}
+		if enum := field.Tag.Get("enum"); enum != "" {
+			schema["enum"] = strings.Split(enum, ",")
+		}
+		properties[name] = schema
+		if !strings.Contains(flags, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/dendianugerah/reubah/internal/processor/palette"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// Bounds of the number of palette colors a client may ask for
+const (
+	defaultPaletteCount = 6
+	maxPaletteCount     = 32
+)
+
+// PaletteResult is the JSON body returned by ExtractPalette
+type PaletteResult struct {
+	Filename string          `json:"filename"`
+	Colors   []palette.Color `json:"colors"`
+}
+
+// ExtractPalette returns the dominant colors of an uploaded image with their
+// share of the image and a readable text color for each
+func ExtractPalette(w http.ResponseWriter, r *http.Request) {
+	form, err := parseUpload(w, r, "palette")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	count := defaultPaletteCount
+	if value := r.FormValue("count"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPaletteCount {
+			errors.SendError(w, errors.New(errors.ErrInvalidFormat,
+				fmt.Sprintf("count must be between 1 and %d", maxPaletteCount), err))
+			return
+		}
+		count = n
+	}
+
+	img, _, err := getAndValidateImage(r, form)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	response.JSON(w, http.StatusOK, PaletteResult{
+		Filename: form.File["image"][0].Filename,
+		Colors:   palette.Extract(img, count),
+	})
+}
@@ -0,0 +1,72 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"net/http"
+
+	"github.com/dendianugerah/reubah/internal/processor/placeholder"
+	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/dendianugerah/reubah/pkg/response"
+)
+
+// Values of the "output" field of /process
+const (
+	outputImage       = "image"
+	outputJSON        = "json"
+	outputPlaceholder = "placeholder"
+)
+
+// ProcessJSONResult is the JSON variant of the /process response, carrying
+// the processed image inline together with its placeholders
+type ProcessJSONResult struct {
+	Format       string                    `json:"format"`
+	Size         int                       `json:"size"`
+	Choice       string                    `json:"choice,omitempty"`
+	Data         string                    `json:"data"`
+	Placeholders *placeholder.Placeholders `json:"placeholders"`
+}
+
+// sendPlaceholders responds with the placeholders of the uploaded image
+// without processing it
+func sendPlaceholders(w http.ResponseWriter, data []byte, sourceFormat string) {
+	img, err := decodeImageData(data, sourceFormat)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	p, err := placeholder.Generate(img)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to generate placeholders", err))
+		return
+	}
+	response.JSON(w, http.StatusOK, p)
+}
+
+// sendProcessJSON responds with the processed image as a data URI and the
+// placeholders computed from it
+func sendProcessJSON(w http.ResponseWriter, output *renderedImage, etag string) {
+	img, _, err := image.Decode(bytes.NewReader(output.Data))
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to decode processed image", err))
+		return
+	}
+
+	p, err := placeholder.Generate(img)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrProcessingFailed, "Failed to generate placeholders", err))
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	response.JSON(w, http.StatusOK, &ProcessJSONResult{
+		Format:       output.Format,
+		Size:         len(output.Data),
+		Choice:       output.Choice,
+		Data:         fmt.Sprintf("data:image/%s;base64,%s", output.Format, base64.StdEncoding.EncodeToString(output.Data)),
+		Placeholders: p,
+	})
+}
@@ -8,77 +8,157 @@ import (
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
-	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/dendianugerah/reubah/internal/constants"
 	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/processor/background"
 	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/processor/trim"
+	"github.com/dendianugerah/reubah/internal/upload"
 	"github.com/dendianugerah/reubah/internal/validator"
 	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/disintegration/imaging"
 	"golang.org/x/image/bmp"
 )
 
+// Defaults are used for settings a request leaves out
+type Defaults struct {
+	Format     string
+	Quality    int
+	ResizeMode string
+	PDFQuality int
+}
+
+var defaults = Defaults{
+	Format:     constants.DefaultFormat,
+	Quality:    constants.DefaultQuality,
+	ResizeMode: constants.DefaultResizeMode,
+	PDFQuality: constants.DefaultQuality,
+}
+
+// SetDefaults sets the defaults for settings a request leaves out
+func SetDefaults(d Defaults) {
+	defaults = d
+}
+
+// encodingChoiceHeader explains which encoding the smallest mode picked
+const encodingChoiceHeader = "X-Encoding-Choice"
+
+// Limits of the relative sizing parameters
+const (
+	maxDPR          = 5
+	maxScalePercent = 1000
+)
+
 func ProcessImage(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseMultipartForm(constants.MaxFileSize); err != nil {
-		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Unable to parse form", err))
+	form, err := parseUpload(w, r, "process")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	defer form.RemoveAll()
+
+	// An archive is processed like a batch of its entries
+	archived, err := hasArchive(form, "image")
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if archived {
+		if err := expandUploads(form, "image", false); err != nil {
+			errors.SendError(w, err)
+			return
+		}
+		sendBatch(w, r, form, form.File["image"])
 		return
 	}
 
-	opts, img, err := parseRequest(r)
+	opts, data, err := parseRequest(r, form)
 	if err != nil {
 		errors.SendError(w, err)
 		return
 	}
 
-	processedImage, err := processImage(img, opts)
+	output := r.FormValue("output")
+	switch output {
+	case "", outputImage, outputJSON:
+	case outputPlaceholder:
+		sendPlaceholders(w, data, r.FormValue("sourceFormat"))
+		return
+	default:
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Unsupported output: %s", output), nil))
+		return
+	}
+
+	// The JSON variant is a different representation of the same result
+	key := processor.CacheKey(data, opts)
+	etag := `"` + key + `"`
+	if output == outputJSON {
+		etag = `"` + key + `-json"`
+	}
+	if opts.OutputFormat == processor.FormatAuto {
+		w.Header().Set("Vary", "Accept")
+	}
+	if notModified(r, etag) {
+		sendNotModified(w, etag)
+		return
+	}
+
+	rendered, err := renderImage(key, data, r.FormValue("sourceFormat"), opts)
 	if err != nil {
 		errors.SendError(w, err)
 		return
 	}
 
-	sendResponse(w, processedImage, opts.OutputFormat)
+	if output == outputJSON {
+		sendProcessJSON(w, rendered, etag)
+		return
+	}
+	sendResponse(w, r, rendered, etag)
 }
 
-func parseRequest(r *http.Request) (processor.ProcessOptions, image.Image, error) {
-	img, err := getAndValidateImage(r)
+func parseRequest(r *http.Request, form *upload.Form) (processor.ProcessOptions, []byte, error) {
+	data, err := readImageUpload(form, "image")
 	if err != nil {
 		return processor.ProcessOptions{}, nil, err
 	}
 
-	opts, err := parseOptions(r)
+	opts, err := parseOptions(r, form)
 	if err != nil {
 		return processor.ProcessOptions{}, nil, err
 	}
 
-	return opts, img, nil
+	return opts, data, nil
 }
 
-func getAndValidateImage(r *http.Request) (image.Image, error) {
-	file, header, err := r.FormFile("image")
+// getAndValidateImage reads and decodes the uploaded image, returning the
+// original bytes alongside for callers that inspect the encoding
+func getAndValidateImage(r *http.Request, form *upload.Form) (image.Image, []byte, error) {
+	data, err := readImageUpload(form, "image")
 	if err != nil {
-		return nil, errors.New(errors.ErrInvalidFormat, "No file uploaded", err)
+		return nil, nil, err
 	}
-	defer file.Close()
-
-	log.Printf("Processing file: %s, size: %d bytes", header.Filename, header.Size)
 
-	if err := validator.ValidateMIMEType(file); err != nil {
-		log.Printf("MIME type validation failed: %v", err)
-		return nil, errors.New(errors.ErrInvalidMIME, "Invalid file type", err)
+	img, err := decodeImageData(data, r.FormValue("sourceFormat"))
+	if err != nil {
+		return nil, nil, err
 	}
+	return img, data, nil
+}
 
-	// Read the entire file into memory
-	data, err := io.ReadAll(file)
-	if err != nil {
-		log.Printf("Failed to read file: %v", err)
-		return nil, errors.New(errors.ErrInvalidFormat, "Failed to read file", err)
+// decodeImageData decodes raw image bytes, using the explicit ICO parser when
+// the source format says so and the registered image decoders otherwise.
+// Images over the decode budget are rejected from their header alone.
+func decodeImageData(data []byte, sourceFormat string) (image.Image, error) {
+	if err := validator.ValidateImageData(data); err != nil {
+		return nil, err
 	}
 
 	// Try different decoders based on the source format
-	sourceFormat := r.FormValue("sourceFormat")
 	log.Printf("Source format: %s", sourceFormat)
 
 	if sourceFormat == "ico" {
@@ -216,7 +296,7 @@ func decodeBMP(data []byte) (image.Image, error) {
 	return img, nil
 }
 
-func parseOptions(r *http.Request) (processor.ProcessOptions, error) {
+func parseOptions(r *http.Request, form *upload.Form) (processor.ProcessOptions, error) {
 	width, err := parseDimension(r.FormValue("width"))
 	if err != nil {
 		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid width value", err)
@@ -229,12 +309,27 @@ func parseOptions(r *http.Request) (processor.ProcessOptions, error) {
 
 	format := r.FormValue("format")
 	if format == "" {
-		format = constants.DefaultFormat
+		format = defaults.Format
+	}
+
+	var acceptedFormats []string
+	if format == processor.FormatAuto {
+		acceptedFormats = processor.AcceptedFormats(r.Header.Get("Accept"))
+	}
+
+	minSSIM, err := parseMinSSIM(r.FormValue("minSSIM"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid minSSIM value", err)
+	}
+
+	colors, err := parseColors(r.FormValue("colors"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid colors value", err)
 	}
 
 	resizeMode := r.FormValue("resizeMode")
 	if resizeMode == "" {
-		resizeMode = constants.DefaultResizeMode
+		resizeMode = defaults.ResizeMode
 	}
 
 	parsedResizeMode, err := resize.ParseResizeMode(resizeMode)
@@ -242,27 +337,117 @@ func parseOptions(r *http.Request) (processor.ProcessOptions, error) {
 		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid resize mode", err)
 	}
 
+	scale, err := parseScale(r.FormValue("scale"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid scale value", err)
+	}
+
+	longEdge, err := parseDimension(r.FormValue("longEdge"))
+	if err != nil || longEdge < 0 {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid longEdge value", err)
+	}
+
+	shortEdge, err := parseDimension(r.FormValue("shortEdge"))
+	if err != nil || shortEdge < 0 {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid shortEdge value", err)
+	}
+
+	if err := checkSizing(width > 0 || height > 0, scale > 0, longEdge > 0, shortEdge > 0); err != nil {
+		return processor.ProcessOptions{}, err
+	}
+
+	maxMegapixels, err := parseMaxMegapixels(r.FormValue("maxMegapixels"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid maxMegapixels value", err)
+	}
+
+	filter := r.FormValue("filter")
+	if _, err := resize.ParseFilter(filter); err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid filter value", err)
+	}
+
+	dpr, err := parseDPR(r.FormValue("dpr"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid dpr value", err)
+	}
+
+	padColor, err := parsePadColor(r.FormValue("padColor"))
+	if err != nil {
+		return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid padColor value", err)
+	}
+
+	anchor := imaging.Center
+	if value := r.FormValue("anchor"); value != "" {
+		if anchor, err = resize.ParseAnchor(value); err != nil {
+			return processor.ProcessOptions{}, errors.New(errors.ErrInvalidFormat, "Invalid anchor value", err)
+		}
+	}
+
+	removal, err := parseBackgroundRemoval(r)
+	if err != nil {
+		return processor.ProcessOptions{}, err
+	}
+
+	fill, err := parseBackgroundFill(r, form)
+	if err != nil {
+		return processor.ProcessOptions{}, err
+	}
+
+	trimOpts, err := parseTrim(r)
+	if err != nil {
+		return processor.ProcessOptions{}, err
+	}
+
 	return processor.ProcessOptions{
-		Width:            width,
-		Height:           height,
-		ResizeMode:       parsedResizeMode,
-		OutputFormat:     format,
-		Quality:          parseQuality(r.FormValue("quality")),
-		RemoveBackground: r.FormValue("removeBackground") == "true",
-		OptimizeImage:    r.FormValue("optimize") == "true",
+		Width:              width,
+		Height:             height,
+		ResizeMode:         parsedResizeMode,
+		PadColor:           padColor,
+		Anchor:             anchor,
+		Filter:             filter,
+		WithoutEnlargement: r.FormValue("withoutEnlargement") == "true",
+		DPR:                dpr,
+		Scale:              scale,
+		LongEdge:           longEdge,
+		ShortEdge:          shortEdge,
+		MaxMegapixels:      maxMegapixels,
+		OutputFormat:       format,
+		Quality:            parseQuality(r.FormValue("quality")),
+		RemoveBackground:   r.FormValue("removeBackground") == "true",
+		BackgroundRemoval:  removal,
+		Remover:            bgRemover.ID(),
+		BackgroundFill:     fill,
+		Trim:               r.FormValue("trim") == "true",
+		TrimOptions:        trimOpts,
+		OptimizeImage:      r.FormValue("optimize") == "true",
+		AcceptedFormats:    acceptedFormats,
+		MinSSIM:            minSSIM,
+		Colors:             colors,
+		NoDither:           r.FormValue("dither") == "false",
 	}, nil
 }
 
 func processImage(img image.Image, opts processor.ProcessOptions) (*processor.ProcessedImage, error) {
-	proc := processor.NewImageProcessor()
+	proc := processor.NewImageProcessor().
+		WithConfig(processor.Config{DefaultQuality: defaults.Quality, DefaultFormat: defaults.Format}).
+		WithRemover(bgRemover)
 	return proc.ProcessImageData(img, opts)
 }
 
-func sendResponse(w http.ResponseWriter, img *processor.ProcessedImage, format string) {
-	w.Header().Set("Content-Type", fmt.Sprintf("image/%s", format))
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=processed.%s", format))
+func sendResponse(w http.ResponseWriter, r *http.Request, img *renderedImage, etag string) {
+	if notModified(r, etag) {
+		sendNotModified(w, etag)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("image/%s", img.Format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=processed.%s", img.Format))
+	w.Header().Set("ETag", etag)
+	if img.Choice != "" {
+		w.Header().Set(encodingChoiceHeader, img.Choice)
+	}
 
-	if err := img.Write(w); err != nil {
+	if _, err := w.Write(img.Data); err != nil {
 		log.Printf("Error writing response: %v", err)
 	}
 }
@@ -274,6 +459,126 @@ func parseDimension(value string) (int, error) {
 	return strconv.Atoi(value)
 }
 
+// parseScale parses a percentage such as "50%" or "50" into a factor, 0
+// when unset
+func parseScale(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	if percent <= 0 || percent > maxScalePercent {
+		return 0, fmt.Errorf("scale must be above 0%% and at most %d%%", maxScalePercent)
+	}
+	return percent / 100, nil
+}
+
+// parseMaxMegapixels parses a pixel budget in millions, 0 when unset
+func parseMaxMegapixels(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	mp, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if mp <= 0 {
+		return 0, fmt.Errorf("maxMegapixels must be positive")
+	}
+	return mp, nil
+}
+
+// checkSizing rejects requests combining width/height, scale, longEdge and
+// shortEdge, which would contradict each other
+func checkSizing(set ...bool) error {
+	n := 0
+	for _, s := range set {
+		if s {
+			n++
+		}
+	}
+	if n > 1 {
+		return errors.New(errors.ErrInvalidFormat, "Use only one of width/height, scale, longEdge or shortEdge", nil)
+	}
+	return nil
+}
+
+// parseDPR parses a device pixel ratio, 0 when unset
+func parseDPR(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	dpr, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if dpr < 1 || dpr > maxDPR {
+		return 0, fmt.Errorf("dpr must be between 1 and %d", maxDPR)
+	}
+	return dpr, nil
+}
+
+// parsePadColor parses the canvas color of the pad resize mode, a hex color
+// or "transparent", which is also the default
+func parsePadColor(value string) (color.NRGBA, error) {
+	if value == "" || strings.EqualFold(value, "transparent") {
+		return color.NRGBA{}, nil
+	}
+	return background.ParseColor(value)
+}
+
+// parseTrim parses the trimTolerance and trimPadding fields
+func parseTrim(r *http.Request) (trim.Options, error) {
+	opts := trim.DefaultOptions()
+	if value := r.FormValue("trimTolerance"); value != "" {
+		tolerance, err := parseTolerance(value)
+		if err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid trimTolerance value", err)
+		}
+		opts.Tolerance = tolerance
+	}
+	if value := r.FormValue("trimPadding"); value != "" {
+		padding, err := parsePadding(value)
+		if err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, "Invalid trimPadding value", err)
+		}
+		opts.Padding = padding
+	}
+	return opts, nil
+}
+
+// parseColors parses the palette size for PNG and GIF output
+func parseColors(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if n < 2 || n > 256 {
+		return 0, fmt.Errorf("colors must be between 2 and 256")
+	}
+	return n, nil
+}
+
+// parseMinSSIM parses the quality floor for the smallest-encoding mode
+func parseMinSSIM(value string) (float64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	v, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, err
+	}
+	if v <= 0 || v > 1 {
+		return 0, fmt.Errorf("minSSIM must be in (0, 1]")
+	}
+	return v, nil
+}
+
 func parseQuality(quality string) int {
 	switch quality {
 	case "low":
@@ -285,6 +590,6 @@ func parseQuality(quality string) int {
 	case "lossless":
 		return 100
 	default:
-		return constants.DefaultQuality // default quality
+		return defaults.Quality
 	}
 }
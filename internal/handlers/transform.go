@@ -0,0 +1,237 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/processor"
+	"github.com/dendianugerah/reubah/internal/processor/background"
+	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/processor/trim"
+	"github.com/dendianugerah/reubah/internal/proxy"
+	"github.com/dendianugerah/reubah/internal/validator"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// TransformPrefix is the route prefix of the transformation endpoint
+const TransformPrefix = "/img/"
+
+// transformMaxAge is how long clients and CDNs may cache a transformed image
+const transformMaxAge = 86400 // 1 day in seconds
+
+// TransformHandler serves URLs of the form
+// /img/<signature>/<options>/<source>, fetching the source from the origin
+// and running it through the image processor.
+type TransformHandler struct {
+	origin proxy.Origin
+	signer *proxy.Signer
+}
+
+func NewTransformHandler(origin proxy.Origin, signer *proxy.Signer) *TransformHandler {
+	return &TransformHandler{origin: origin, signer: signer}
+}
+
+func (h *TransformHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Errors must not be cached under the signed URL, only the image and
+	// the 304 revalidating it replace this
+	w.Header().Set("Cache-Control", "no-store")
+
+	signature, options, source, err := splitTransformPath(r.URL.EscapedPath())
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	// The signature covers everything after it, exactly as it was requested
+	if !h.signer.Verify(signature, "/"+options+"/"+source) {
+		errors.SendError(w, errors.New(errors.ErrInvalidSignature, "Invalid URL signature", nil))
+		return
+	}
+
+	name, err := url.PathUnescape(source)
+	if err != nil {
+		errors.SendError(w, errors.New(errors.ErrInvalidFormat, "Invalid source path", err))
+		return
+	}
+
+	opts, err := parseTransformOptions(options)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+	if opts.OutputFormat == processor.FormatAuto {
+		opts.AcceptedFormats = processor.AcceptedFormats(r.Header.Get("Accept"))
+		w.Header().Set("Vary", "Accept")
+	}
+
+	src, err := h.origin.Fetch(r.Context(), name)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	if err := validator.ValidateMIMEBytes(src.Data); err != nil {
+		errors.SendError(w, errors.New(errors.ErrInvalidMIME, "Invalid file type", err))
+		return
+	}
+
+	// Origin content can change under the same name, so the ETag is derived
+	// from the fetched bytes rather than the URL
+	key := processor.CacheKey(src.Data, opts)
+	etag := `"` + key + `"`
+	cacheControl := fmt.Sprintf("public, max-age=%d", transformMaxAge)
+	if notModified(r, etag) {
+		w.Header().Set("Cache-Control", cacheControl)
+		sendNotModified(w, etag)
+		return
+	}
+
+	sourceFormat := strings.TrimPrefix(strings.ToLower(path.Ext(name)), ".")
+	output, err := renderImage(key, src.Data, sourceFormat, opts)
+	if err != nil {
+		errors.SendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf("image/%s", output.Format))
+	w.Header().Set("Cache-Control", cacheControl)
+	if !src.ModTime.IsZero() {
+		w.Header().Set("Last-Modified", src.ModTime.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("ETag", etag)
+	if output.Choice != "" {
+		w.Header().Set(encodingChoiceHeader, output.Choice)
+	}
+
+	if _, err := w.Write(output.Data); err != nil {
+		log.Printf("Error writing response: %v", err)
+	}
+}
+
+// splitTransformPath splits /img/<signature>/<options>/<source> into its parts
+func splitTransformPath(p string) (signature, options, source string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(p, TransformPrefix), "/", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", errors.New(errors.ErrInvalidFormat,
+			"Expected /img/<signature>/<options>/<source>", nil)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
+
+// parseTransformOptions parses a comma-separated option list such as
+// "w_400,h_300,fit_fill,f_webp,q_80"
+func parseTransformOptions(s string) (processor.ProcessOptions, error) {
+	opts := processor.ProcessOptions{
+		ResizeMode:        resize.ModeAspectFit,
+		OutputFormat:      defaults.Format,
+		Quality:           defaults.Quality,
+		BackgroundRemoval: background.DefaultOptions(),
+		Remover:           bgRemover.ID(),
+		BackgroundFill:    background.DefaultFill(),
+		TrimOptions:       trim.DefaultOptions(),
+	}
+
+	for _, option := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(option, "_")
+		if !ok || value == "" {
+			return opts, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Invalid option: %s", option), nil)
+		}
+
+		var err error
+		switch key {
+		case "w":
+			opts.Width, err = parseDimension(value)
+		case "h":
+			opts.Height, err = parseDimension(value)
+		case "fit":
+			opts.ResizeMode, err = resize.ParseResizeMode(value)
+		case "f":
+			opts.OutputFormat = strings.ToLower(value)
+		case "scale":
+			opts.Scale, err = parseScale(value)
+		case "long":
+			opts.LongEdge, err = parseDimension(value)
+		case "short":
+			opts.ShortEdge, err = parseDimension(value)
+		case "mp":
+			opts.MaxMegapixels, err = parseMaxMegapixels(value)
+		case "filter":
+			if _, err = resize.ParseFilter(value); err == nil {
+				opts.Filter = value
+			}
+		case "noup":
+			opts.WithoutEnlargement, err = strconv.ParseBool(value)
+		case "dpr":
+			opts.DPR, err = parseDPR(value)
+		case "pc":
+			opts.PadColor, err = parsePadColor(value)
+		case "a":
+			opts.Anchor, err = resize.ParseAnchor(value)
+		case "q":
+			opts.Quality, err = parseTransformQuality(value)
+		case "ssim":
+			opts.MinSSIM, err = parseMinSSIM(value)
+		case "c":
+			opts.Colors, err = parseColors(value)
+		case "dither":
+			var dither bool
+			dither, err = strconv.ParseBool(value)
+			opts.NoDither = !dither
+		case "opt":
+			opts.OptimizeImage, err = strconv.ParseBool(value)
+		case "rb":
+			opts.RemoveBackground, err = strconv.ParseBool(value)
+		case "rbm":
+			opts.BackgroundRemoval.Method, err = background.ParseMethod(value)
+		case "rbt":
+			opts.BackgroundRemoval.Tolerance, err = parseTolerance(value)
+		case "rbc":
+			opts.BackgroundRemoval.KeyColor, err = background.ParseColor(value)
+		case "rbf":
+			opts.BackgroundRemoval.Feather, err = parseFeather(value)
+		case "rbmodel":
+			opts.BackgroundRemoval.Model, err = background.ParseModel(value)
+		case "rbam":
+			opts.BackgroundRemoval.AlphaMatting, err = strconv.ParseBool(value)
+		case "trim":
+			opts.Trim, err = strconv.ParseBool(value)
+		case "trimt":
+			opts.TrimOptions.Tolerance, err = parseTolerance(value)
+		case "trimp":
+			opts.TrimOptions.Padding, err = parsePadding(value)
+		case "bg":
+			err = parseTransformFill(&opts.BackgroundFill, value)
+		case "shadow":
+			opts.BackgroundFill.Shadow.Enabled, err = strconv.ParseBool(value)
+		case "pad":
+			opts.BackgroundFill.Padding, err = parsePadding(value)
+		default:
+			return opts, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Unknown option: %s", key), nil)
+		}
+		if err != nil {
+			return opts, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("Invalid value for option %s", key), err)
+		}
+	}
+
+	if err := checkSizing(opts.Width > 0 || opts.Height > 0, opts.Scale > 0, opts.LongEdge > 0, opts.ShortEdge > 0); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+// parseTransformQuality accepts either a named quality level or 1-100
+func parseTransformQuality(value string) (int, error) {
+	q, err := strconv.Atoi(value)
+	if err != nil {
+		return parseQuality(value), nil
+	}
+	if q < 1 || q > 100 {
+		return 0, fmt.Errorf("quality must be between 1 and 100")
+	}
+	return q, nil
+}
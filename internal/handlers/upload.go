@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/dendianugerah/reubah/internal/archive"
+	"github.com/dendianugerah/reubah/internal/upload"
+	"github.com/dendianugerah/reubah/internal/validator"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// uploadLimits bounds multipart uploads, endpointLimits overrides it for
+// single endpoints
+var (
+	uploadLimits   = upload.DefaultLimits()
+	endpointLimits = map[string]upload.Limits{}
+)
+
+// SetUploadLimits sets the limits for multipart uploads and their overrides
+// by endpoint name, such as "process" or "merge-pdf"
+func SetUploadLimits(limits upload.Limits, perEndpoint map[string]upload.Limits) {
+	uploadLimits = limits
+	endpointLimits = perEndpoint
+}
+
+// archiveOptions bound the archives uploads are expanded from
+var archiveOptions = archive.DefaultOptions()
+
+// SetArchiveOptions sets the limits for expanding uploaded archives
+func SetArchiveOptions(opts archive.Options) {
+	archiveOptions = opts
+}
+
+// expandUploads replaces the archives uploaded as field by their entries,
+// sorted by natural filename order if sorted is set
+func expandUploads(form *upload.Form, field string, sorted bool) error {
+	opts := archiveOptions
+	opts.Sorted = sorted
+	return archive.Expand(form, field, opts)
+}
+
+// hasArchive reports whether one of the uploads of field is an archive
+func hasArchive(form *upload.Form, field string) (bool, error) {
+	return archive.Contains(form.File[field])
+}
+
+// parseUpload parses the multipart upload of r within the limits of endpoint
+func parseUpload(w http.ResponseWriter, r *http.Request, endpoint string) (*upload.Form, error) {
+	return upload.Parse(w, r, limitsFor(endpoint))
+}
+
+// limitsFor returns the upload limits of endpoint
+func limitsFor(endpoint string) upload.Limits {
+	if limits, ok := endpointLimits[endpoint]; ok {
+		return limits
+	}
+	return uploadLimits
+}
+
+// readImageUpload reads the first image uploaded as field
+func readImageUpload(form *upload.Form, field string) ([]byte, error) {
+	files := form.File[field]
+	if len(files) == 0 {
+		return nil, errors.New(errors.ErrInvalidFormat, "No file uploaded", nil)
+	}
+	return readUploadedImage(files[0])
+}
+
+// readUploadedImage reads a spooled upload into memory after checking its
+// MIME type
+func readUploadedImage(header *upload.File) ([]byte, error) {
+	file, err := header.Open()
+	if err != nil {
+		return nil, errors.New(errors.ErrInvalidFormat, "Failed to open file", err)
+	}
+	defer file.Close()
+
+	log.Printf("Processing file: %s, size: %d bytes", header.Filename, header.Size)
+
+	if err := validator.ValidateMIMEType(file); err != nil {
+		log.Printf("MIME type validation failed: %v", err)
+		return nil, errors.New(errors.ErrInvalidMIME, "Invalid file type: "+header.Filename, err)
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		log.Printf("Failed to read file: %v", err)
+		return nil, errors.New(errors.ErrInvalidFormat, "Failed to read file", err)
+	}
+	return data, nil
+}
@@ -0,0 +1,235 @@
+package jobs
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/storage"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Status is the state of a job
+type Status string
+
+const (
+	StatusQueued  Status = "queued"
+	StatusRunning Status = "running"
+	StatusDone    Status = "done"
+	StatusFailed  Status = "failed"
+)
+
+// Func does the work of a job and stores its result. progress reports the
+// share of the work done in percent. Jobs still queued at shutdown are run
+// with a cancelled ctx and should return at once, after cleaning up.
+type Func func(ctx context.Context, progress func(percent int)) (*storage.Result, error)
+
+// Job is a snapshot of a submitted job
+type Job struct {
+	ID       string
+	Kind     string
+	Status   Status
+	Progress int
+	// Result is set when the job is done, Error when it failed
+	Result   *storage.Result
+	Error    *errors.AppError
+	Created  time.Time
+	Started  time.Time
+	Finished time.Time
+}
+
+// Options size a queue
+type Options struct {
+	// Workers run jobs concurrently, QueueSize more may wait for them
+	Workers   int
+	QueueSize int
+	// TTL is how long finished jobs can be looked up
+	TTL time.Duration
+}
+
+// DefaultOptions returns the options used unless configured otherwise
+func DefaultOptions() Options {
+	return Options{Workers: 2, QueueSize: 100, TTL: time.Hour}
+}
+
+type task struct {
+	job  *Job
+	run  Func
+	done func(Job)
+}
+
+// Queue runs jobs on a fixed number of workers. Submitting never blocks: a
+// job is refused when the queue is full.
+type Queue struct {
+	tasks chan task
+	ttl   time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	jobs   map[string]*Job
+	closed bool
+}
+
+// New starts a queue with opts.Workers workers
+func New(opts Options) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		tasks:  make(chan task, opts.QueueSize),
+		ttl:    opts.TTL,
+		ctx:    ctx,
+		cancel: cancel,
+		jobs:   map[string]*Job{},
+	}
+	for i := 0; i < opts.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+// Submit queues run as a job of kind, failing with ErrQueueFull when there is
+// no room. done, if not nil, is called with the job once it has ended.
+func (q *Queue) Submit(kind string, run Func, done func(Job)) (Job, error) {
+	id, err := newID()
+	if err != nil {
+		return Job{}, errors.New(errors.ErrProcessingFailed, "Failed to create job", err)
+	}
+	job := &Job{ID: id, Kind: kind, Status: StatusQueued, Created: time.Now()}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return Job{}, errors.New(errors.ErrQueueFull, "The server is shutting down", nil)
+	}
+	q.sweep()
+
+	select {
+	case q.tasks <- task{job: job, run: run, done: done}:
+	default:
+		return Job{}, errors.New(errors.ErrQueueFull, "Too many jobs are waiting, try again later", nil)
+	}
+	q.jobs[id] = job
+	return *job, nil
+}
+
+// Get returns the job with id, false when it doesn't exist or has expired
+func (q *Queue) Get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok || q.expired(job, time.Now()) {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// Shutdown stops accepting jobs and waits for the queued and running ones.
+// When ctx ends first, running jobs are cancelled and queued ones fail.
+func (q *Queue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.tasks)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		q.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for t := range q.tasks {
+		q.run(t)
+	}
+}
+
+func (q *Queue) run(t task) {
+	q.mu.Lock()
+	t.job.Status = StatusRunning
+	t.job.Started = time.Now()
+	q.mu.Unlock()
+
+	progress := func(percent int) {
+		q.mu.Lock()
+		t.job.Progress = max(0, min(percent, 100))
+		q.mu.Unlock()
+	}
+
+	result, err := q.call(t.run, progress)
+	if err != nil {
+		log.Printf("Job %s (%s) failed: %v", t.job.ID, t.job.Kind, err)
+	}
+	job := q.finish(t.job, result, err)
+	if t.done != nil {
+		t.done(job)
+	}
+}
+
+// call runs fn, turning a panic into an error so a bad job can't take a
+// worker down
+func (q *Queue) call(fn Func, progress func(int)) (result *storage.Result, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("panic: %v", p)
+		}
+	}()
+	return fn(q.ctx, progress)
+}
+
+// finish records the outcome of job and returns a snapshot of it
+func (q *Queue) finish(job *Job, result *storage.Result, err error) Job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job.Finished = time.Now()
+	if err != nil {
+		job.Status = StatusFailed
+		job.Error = errors.Wrap(errors.ErrProcessingFailed, "Job failed", err)
+		return *job
+	}
+	job.Status = StatusDone
+	job.Progress = 100
+	job.Result = result
+	return *job
+}
+
+// sweep forgets expired jobs, q.mu must be held
+func (q *Queue) sweep() {
+	now := time.Now()
+	for id, job := range q.jobs {
+		if q.expired(job, now) {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+func (q *Queue) expired(job *Job, now time.Time) bool {
+	return !job.Finished.IsZero() && now.Sub(job.Finished) > q.ttl
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
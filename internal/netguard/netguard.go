@@ -0,0 +1,49 @@
+package netguard
+
+import (
+	stderrors "errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// ErrPrivateAddress is returned when connecting to an address that isn't
+// publicly routable
+var ErrPrivateAddress = stderrors.New("address is not public")
+
+// Transport returns an HTTP transport whose connections take at most timeout
+// to set up. Unless allowPrivate is set it refuses to connect to loopback,
+// private and link-local addresses, so a URL given by a client can't be used
+// to reach internal services. The check happens when connecting, so it also
+// covers redirects and DNS names that resolve to such addresses.
+func Transport(timeout time.Duration, allowPrivate bool) *http.Transport {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = refusePrivate
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = dialer.DialContext
+	// A proxy would be dialled instead of the target host
+	transport.Proxy = nil
+	return transport
+}
+
+// refusePrivate is a net.Dialer Control function that fails connections to
+// addresses that aren't publicly routable
+func refusePrivate(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("unexpected address %s", address)
+	}
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return fmt.Errorf("%w: %s", ErrPrivateAddress, ip)
+	}
+	return nil
+}
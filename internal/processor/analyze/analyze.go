@@ -0,0 +1,50 @@
+package analyze
+
+import (
+	"image"
+)
+
+// HasAlpha reports whether any pixel of the image is not fully opaque
+func HasAlpha(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return !o.Opaque()
+	}
+
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsPhotographic reports whether the image looks like a photo rather than
+// flat graphics such as logos, screenshots or diagrams. Flat graphics reuse
+// a small set of colors, so the check counts distinct colors on a sample grid.
+func IsPhotographic(img image.Image) bool {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width == 0 || height == 0 {
+		return false
+	}
+
+	const gridSize = 100
+	stepX := max(width/gridSize, 1)
+	stepY := max(height/gridSize, 1)
+
+	colors := make(map[uint32]struct{})
+	samples := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += stepY {
+		for x := bounds.Min.X; x < bounds.Max.X; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			colors[(r>>8)<<16|(g>>8)<<8|b>>8] = struct{}{}
+			samples++
+		}
+	}
+
+	// Photos have a distinct color for a large share of the samples
+	return len(colors) > 256 && float64(len(colors)) > float64(samples)*0.1
+}
@@ -0,0 +1,169 @@
+package background
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+
+	"github.com/disintegration/imaging"
+)
+
+// FillMode selects what is placed behind the subject
+type FillMode string
+
+const (
+	// FillNone keeps the background transparent
+	FillNone FillMode = ""
+	// FillColor paints the background with a solid color
+	FillColor FillMode = "color"
+	// FillBlur uses a blurred version of the original image
+	FillBlur FillMode = "blur"
+	// FillImage uses an uploaded backdrop image
+	FillImage FillMode = "image"
+)
+
+// Fill describes how the transparent background of an image is replaced
+type Fill struct {
+	Mode  FillMode
+	Color color.NRGBA
+	// BlurSigma is the strength of the FillBlur blur
+	BlurSigma float64
+	// Backdrop is the FillImage image, BackdropID identifies it in cache keys
+	Backdrop   image.Image `json:"-"`
+	BackdropID string
+	Shadow     Shadow
+	// Padding crops the image to the subject and surrounds it with this
+	// many pixels on every side so it sits centered
+	Padding int
+}
+
+// Shadow is a drop shadow cast by the subject onto the background
+type Shadow struct {
+	Enabled bool
+	Blur    float64
+	OffsetX int
+	OffsetY int
+	// Opacity of the shadow between 0 and 1
+	Opacity float64
+}
+
+// DefaultFill returns the fill used when a request sets none
+func DefaultFill() Fill {
+	return Fill{
+		Color:     color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+		BlurSigma: 20,
+		Shadow: Shadow{
+			Blur:    8,
+			OffsetY: 8,
+			Opacity: 0.4,
+		},
+	}
+}
+
+// Active reports whether applying the fill changes an image
+func (f Fill) Active() bool {
+	return f.Mode != FillNone || f.Shadow.Enabled || f.Padding > 0
+}
+
+// ParseFillMode parses a fill name, "white" being a shorthand for a white
+// color fill
+func ParseFillMode(s string) (FillMode, *color.NRGBA, error) {
+	switch m := FillMode(strings.ToLower(s)); m {
+	case "none":
+		return FillNone, nil, nil
+	case "white":
+		return FillColor, &color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, nil
+	case FillColor, FillBlur, FillImage:
+		return m, nil, nil
+	default:
+		return "", nil, fmt.Errorf("invalid background fill: %s", s)
+	}
+}
+
+// Composite places subject, an image with a transparent background, onto
+// the background described by fill. original is the image before the
+// background was removed and is used by FillBlur.
+func Composite(subject, original image.Image, fill Fill) (image.Image, error) {
+	subj := imaging.Clone(subject)
+
+	canvas := subj.Bounds()
+	offset := image.Point{}
+	if fill.Padding > 0 {
+		if box := opaqueBounds(subj); !box.Empty() {
+			subj = imaging.Crop(subj, box)
+		}
+		canvas = image.Rect(0, 0, subj.Bounds().Dx()+2*fill.Padding, subj.Bounds().Dy()+2*fill.Padding)
+		offset = image.Pt(fill.Padding, fill.Padding)
+	}
+	w, h := canvas.Dx(), canvas.Dy()
+
+	var dst *image.NRGBA
+	switch fill.Mode {
+	case FillNone:
+		dst = image.NewNRGBA(canvas)
+	case FillColor:
+		dst = imaging.New(w, h, fill.Color)
+	case FillBlur:
+		dst = imaging.Blur(imaging.Fill(original, w, h, imaging.Center, imaging.Lanczos), fill.BlurSigma)
+	case FillImage:
+		if fill.Backdrop == nil {
+			return nil, fmt.Errorf("no backdrop image")
+		}
+		dst = imaging.Fill(fill.Backdrop, w, h, imaging.Center, imaging.Lanczos)
+	default:
+		return nil, fmt.Errorf("invalid background fill: %s", fill.Mode)
+	}
+
+	if fill.Shadow.Enabled {
+		shadow := castShadow(subj, fill.Shadow)
+		at := offset.Add(image.Pt(fill.Shadow.OffsetX, fill.Shadow.OffsetY))
+		draw.Draw(dst, shadow.Bounds().Add(at), shadow, shadow.Bounds().Min, draw.Over)
+	}
+
+	draw.Draw(dst, subj.Bounds().Add(offset), subj, image.Point{}, draw.Over)
+	return dst, nil
+}
+
+// castShadow returns a blurred black silhouette of img. Blurring spreads the
+// silhouette, so it is drawn on a margin large enough to keep the soft edge.
+func castShadow(img *image.NRGBA, s Shadow) *image.NRGBA {
+	margin := int(3 * s.Blur)
+	bounds := img.Bounds()
+	shadow := image.NewNRGBA(image.Rect(0, 0, bounds.Dx()+2*margin, bounds.Dy()+2*margin))
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			a := img.Pix[y*img.Stride+x*4+3]
+			shadow.Pix[(y+margin)*shadow.Stride+(x+margin)*4+3] = uint8(float64(a) * s.Opacity)
+		}
+	}
+	if s.Blur > 0 {
+		shadow = imaging.Blur(shadow, s.Blur)
+	}
+
+	// Shift back so the silhouette lines up with the subject
+	translated := image.NewNRGBA(shadow.Bounds().Sub(image.Pt(margin, margin)))
+	draw.Draw(translated, translated.Bounds(), shadow, image.Point{}, draw.Src)
+	return translated
+}
+
+// opaqueBounds returns the smallest rectangle holding every visible pixel
+func opaqueBounds(img *image.NRGBA) image.Rectangle {
+	bounds := img.Bounds()
+	box := image.Rectangle{}
+	for y := 0; y < bounds.Dy(); y++ {
+		for x := 0; x < bounds.Dx(); x++ {
+			if img.Pix[y*img.Stride+x*4+3] == 0 {
+				continue
+			}
+			px := image.Rect(x, y, x+1, y+1)
+			if box.Empty() {
+				box = px
+			} else {
+				box = box.Union(px)
+			}
+		}
+	}
+	return box
+}
@@ -0,0 +1,159 @@
+package background
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/dendianugerah/reubah/internal/processor/optimize"
+	"github.com/disintegration/imaging"
+)
+
+// maxDistance is the distance between black and white in RGB space
+var maxDistance = math.Sqrt(3 * 255 * 255)
+
+// Native removes backgrounds in pure Go. It handles images on solid or
+// near-solid backgrounds, such as product shots and scans, and chroma key
+// footage, but not busy photographic backgrounds.
+type Native struct{}
+
+func (Native) ID() string {
+	return BackendNative
+}
+
+func (Native) Remove(img image.Image, opts Options) (image.Image, error) {
+	src := imaging.Clone(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w == 0 || h == 0 {
+		return nil, fmt.Errorf("image is empty")
+	}
+
+	threshold := opts.Tolerance / 100 * maxDistance
+	var mask []bool
+	switch opts.Method {
+	case MethodChroma:
+		mask = chromaMask(src, opts.KeyColor, threshold)
+	default:
+		mask = floodMask(src, borderColor(src), threshold)
+	}
+
+	alpha := image.NewGray(image.Rect(0, 0, w, h))
+	for i, background := range mask {
+		if !background {
+			alpha.Pix[i] = 0xff
+		}
+	}
+
+	// Blur the mask for a soft edge, but never bring back background pixels
+	var feathered *image.NRGBA
+	if opts.Feather > 0 {
+		feathered = imaging.Blur(alpha, opts.Feather)
+	}
+
+	for i := range mask {
+		a := alpha.Pix[i]
+		if feathered != nil {
+			a = min(a, feathered.Pix[i*4])
+		}
+		offset := i * 4
+		src.Pix[offset+3] = uint8(int(src.Pix[offset+3]) * int(a) / 0xff)
+	}
+	return src, nil
+}
+
+// borderColor estimates the background color as the most common color along
+// the image edges
+func borderColor(img *image.NRGBA) color.NRGBA {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	border := image.NewNRGBA(image.Rect(0, 0, 2*(w+h), 1))
+	n := 0
+	add := func(x, y int) {
+		copy(border.Pix[n*4:n*4+4], img.Pix[y*img.Stride+x*4:])
+		n++
+	}
+	for x := 0; x < w; x++ {
+		add(x, 0)
+		add(x, h-1)
+	}
+	for y := 0; y < h; y++ {
+		add(0, y)
+		add(w-1, y)
+	}
+
+	clusters := optimize.MedianCut(border, 4)
+	if len(clusters) == 0 {
+		return color.NRGBA{}
+	}
+	return clusters[0].Color
+}
+
+// floodMask marks the pixels within threshold of bg that are connected to
+// the image edges
+func floodMask(img *image.NRGBA, bg color.NRGBA, threshold float64) []bool {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	mask := make([]bool, w*h)
+	stack := make([]int, 0, 2*(w+h))
+
+	visit := func(x, y int) {
+		i := y*w + x
+		if mask[i] || !matches(img, x, y, bg, threshold) {
+			return
+		}
+		mask[i] = true
+		stack = append(stack, i)
+	}
+
+	for x := 0; x < w; x++ {
+		visit(x, 0)
+		visit(x, h-1)
+	}
+	for y := 0; y < h; y++ {
+		visit(0, y)
+		visit(w-1, y)
+	}
+
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		x, y := i%w, i/w
+		if x > 0 {
+			visit(x-1, y)
+		}
+		if x < w-1 {
+			visit(x+1, y)
+		}
+		if y > 0 {
+			visit(x, y-1)
+		}
+		if y < h-1 {
+			visit(x, y+1)
+		}
+	}
+	return mask
+}
+
+// chromaMask marks every pixel within threshold of the key color
+func chromaMask(img *image.NRGBA, key color.NRGBA, threshold float64) []bool {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	mask := make([]bool, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			mask[y*w+x] = matches(img, x, y, key, threshold)
+		}
+	}
+	return mask
+}
+
+// matches reports whether the pixel at x, y is transparent or within
+// threshold of c
+func matches(img *image.NRGBA, x, y int, c color.NRGBA, threshold float64) bool {
+	px := img.Pix[y*img.Stride+x*4:]
+	if px[3] == 0 {
+		return true
+	}
+	dr := float64(px[0]) - float64(c.R)
+	dg := float64(px[1]) - float64(c.G)
+	db := float64(px[2]) - float64(c.B)
+	return math.Sqrt(dr*dr+dg*dg+db*db) <= threshold
+}
@@ -0,0 +1,213 @@
+package background
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// DefaultRembgTimeout bounds a single rembg run. The first run of a model
+// downloads it, so this is generous.
+const DefaultRembgTimeout = 60 * time.Second
+
+// killGrace is how long a timed out rembg may keep its pipes open, which
+// wrapper scripts that leave children behind would otherwise do indefinitely
+const killGrace = time.Second
+
+// maxStderr is how much of the rembg output is kept for error messages
+const maxStderr = 2048
+
+// rembgModels maps accepted model names to the names rembg knows
+var rembgModels = map[string]string{
+	"u2net":             "u2net",
+	"u2netp":            "u2netp",
+	"u2net_human_seg":   "u2net_human_seg",
+	"isnet":             "isnet-general-use",
+	"isnet-general-use": "isnet-general-use",
+	"isnet-anime":       "isnet-anime",
+	"silueta":           "silueta",
+}
+
+// ParseModel validates a rembg model name, accepting "isnet" as a shorthand
+// for the general purpose ISNet model
+func ParseModel(s string) (string, error) {
+	model, ok := rembgModels[strings.ToLower(s)]
+	if !ok {
+		return "", fmt.Errorf("unknown rembg model: %s", s)
+	}
+	return model, nil
+}
+
+// RembgConfig selects how rembg is reached
+type RembgConfig struct {
+	// Command is the rembg executable, run once per image
+	Command string
+	// URL is the base URL of a long-running "rembg s" server and takes
+	// precedence over Command
+	URL     string
+	Timeout time.Duration
+}
+
+// NewRembg returns a remover for the rembg server at cfg.URL or, without a
+// URL, for the rembg command, failing when it is not installed
+func NewRembg(cfg RembgConfig) (Remover, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultRembgTimeout
+	}
+
+	if cfg.URL != "" {
+		return &RembgServer{
+			url:    strings.TrimRight(cfg.URL, "/") + "/api/remove",
+			client: &http.Client{Timeout: cfg.Timeout},
+		}, nil
+	}
+
+	if cfg.Command == "" {
+		cfg.Command = "rembg"
+	}
+	path, err := exec.LookPath(cfg.Command)
+	if err != nil {
+		return nil, fmt.Errorf("rembg not found: %w", err)
+	}
+	return &RembgCLI{command: path, timeout: cfg.Timeout}, nil
+}
+
+// RembgCLI removes backgrounds with the external rembg tool, which handles
+// photographic backgrounds the native remover cannot. It starts a process
+// per image, RembgServer avoids that.
+type RembgCLI struct {
+	command string
+	timeout time.Duration
+}
+
+func (r *RembgCLI) ID() string {
+	return BackendRembg + " " + r.command
+}
+
+func (r *RembgCLI) Remove(img image.Image, opts Options) (image.Image, error) {
+	var input bytes.Buffer
+	if err := png.Encode(&input, img); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	// "-" means use stdin/stdout
+	args := append([]string{"i"}, rembgArgs(opts)...)
+	cmd := exec.CommandContext(ctx, r.command, append(args, "-", "-")...)
+	cmd.Stdin = &input
+	var output, stderr bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = killGrace
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, errors.New(errors.ErrBackgroundRemoval,
+				fmt.Sprintf("Background removal timed out after %s", r.timeout), err)
+		}
+		return nil, errors.New(errors.ErrBackgroundRemoval, "Background removal failed",
+			fmt.Errorf("%w: %s", err, tail(stderr.String())))
+	}
+
+	return decodeRembgOutput(&output)
+}
+
+// rembgArgs returns the rembg i flags for opts
+func rembgArgs(opts Options) []string {
+	var args []string
+	if opts.Model != "" {
+		args = append(args, "-m", opts.Model)
+	}
+	if opts.AlphaMatting {
+		args = append(args, "-a",
+			"-af", strconv.Itoa(opts.Matting.Foreground),
+			"-ab", strconv.Itoa(opts.Matting.Background),
+			"-ae", strconv.Itoa(opts.Matting.Erode))
+	}
+	return args
+}
+
+// RembgServer sends images to a running "rembg s" server
+type RembgServer struct {
+	url    string
+	client *http.Client
+}
+
+func (r *RembgServer) ID() string {
+	return BackendRembg + " " + r.url
+}
+
+func (r *RembgServer) Remove(img image.Image, opts Options) (image.Image, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", "image.png")
+	if err != nil {
+		return nil, err
+	}
+	if err := png.Encode(part, img); err != nil {
+		return nil, err
+	}
+
+	fields := map[string]string{}
+	if opts.Model != "" {
+		fields["model"] = opts.Model
+	}
+	if opts.AlphaMatting {
+		fields["a"] = "true"
+		fields["af"] = strconv.Itoa(opts.Matting.Foreground)
+		fields["ab"] = strconv.Itoa(opts.Matting.Background)
+		fields["ae"] = strconv.Itoa(opts.Matting.Erode)
+	}
+	for name, value := range fields {
+		if err := form.WriteField(name, value); err != nil {
+			return nil, err
+		}
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	resp, err := r.client.Post(r.url, form.FormDataContentType(), &body)
+	if err != nil {
+		return nil, errors.New(errors.ErrBackgroundRemoval, "Background removal service unavailable", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, maxStderr))
+		return nil, errors.New(errors.ErrBackgroundRemoval, "Background removal failed",
+			fmt.Errorf("rembg server returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+
+	return decodeRembgOutput(resp.Body)
+}
+
+func decodeRembgOutput(r io.Reader) (image.Image, error) {
+	result, err := png.Decode(r)
+	if err != nil {
+		return nil, errors.New(errors.ErrBackgroundRemoval, "Background removal returned an invalid image", err)
+	}
+	return result, nil
+}
+
+// tail keeps the end of s, where tools print the actual error
+func tail(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) > maxStderr {
+		s = "..." + s[len(s)-maxStderr:]
+	}
+	return s
+}
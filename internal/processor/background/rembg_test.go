@@ -0,0 +1,265 @@
+package background
+
+import (
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+func testImage() image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, 4, 3))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	img.SetNRGBA(1, 1, color.NRGBA{R: 0xff, A: 0xff})
+	return img
+}
+
+func sameImage(a, b image.Image) bool {
+	if a.Bounds() != b.Bounds() {
+		return false
+	}
+	for y := a.Bounds().Min.Y; y < a.Bounds().Max.Y; y++ {
+		for x := a.Bounds().Min.X; x < a.Bounds().Max.X; x++ {
+			r1, g1, b1, a1 := a.At(x, y).RGBA()
+			r2, g2, b2, a2 := b.At(x, y).RGBA()
+			if r1 != r2 || g1 != g2 || b1 != b2 || a1 != a2 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// stubRembg writes a shell script standing in for the rembg command
+func stubRembg(t *testing.T, script string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub commands are shell scripts")
+	}
+	path := filepath.Join(t.TempDir(), "rembg")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newTestRembg(t *testing.T, cfg RembgConfig) Remover {
+	t.Helper()
+	remover, err := NewRembg(cfg)
+	if err != nil {
+		t.Fatalf("NewRembg: %v", err)
+	}
+	return remover
+}
+
+// wantRemovalError checks err is a background removal failure whose message
+// contains want
+func wantRemovalError(t *testing.T, err error, want string) {
+	t.Helper()
+	appErr, ok := err.(*errors.AppError)
+	if !ok {
+		t.Fatalf("error = %v, want an AppError", err)
+	}
+	if appErr.Code != errors.ErrBackgroundRemoval {
+		t.Errorf("code = %s, want %s", appErr.Code, errors.ErrBackgroundRemoval)
+	}
+	if !strings.Contains(err.Error(), want) {
+		t.Errorf("error = %q, want it to contain %q", err, want)
+	}
+}
+
+func TestRembgCLI(t *testing.T) {
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	command := stubRembg(t, `echo "$@" > `+argsFile+`; cat`)
+	remover := newTestRembg(t, RembgConfig{Command: command, Timeout: 5 * time.Second})
+
+	opts := DefaultOptions()
+	opts.Model = "isnet-general-use"
+	opts.AlphaMatting = true
+	opts.Matting = Matting{Foreground: 240, Background: 10, Erode: 5}
+	img := testImage()
+	result, err := remover.Remove(img, opts)
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if !sameImage(result, img) {
+		t.Errorf("result differs from the image the stub echoed back")
+	}
+
+	args, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "i -m isnet-general-use -a -af 240 -ab 10 -ae 5 - -"
+	if got := strings.TrimSpace(string(args)); got != want {
+		t.Errorf("arguments = %q, want %q", got, want)
+	}
+	if got := remover.ID(); got != "rembg "+command {
+		t.Errorf("ID = %q, want the command", got)
+	}
+}
+
+func TestRembgCLIFailures(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		want   string
+	}{
+		{"stderr", `echo "loading model" >&2; echo "model isnet not found" >&2; exit 1`, "model isnet not found"},
+		{"exit status", `exit 3`, "exit status 3"},
+		{"invalid output", `echo "not a png"`, "invalid image"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remover := newTestRembg(t, RembgConfig{Command: stubRembg(t, tt.script), Timeout: 5 * time.Second})
+			_, err := remover.Remove(testImage(), DefaultOptions())
+			wantRemovalError(t, err, tt.want)
+		})
+	}
+}
+
+func TestRembgCLIStderrTail(t *testing.T) {
+	// Only the end of a long output is kept, where the error is
+	script := `i=0; while [ $i -lt 500 ]; do echo "progress line $i" >&2; i=$((i+1)); done; echo "out of memory" >&2; exit 1`
+	remover := newTestRembg(t, RembgConfig{Command: stubRembg(t, script), Timeout: 5 * time.Second})
+	_, err := remover.Remove(testImage(), DefaultOptions())
+	wantRemovalError(t, err, "out of memory")
+	if strings.Contains(err.Error(), "progress line 0\n") || len(err.Error()) > 2*maxStderr {
+		t.Errorf("error keeps the whole output, %d bytes", len(err.Error()))
+	}
+}
+
+func TestRembgCLITimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+	}{
+		{"slow", `exec sleep 5`},
+		// The child keeps the output pipes open after the script is killed,
+		// which only WaitDelay ends
+		{"child holding pipes", `sleep 5 & wait`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const timeout = 100 * time.Millisecond
+			remover := newTestRembg(t, RembgConfig{Command: stubRembg(t, tt.script), Timeout: timeout})
+
+			start := time.Now()
+			_, err := remover.Remove(testImage(), DefaultOptions())
+			elapsed := time.Since(start)
+			wantRemovalError(t, err, "timed out")
+			if elapsed > timeout+killGrace+time.Second {
+				t.Errorf("Remove returned after %v, want within the timeout and kill grace", elapsed)
+			}
+		})
+	}
+}
+
+func TestRembgNotFound(t *testing.T) {
+	if _, err := NewRembg(RembgConfig{Command: filepath.Join(t.TempDir(), "missing")}); err == nil {
+		t.Error("NewRembg accepted a missing command")
+	}
+}
+
+func TestRembgServer(t *testing.T) {
+	var fields map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/remove" {
+			t.Errorf("request = %s %s, want POST /api/remove", r.Method, r.URL.Path)
+		}
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			t.Errorf("reading the uploaded file: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+		img, err := png.Decode(file)
+		if err != nil {
+			t.Errorf("uploaded file is not a PNG: %v", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fields = map[string]string{}
+		for name, values := range r.MultipartForm.Value {
+			fields[name] = values[0]
+		}
+		png.Encode(w, img)
+	}))
+	t.Cleanup(server.Close)
+	remover := newTestRembg(t, RembgConfig{URL: server.URL + "/", Timeout: 5 * time.Second})
+
+	opts := DefaultOptions()
+	opts.Model = "u2netp"
+	opts.AlphaMatting = true
+	opts.Matting = Matting{Foreground: 240, Background: 10, Erode: 5}
+	img := testImage()
+	result, err := remover.Remove(img, opts)
+	if err != nil {
+		t.Fatalf("Remove: %v", err)
+	}
+	if !sameImage(result, img) {
+		t.Errorf("result differs from the image the server echoed back")
+	}
+
+	want := map[string]string{"model": "u2netp", "a": "true", "af": "240", "ab": "10", "ae": "5"}
+	for name, value := range want {
+		if fields[name] != value {
+			t.Errorf("field %s = %q, want %q", name, fields[name], value)
+		}
+	}
+	if len(fields) != len(want) {
+		t.Errorf("fields = %v, want %v", fields, want)
+	}
+}
+
+func TestRembgServerFailures(t *testing.T) {
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "model u2net failed to load", http.StatusInternalServerError)
+	}))
+	t.Cleanup(failing.Close)
+	invalid := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not a png"))
+	}))
+	t.Cleanup(invalid.Close)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(slow.Close)
+	// Cleanups run last first, so the handler returns before Close waits
+	t.Cleanup(func() { close(release) })
+
+	tests := []struct {
+		name    string
+		url     string
+		timeout time.Duration
+		want    string
+	}{
+		{"error status", failing.URL, 5 * time.Second, "model u2net failed to load"},
+		{"invalid output", invalid.URL, 5 * time.Second, "invalid image"},
+		{"unavailable", closed.URL, 5 * time.Second, "unavailable"},
+		{"timeout", slow.URL, 100 * time.Millisecond, "unavailable"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remover := newTestRembg(t, RembgConfig{URL: tt.url, Timeout: tt.timeout})
+			_, err := remover.Remove(testImage(), DefaultOptions())
+			wantRemovalError(t, err, tt.want)
+		})
+	}
+}
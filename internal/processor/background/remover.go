@@ -0,0 +1,113 @@
+package background
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strconv"
+	"strings"
+)
+
+// Backends that can be selected with New
+const (
+	BackendNative = "native"
+	BackendRembg  = "rembg"
+)
+
+// Method selects how the native remover finds the background
+type Method string
+
+const (
+	// MethodAuto removes the solid or near-solid area connected to the
+	// image edges
+	MethodAuto Method = "auto"
+	// MethodChroma removes every pixel close to a key color
+	MethodChroma Method = "chroma"
+)
+
+// Options tune background removal. Backends ignore options they don't
+// support.
+type Options struct {
+	Method Method
+	// Tolerance is the color distance still counted as background, in
+	// percent of the largest possible distance
+	Tolerance float64
+	// KeyColor is the color removed by MethodChroma
+	KeyColor color.NRGBA
+	// Feather softens the cut-out edge over this many pixels
+	Feather float64
+
+	// Model is the rembg segmentation model, empty for its default
+	Model string
+	// AlphaMatting makes rembg refine hair and other fine edges
+	AlphaMatting bool
+	Matting      Matting
+}
+
+// Matting holds the rembg alpha matting thresholds
+type Matting struct {
+	Foreground int
+	Background int
+	Erode      int
+}
+
+// DefaultOptions returns the options used when a request sets none
+func DefaultOptions() Options {
+	return Options{
+		Method:    MethodAuto,
+		Tolerance: 10,
+		KeyColor:  color.NRGBA{G: 0xff, A: 0xff},
+		Matting: Matting{
+			Foreground: 240,
+			Background: 10,
+			Erode:      10,
+		},
+	}
+}
+
+// Remover makes the background of an image transparent
+type Remover interface {
+	Remove(img image.Image, opts Options) (image.Image, error)
+	// ID names the backend and where it runs, so results cut out by one
+	// aren't mistaken for those of another
+	ID() string
+}
+
+// New returns the remover for a backend name, an empty name selects the
+// native remover. rembg is only used by the rembg backend.
+func New(backend string, rembg RembgConfig) (Remover, error) {
+	switch strings.ToLower(backend) {
+	case "", BackendNative:
+		return Native{}, nil
+	case BackendRembg:
+		return NewRembg(rembg)
+	default:
+		return nil, fmt.Errorf("unknown background remover: %s", backend)
+	}
+}
+
+// ParseMethod parses a removal method name
+func ParseMethod(s string) (Method, error) {
+	switch m := Method(strings.ToLower(s)); m {
+	case MethodAuto, MethodChroma:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid background removal method: %s", s)
+	}
+}
+
+// ParseColor parses an opaque hex color such as "#00ff00", "00ff00" or "0f0"
+func ParseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color: %s", s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 0xff}, nil
+}
@@ -0,0 +1,106 @@
+package processor
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image/color"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/processor/background"
+	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/processor/trim"
+)
+
+// CacheKey returns a content-addressed key for processing data with opts.
+// Equivalent option sets produce the same key so they share cache entries.
+func CacheKey(data []byte, opts ProcessOptions) string {
+	h := sha256.New()
+	h.Write(data)
+
+	normalized := normalizeOptions(opts)
+	encoded, _ := json.Marshal(normalized)
+	h.Write([]byte{0})
+	h.Write(encoded)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// normalizeOptions maps options that produce identical output to one form
+func normalizeOptions(opts ProcessOptions) ProcessOptions {
+	opts.OutputFormat = strings.ToLower(opts.OutputFormat)
+	if opts.OutputFormat == "jpg" {
+		opts.OutputFormat = "jpeg"
+	}
+
+	// Accepted formats only matter when negotiating
+	if opts.OutputFormat != FormatAuto {
+		opts.AcceptedFormats = nil
+	}
+
+	// The quality floor only matters when picking the smallest encoding
+	if opts.OutputFormat != FormatSmallest {
+		opts.MinSSIM = 0
+	}
+
+	// Palette options only matter for paletted output
+	if opts.OutputFormat != "png" && opts.OutputFormat != "gif" && opts.OutputFormat != FormatAuto {
+		opts.Colors = 0
+		opts.NoDither = false
+	}
+
+	// Removal options only matter when removing the background
+	if !opts.RemoveBackground {
+		opts.BackgroundRemoval = background.Options{}
+		opts.Remover = ""
+	}
+
+	// Trim settings only matter when trimming
+	if !opts.Trim {
+		opts.TrimOptions = trim.Options{}
+	}
+
+	// Fill settings only matter for their own mode, the backdrop is keyed
+	// by BackdropID
+	fill := background.Fill{
+		Mode:    opts.BackgroundFill.Mode,
+		Padding: opts.BackgroundFill.Padding,
+	}
+	switch fill.Mode {
+	case background.FillColor:
+		fill.Color = opts.BackgroundFill.Color
+	case background.FillBlur:
+		fill.BlurSigma = opts.BackgroundFill.BlurSigma
+	case background.FillImage:
+		fill.BackdropID = opts.BackgroundFill.BackdropID
+	}
+	if opts.BackgroundFill.Shadow.Enabled {
+		fill.Shadow = opts.BackgroundFill.Shadow
+	}
+	opts.BackgroundFill = fill
+
+	// Resize settings only matter when resizing
+	opts.Filter = strings.ToLower(opts.Filter)
+	if opts.Filter == resize.DefaultFilter {
+		opts.Filter = ""
+	}
+	if opts.DPR == 1 {
+		opts.DPR = 0
+	}
+	if !opts.resizing() {
+		opts.ResizeMode = 0
+		opts.Filter = ""
+		opts.WithoutEnlargement = false
+		opts.DPR = 0
+	}
+
+	// The pad color only matters for padding, the anchor also for filling
+	if opts.ResizeMode != resize.ModePad {
+		opts.PadColor = color.NRGBA{}
+		if opts.ResizeMode != resize.ModeFill {
+			opts.Anchor = 0
+		}
+	}
+
+	return opts
+}
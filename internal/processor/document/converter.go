@@ -1,12 +1,15 @@
 package document
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // SupportedFormats defines the supported input and output formats
@@ -19,6 +22,25 @@ var SupportedFormats = map[string][]string{
 	"txt":  {"pdf", "doc", "docx", "odt", "rtf"},
 }
 
+// Defaults for the LibreOffice installation
+const (
+	DefaultOfficeCommand = "soffice"
+	DefaultOfficeTimeout = 2 * time.Minute
+)
+
+// Office is the LibreOffice installation used for conversions
+type Office struct {
+	Command string
+	Timeout time.Duration
+}
+
+var office = Office{Command: DefaultOfficeCommand, Timeout: DefaultOfficeTimeout}
+
+// SetOffice sets the LibreOffice command and how long a conversion may take
+func SetOffice(o Office) {
+	office = o
+}
+
 // ConversionOptions contains options for document conversion
 type ConversionOptions struct {
 	InputFormat  string
@@ -26,8 +48,9 @@ type ConversionOptions struct {
 	Quality      int
 }
 
-// ConvertDocument converts a document from one format to another using LibreOffice
-func ConvertDocument(input io.Reader, inputFormat, outputFormat string) ([]byte, error) {
+// ConvertDocument converts a document from one format to another using
+// LibreOffice, which is killed when ctx ends
+func ConvertDocument(ctx context.Context, input io.Reader, inputFormat, outputFormat string) ([]byte, error) {
 	// Create temporary directory
 	tempDir, err := os.MkdirTemp("", "doc_conversion_*")
 	if err != nil {
@@ -49,26 +72,30 @@ func ConvertDocument(input io.Reader, inputFormat, outputFormat string) ([]byte,
 	}
 	f.Close()
 
-	var cmd *exec.Cmd
+	// Every conversion gets its own profile. Instances sharing one hand
+	// their work to the first and exit, so concurrent conversions would
+	// find no output.
+	profile := url.URL{Scheme: "file", Path: filepath.ToSlash(filepath.Join(tempDir, "profile"))}
+	args := []string{"-env:UserInstallation=" + profile.String(), "--headless"}
 	if inputFormat == "pdf" {
-		cmdStr := "libreoffice --headless --infilter='writer_pdf_import' --convert-to %s --outdir %s %q"
-		cmd = exec.Command(
-			"bash",
-			"-c",
-			fmt.Sprintf(cmdStr, outputFormat, tempDir, inputFile),
-		)
-	} else {
-		cmd = exec.Command(
-			"soffice",
-			"--headless",
-			"--convert-to", outputFormat,
-			"--outdir", tempDir,
-			inputFile,
-		)
+		args = append(args, "--infilter=writer_pdf_import")
 	}
+	args = append(args, "--convert-to", outputFormat, "--outdir", tempDir, inputFile)
+
+	convertCtx, cancel := context.WithTimeout(ctx, office.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(convertCtx, office.Command, args...)
+	killOnCancel(cmd)
+	cmd.WaitDelay = 5 * time.Second
 
 	// Execute conversion
 	if output, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("conversion cancelled: %w", ctx.Err())
+		}
+		if convertCtx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("conversion timed out after %s", office.Timeout)
+		}
 		fmt.Printf("LibreOffice error: %s\n", string(output))
 		return nil, fmt.Errorf("conversion failed: %w", err)
 	}
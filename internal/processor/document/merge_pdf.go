@@ -8,44 +8,64 @@ import (
 	"io"
 	"math"
 
-	"github.com/jung-kurt/gofpdf"
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/disintegration/imaging"
 )
 
 type PDFOptions struct {
-	PageSize      string // "A4", "letter", "legal"
+	PageSize      string // "A3", "A4", "A5", "letter", "legal"
 	Orientation   string // "portrait", "landscape", "auto"
 	ImagesPerPage int    // 1, 2, or 4
 	Quality       int    // JPEG quality for images in PDF
 }
 
-func MergeToPDF(images []image.Image, opts PDFOptions) (io.Reader, error) {
+// ImageSource provides the images of a PDF by index, so they can be
+// decoded one at a time instead of all being held in memory
+type ImageSource interface {
+	Len() int
+	Image(i int) (image.Image, error)
+}
+
+// MergeToPDF writes a PDF with the images of src to w. Each image is
+// decoded, compressed to JPEG at no more than maxImageDPI and written out
+// before the next one is loaded, so memory use doesn't grow with the number
+// of images.
+func MergeToPDF(w io.Writer, src ImageSource, opts PDFOptions) error {
+	if src.Len() == 0 {
+		return fmt.Errorf("no images to merge")
+	}
+
+	// The first image may pick the orientation, keep it for its page
+	first, err := src.Image(0)
+	if err != nil {
+		return err
+	}
+
 	// Set defaults if not specified
 	if opts.PageSize == "" {
 		opts.PageSize = "A4"
 	}
 	if opts.Orientation == "" || opts.Orientation == "auto" {
-		opts.Orientation = determineOrientation(images[0])
+		opts.Orientation = determineOrientation(first)
 	}
 	if opts.ImagesPerPage == 0 {
 		opts.ImagesPerPage = 1
 	}
 	if opts.Quality == 0 {
-		opts.Quality = 85
+		opts.Quality = constants.DefaultQuality
 	}
 
-	// Create PDF
-	pdf := gofpdf.New(opts.Orientation, "mm", opts.PageSize, "")
-	pdf.SetMargins(10, 10, 10)
-
 	// Get page dimensions
-	pageWidth, pageHeight := pdf.GetPageSize()
-	effectiveWidth := pageWidth - 20  // Account for margins
+	pageWidth, pageHeight, err := pageSize(opts.PageSize, opts.Orientation)
+	if err != nil {
+		return err
+	}
+	pdf := newPDFWriter(w, pageWidth, pageHeight)
+	effectiveWidth := pageWidth - 20 // Account for margins
 	effectiveHeight := pageHeight - 20
 
 	// Process images
-	for i := 0; i < len(images); i += opts.ImagesPerPage {
-		pdf.AddPage()
-
+	for i := 0; i < src.Len(); i += opts.ImagesPerPage {
 		// Calculate grid layout
 		cols := 1
 		rows := 1
@@ -60,14 +80,14 @@ func MergeToPDF(images []image.Image, opts PDFOptions) (io.Reader, error) {
 		cellHeight := effectiveHeight / float64(rows)
 
 		// Process images for current page
-		for j := 0; j < opts.ImagesPerPage && (i+j) < len(images); j++ {
-			img := images[i+j]
-			
-			// Convert image to JPEG bytes
-			var imgBuf bytes.Buffer
-			if err := jpeg.Encode(&imgBuf, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
-				return nil, fmt.Errorf("failed to encode image: %w", err)
+		for j := 0; j < opts.ImagesPerPage && (i+j) < src.Len(); j++ {
+			img := first
+			if i+j > 0 {
+				if img, err = src.Image(i + j); err != nil {
+					return err
+				}
 			}
+			first = nil
 
 			// Calculate position in grid
 			col := j % cols
@@ -85,24 +105,51 @@ func MergeToPDF(images []image.Image, opts PDFOptions) (io.Reader, error) {
 			finalWidth := imgWidth * scale
 			finalHeight := imgHeight * scale
 
+			// Each image is bounded by the resolution its place on the page
+			// can show
+			img = limitResolution(img, finalWidth, finalHeight)
+
+			// Convert image to JPEG bytes
+			var imgBuf bytes.Buffer
+			if err := jpeg.Encode(&imgBuf, img, &jpeg.Options{Quality: opts.Quality}); err != nil {
+				return fmt.Errorf("failed to encode image: %w", err)
+			}
+
 			// Center image in cell
 			x += (cellWidth - finalWidth) / 2
 			y += (cellHeight - finalHeight) / 2
 
-			// Add image to PDF
-			imgID := fmt.Sprintf("img%d", i+j)
-			pdf.RegisterImageOptionsReader(imgID, gofpdf.ImageOptions{ImageType: "JPEG"}, &imgBuf)
-			pdf.Image(imgID, x, y, finalWidth, finalHeight, false, "", 0, "")
+			// Add image to PDF, image/jpeg only writes gray images with a
+			// single component
+			components := 3
+			if _, ok := img.(*image.Gray); ok {
+				components = 1
+			}
+			pdf.addImage(imgBuf.Bytes(), img.Bounds().Dx(), img.Bounds().Dy(), components,
+				x, y, finalWidth, finalHeight)
 		}
+		pdf.endPage()
 	}
 
-	// Write PDF to buffer
-	var buf bytes.Buffer
-	if err := pdf.Output(&buf); err != nil {
-		return nil, fmt.Errorf("failed to generate PDF: %w", err)
+	if err := pdf.close(); err != nil {
+		return fmt.Errorf("failed to generate PDF: %w", err)
 	}
+	return nil
+}
 
-	return &buf, nil
+// maxImageDPI is the highest resolution images are embedded at, that of
+// print quality
+const maxImageDPI = 300
+
+// limitResolution downscales img to maxImageDPI when placed at width by
+// height millimetres
+func limitResolution(img image.Image, width, height float64) image.Image {
+	maxWidth := int(math.Ceil(width / 25.4 * maxImageDPI))
+	maxHeight := int(math.Ceil(height / 25.4 * maxImageDPI))
+	if img.Bounds().Dx() <= maxWidth && img.Bounds().Dy() <= maxHeight {
+		return img
+	}
+	return imaging.Fit(img, maxWidth, maxHeight, imaging.Lanczos)
 }
 
 func determineOrientation(img image.Image) string {
@@ -111,4 +158,4 @@ func determineOrientation(img image.Image) string {
 		return "L" // Landscape
 	}
 	return "P" // Portrait
-} 
\ No newline at end of file
+}
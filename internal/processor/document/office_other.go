@@ -0,0 +1,8 @@
+//go:build !unix
+
+package document
+
+import "os/exec"
+
+// killOnCancel leaves cancelling cmd to kill the launcher only
+func killOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package document
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killOnCancel makes cancelling cmd kill the processes it started along
+// with it. The soffice launcher runs the office in a child process that
+// would otherwise keep converting, and keep its output open, once the
+// launcher is killed.
+func killOnCancel(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
@@ -0,0 +1,164 @@
+package document
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// mmToPoints converts millimetres to PDF points
+const mmToPoints = 72 / 25.4
+
+// pageSizes are the portrait page sizes in millimetres
+var pageSizes = map[string][2]float64{
+	"a3":     {297, 420},
+	"a4":     {210, 297},
+	"a5":     {148, 210},
+	"letter": {215.9, 279.4},
+	"legal":  {215.9, 355.6},
+}
+
+// pageSize returns the width and height in millimetres of a named page size
+// in orientation, "P" or "L"
+func pageSize(name, orientation string) (float64, float64, error) {
+	size, ok := pageSizes[strings.ToLower(name)]
+	if !ok {
+		return 0, 0, fmt.Errorf("unknown page size: %s", name)
+	}
+	switch strings.ToLower(orientation) {
+	case "p", "portrait":
+		return size[0], size[1], nil
+	case "l", "landscape":
+		return size[1], size[0], nil
+	default:
+		return 0, 0, fmt.Errorf("unknown orientation: %s", orientation)
+	}
+}
+
+// pdfWriter writes a PDF of JPEG images page by page. Every image is
+// written out as soon as it is placed, so only the offsets of the objects
+// are kept until the end, whatever the number of pages.
+type pdfWriter struct {
+	w   *bufio.Writer
+	n   int64
+	err error
+	// offsets holds the position of every object, by number less one
+	offsets []int64
+	pages   []int
+	// width and height of the pages in points
+	width, height float64
+	// content collects the drawing operators of the current page
+	content strings.Builder
+	images  []int
+}
+
+// Objects written before the pages, whose numbers are known up front
+const (
+	catalogObject = 1
+	pagesObject   = 2
+)
+
+func newPDFWriter(w io.Writer, widthMM, heightMM float64) *pdfWriter {
+	p := &pdfWriter{
+		w:       bufio.NewWriter(w),
+		offsets: make([]int64, pagesObject),
+		width:   widthMM * mmToPoints,
+		height:  heightMM * mmToPoints,
+	}
+	// The binary comment marks the file as binary for transfer tools
+	p.printf("%%PDF-1.4\n%%\xe2\xe3\xcf\xd3\n")
+	p.offsets[catalogObject-1] = p.n
+	p.printf("%d 0 obj\n<< /Type /Catalog /Pages %d 0 R >>\nendobj\n", catalogObject, pagesObject)
+	return p
+}
+
+func (p *pdfWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(p.w, format, args...)
+	p.n += int64(n)
+	p.err = err
+}
+
+func (p *pdfWriter) write(data []byte) {
+	if p.err != nil {
+		return
+	}
+	n, err := p.w.Write(data)
+	p.n += int64(n)
+	p.err = err
+}
+
+// beginObject starts the next object and returns its number
+func (p *pdfWriter) beginObject() int {
+	p.offsets = append(p.offsets, p.n)
+	number := len(p.offsets)
+	p.printf("%d 0 obj\n", number)
+	return number
+}
+
+// addImage writes a JPEG of width by height pixels with components color
+// channels and places it at x, y from the top left of the current page,
+// sized w by h, all in millimetres
+func (p *pdfWriter) addImage(jpeg []byte, width, height, components int, x, y, w, h float64) {
+	colorSpace := "/DeviceRGB"
+	if components == 1 {
+		colorSpace = "/DeviceGray"
+	}
+	number := p.beginObject()
+	p.printf("<< /Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace %s "+
+		"/BitsPerComponent 8 /Filter /DCTDecode /Length %d >>\nstream\n",
+		width, height, colorSpace, len(jpeg))
+	p.write(jpeg)
+	p.printf("\nendstream\nendobj\n")
+
+	p.images = append(p.images, number)
+	// PDF coordinates start at the bottom left
+	fmt.Fprintf(&p.content, "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n",
+		w*mmToPoints, h*mmToPoints, x*mmToPoints, p.height-(y+h)*mmToPoints, number)
+}
+
+// endPage writes the page holding the images added since the last one
+func (p *pdfWriter) endPage() {
+	content := p.content.String()
+	contentObject := p.beginObject()
+	p.printf("<< /Length %d >>\nstream\n%s\nendstream\nendobj\n", len(content), content)
+
+	var resources strings.Builder
+	for _, image := range p.images {
+		fmt.Fprintf(&resources, " /Im%d %d 0 R", image, image)
+	}
+	page := p.beginObject()
+	p.printf("<< /Type /Page /Parent %d 0 R /MediaBox [0 0 %.2f %.2f] "+
+		"/Resources << /XObject <<%s >> >> /Contents %d 0 R >>\nendobj\n",
+		pagesObject, p.width, p.height, resources.String(), contentObject)
+
+	p.pages = append(p.pages, page)
+	p.content.Reset()
+	p.images = p.images[:0]
+}
+
+// close writes the page tree and the cross-reference table and flushes the
+// PDF
+func (p *pdfWriter) close() error {
+	p.offsets[pagesObject-1] = p.n
+	p.printf("%d 0 obj\n<< /Type /Pages /Count %d /Kids [", pagesObject, len(p.pages))
+	for _, page := range p.pages {
+		p.printf(" %d 0 R", page)
+	}
+	p.printf(" ] >>\nendobj\n")
+
+	xref := p.n
+	p.printf("xref\n0 %d\n0000000000 65535 f \n", len(p.offsets)+1)
+	for _, offset := range p.offsets {
+		p.printf("%010d 00000 n \n", offset)
+	}
+	p.printf("trailer\n<< /Size %d /Root %d 0 R >>\nstartxref\n%d\n%%%%EOF\n",
+		len(p.offsets)+1, catalogObject, xref)
+	if p.err != nil {
+		return p.err
+	}
+	return p.w.Flush()
+}
@@ -0,0 +1,257 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// EXIF holds the commonly used EXIF fields of an image
+type EXIF struct {
+	Make        string     `json:"make,omitempty"`
+	Model       string     `json:"model,omitempty"`
+	LensModel   string     `json:"lensModel,omitempty"`
+	Software    string     `json:"software,omitempty"`
+	DateTaken   *time.Time `json:"dateTaken,omitempty"`
+	Orientation int        `json:"orientation,omitempty"`
+	GPS         *GPS       `json:"gps,omitempty"`
+}
+
+// GPS is a location in decimal degrees
+type GPS struct {
+	Latitude  float64  `json:"latitude"`
+	Longitude float64  `json:"longitude"`
+	Altitude  *float64 `json:"altitude,omitempty"`
+}
+
+// TIFF tags read by ParseEXIF
+const (
+	tagMake             = 0x010f
+	tagModel            = 0x0110
+	tagOrientation      = 0x0112
+	tagSoftware         = 0x0131
+	tagDateTime         = 0x0132
+	tagExifIFD          = 0x8769
+	tagGPSIFD           = 0x8825
+	tagDateTimeOriginal = 0x9003
+	tagLensModel        = 0xa434
+
+	tagGPSLatitudeRef  = 0x1
+	tagGPSLatitude     = 0x2
+	tagGPSLongitudeRef = 0x3
+	tagGPSLongitude    = 0x4
+	tagGPSAltitudeRef  = 0x5
+	tagGPSAltitude     = 0x6
+)
+
+// exifTimeLayout is the timestamp format used by EXIF, which has no zone
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+// ParseEXIF parses a TIFF-structured EXIF block. It returns nil when the
+// block is malformed rather than failing the whole inspection.
+func ParseEXIF(data []byte) *EXIF {
+	t, ok := newTIFF(data)
+	if !ok {
+		return nil
+	}
+
+	ifd0 := t.readIFD(int(t.order.Uint32(data[4:8])))
+	if ifd0 == nil {
+		return nil
+	}
+
+	exif := &EXIF{
+		Make:        ifd0.string(tagMake),
+		Model:       ifd0.string(tagModel),
+		Software:    ifd0.string(tagSoftware),
+		Orientation: int(ifd0.uint(tagOrientation)),
+	}
+	date := ifd0.string(tagDateTime)
+
+	if offset, ok := ifd0.offset(tagExifIFD); ok {
+		if sub := t.readIFD(offset); sub != nil {
+			exif.LensModel = sub.string(tagLensModel)
+			if original := sub.string(tagDateTimeOriginal); original != "" {
+				date = original
+			}
+		}
+	}
+
+	if taken, err := time.Parse(exifTimeLayout, date); err == nil {
+		exif.DateTaken = &taken
+	}
+
+	if offset, ok := ifd0.offset(tagGPSIFD); ok {
+		exif.GPS = t.readGPS(offset)
+	}
+
+	return exif
+}
+
+// tiff reads IFDs from a TIFF header in either byte order
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+func newTIFF(data []byte) (*tiff, bool) {
+	if len(data) < 8 {
+		return nil, false
+	}
+	switch string(data[:2]) {
+	case "II":
+		return &tiff{data: data, order: binary.LittleEndian}, true
+	case "MM":
+		return &tiff{data: data, order: binary.BigEndian}, true
+	default:
+		return nil, false
+	}
+}
+
+// ifdEntry points at the value of one tag
+type ifdEntry struct {
+	typ    uint16
+	count  uint32
+	offset int // absolute offset of the value within the TIFF data
+}
+
+type ifd struct {
+	t       *tiff
+	entries map[uint16]ifdEntry
+}
+
+// typeSizes are the byte sizes of the TIFF field types
+var typeSizes = map[uint16]int{
+	1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8,
+}
+
+func (t *tiff) readIFD(offset int) *ifd {
+	if offset < 8 || offset+2 > len(t.data) {
+		return nil
+	}
+
+	count := int(t.order.Uint16(t.data[offset:]))
+	dir := &ifd{t: t, entries: make(map[uint16]ifdEntry, count)}
+	for i := 0; i < count; i++ {
+		at := offset + 2 + i*12
+		if at+12 > len(t.data) {
+			break
+		}
+
+		entry := ifdEntry{
+			typ:   t.order.Uint16(t.data[at+2:]),
+			count: t.order.Uint32(t.data[at+4:]),
+		}
+		size, known := typeSizes[entry.typ]
+		if !known {
+			continue
+		}
+
+		// Values of up to four bytes are stored inline
+		total := uint64(size) * uint64(entry.count)
+		if total <= 4 {
+			entry.offset = at + 8
+		} else {
+			entry.offset = int(t.order.Uint32(t.data[at+8:]))
+		}
+		if uint64(entry.offset)+total > uint64(len(t.data)) {
+			continue
+		}
+
+		dir.entries[t.order.Uint16(t.data[at:])] = entry
+	}
+	return dir
+}
+
+func (d *ifd) string(tag uint16) string {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 2 {
+		return ""
+	}
+	value := string(d.t.data[e.offset : e.offset+int(e.count)])
+	return strings.TrimSpace(strings.TrimRight(value, "\x00"))
+}
+
+func (d *ifd) uint(tag uint16) uint32 {
+	e, ok := d.entries[tag]
+	if !ok || e.count == 0 {
+		return 0
+	}
+	switch e.typ {
+	case 1, 7:
+		return uint32(d.t.data[e.offset])
+	case 3:
+		return uint32(d.t.order.Uint16(d.t.data[e.offset:]))
+	case 4:
+		return d.t.order.Uint32(d.t.data[e.offset:])
+	default:
+		return 0
+	}
+}
+
+func (d *ifd) offset(tag uint16) (int, bool) {
+	if _, ok := d.entries[tag]; !ok {
+		return 0, false
+	}
+	return int(d.uint(tag)), true
+}
+
+// rationals returns the unsigned rational values of a tag
+func (d *ifd) rationals(tag uint16) []float64 {
+	e, ok := d.entries[tag]
+	if !ok || e.typ != 5 {
+		return nil
+	}
+	values := make([]float64, 0, e.count)
+	for i := 0; i < int(e.count); i++ {
+		at := e.offset + i*8
+		num := d.t.order.Uint32(d.t.data[at:])
+		den := d.t.order.Uint32(d.t.data[at+4:])
+		if den == 0 {
+			return nil
+		}
+		values = append(values, float64(num)/float64(den))
+	}
+	return values
+}
+
+func (t *tiff) readGPS(offset int) *GPS {
+	dir := t.readIFD(offset)
+	if dir == nil {
+		return nil
+	}
+
+	lat := degrees(dir.rationals(tagGPSLatitude))
+	lon := degrees(dir.rationals(tagGPSLongitude))
+	if lat == nil || lon == nil {
+		return nil
+	}
+
+	gps := &GPS{Latitude: *lat, Longitude: *lon}
+	if dir.string(tagGPSLatitudeRef) == "S" {
+		gps.Latitude = -gps.Latitude
+	}
+	if dir.string(tagGPSLongitudeRef) == "W" {
+		gps.Longitude = -gps.Longitude
+	}
+
+	if alt := dir.rationals(tagGPSAltitude); len(alt) == 1 {
+		altitude := alt[0]
+		// Reference 1 means below sea level
+		if dir.uint(tagGPSAltitudeRef) == 1 {
+			altitude = -altitude
+		}
+		gps.Altitude = &altitude
+	}
+
+	return gps
+}
+
+// degrees converts degrees, minutes and seconds to decimal degrees
+func degrees(dms []float64) *float64 {
+	if len(dms) != 3 {
+		return nil
+	}
+	value := dms[0] + dms[1]/60 + dms[2]/3600
+	return &value
+}
@@ -0,0 +1,65 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"strings"
+	"unicode/utf16"
+)
+
+// ICCDescription returns the profile description stored in the 'desc' tag
+// of an ICC profile, such as "sRGB IEC61966-2.1" or "Display P3"
+func ICCDescription(profile []byte) string {
+	const headerSize = 128
+	if len(profile) < headerSize+4 {
+		return ""
+	}
+
+	count := int(binary.BigEndian.Uint32(profile[headerSize:]))
+	for i := 0; i < count; i++ {
+		entry := headerSize + 4 + i*12
+		if entry+12 > len(profile) {
+			break
+		}
+		if string(profile[entry:entry+4]) != "desc" {
+			continue
+		}
+
+		offset := int(binary.BigEndian.Uint32(profile[entry+4:]))
+		size := int(binary.BigEndian.Uint32(profile[entry+8:]))
+		if offset < 0 || size < 12 || offset+size > len(profile) {
+			return ""
+		}
+		return parseDescTag(profile[offset : offset+size])
+	}
+	return ""
+}
+
+// parseDescTag reads a textDescriptionType (ICC v2) or
+// multiLocalizedUnicodeType (ICC v4) tag
+func parseDescTag(tag []byte) string {
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n > len(tag) {
+			return ""
+		}
+		return strings.TrimRight(string(tag[12:12+n]), "\x00")
+
+	case "mluc":
+		if len(tag) < 28 || binary.BigEndian.Uint32(tag[8:]) == 0 {
+			return ""
+		}
+		// Use the first record, whatever its language
+		length := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+length > len(tag) {
+			return ""
+		}
+		units := make([]uint16, length/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(tag[offset+i*2:])
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+	return ""
+}
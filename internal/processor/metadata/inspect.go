@@ -0,0 +1,284 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"io"
+
+	"github.com/dendianugerah/reubah/internal/processor/analyze"
+)
+
+// Info describes an image without transforming it
+type Info struct {
+	Format     string `json:"format"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	ColorModel string `json:"colorModel"`
+	BitDepth   int    `json:"bitDepth"`
+	HasAlpha   bool   `json:"hasAlpha"`
+	Frames     int    `json:"frames"`
+	FileSize   int    `json:"fileSize"`
+	EXIF       *EXIF  `json:"exif,omitempty"`
+	ICCProfile string `json:"iccProfile,omitempty"`
+}
+
+// Inspect gathers information about an image from its encoded bytes and the
+// already decoded image
+func Inspect(data []byte, img image.Image) *Info {
+	bounds := img.Bounds()
+	info := &Info{
+		Format:   DetectFormat(data),
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		HasAlpha: analyze.HasAlpha(img),
+		Frames:   1,
+		FileSize: len(data),
+	}
+	info.ColorModel, info.BitDepth = describeColorModel(img.ColorModel())
+
+	var exif, icc []byte
+	switch info.Format {
+	case "jpeg":
+		exif, icc = jpegMetadata(data)
+	case "png":
+		exif, icc = pngMetadata(data)
+		if depth := pngBitDepth(data); depth > 0 {
+			info.BitDepth = depth
+		}
+	case "webp":
+		exif, icc, info.Frames = webpMetadata(data)
+	case "gif":
+		if frames := gifFrames(data); frames > 0 {
+			info.Frames = frames
+		}
+	}
+
+	if exif != nil {
+		info.EXIF = ParseEXIF(exif)
+	}
+	if icc != nil {
+		info.ICCProfile = ICCDescription(icc)
+	}
+	return info
+}
+
+// DetectFormat identifies the container format from the file signature
+func DetectFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte("\xff\xd8\xff")):
+		return "jpeg"
+	case bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n")):
+		return "png"
+	case bytes.HasPrefix(data, []byte("GIF8")):
+		return "gif"
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return "webp"
+	case bytes.HasPrefix(data, []byte("BM")):
+		return "bmp"
+	case bytes.HasPrefix(data, []byte{0, 0, 1, 0}):
+		return "ico"
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		if brand := string(data[8:12]); brand == "heif" || brand == "mif1" || brand == "msf1" {
+			return "heif"
+		}
+		return "heic"
+	default:
+		return "unknown"
+	}
+}
+
+// describeColorModel names a color model and its bits per channel
+func describeColorModel(model color.Model) (string, int) {
+	switch model {
+	case color.RGBAModel:
+		return "RGBA", 8
+	case color.NRGBAModel:
+		return "NRGBA", 8
+	case color.RGBA64Model:
+		return "RGBA64", 16
+	case color.NRGBA64Model:
+		return "NRGBA64", 16
+	case color.GrayModel:
+		return "Gray", 8
+	case color.Gray16Model:
+		return "Gray16", 16
+	case color.AlphaModel:
+		return "Alpha", 8
+	case color.Alpha16Model:
+		return "Alpha16", 16
+	case color.YCbCrModel:
+		return "YCbCr", 8
+	case color.NYCbCrAModel:
+		return "NYCbCrA", 8
+	case color.CMYKModel:
+		return "CMYK", 8
+	}
+	if _, ok := model.(color.Palette); ok {
+		return "Paletted", 8
+	}
+	return "Unknown", 8
+}
+
+// jpegMetadata returns the EXIF block and the reassembled ICC profile from
+// the APP1 and APP2 segments of a JPEG
+func jpegMetadata(data []byte) (exif, icc []byte) {
+	iccChunks := map[byte][]byte{}
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xff {
+			break
+		}
+		marker := data[i+1]
+		// Start of scan, the metadata segments are behind us
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			break
+		}
+		segment := data[i+4 : i+2+length]
+
+		switch {
+		case marker == 0xe1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")):
+			exif = segment[6:]
+		case marker == 0xe2 && bytes.HasPrefix(segment, []byte("ICC_PROFILE\x00")) && len(segment) > 14:
+			// Profiles larger than a segment are split into numbered chunks
+			iccChunks[segment[12]] = segment[14:]
+		}
+		i += 2 + length
+	}
+
+	for seq := byte(1); ; seq++ {
+		chunk, ok := iccChunks[seq]
+		if !ok {
+			break
+		}
+		icc = append(icc, chunk...)
+	}
+	return exif, icc
+}
+
+// pngMetadata returns the eXIf chunk and the decompressed iCCP profile
+func pngMetadata(data []byte) (exif, icc []byte) {
+	for i := 8; i+8 <= len(data); {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		chunkType := string(data[i+4 : i+8])
+		if length < 0 || i+12+length > len(data) {
+			break
+		}
+		chunk := data[i+8 : i+8+length]
+
+		switch chunkType {
+		case "eXIf":
+			exif = chunk
+		case "iCCP":
+			// Profile name, NUL, compression method, zlib stream
+			if nul := bytes.IndexByte(chunk, 0); nul >= 0 && nul+2 <= len(chunk) {
+				if zr, err := zlib.NewReader(bytes.NewReader(chunk[nul+2:])); err == nil {
+					icc, _ = io.ReadAll(io.LimitReader(zr, 4<<20))
+					zr.Close()
+				}
+			}
+		case "IDAT", "IEND":
+			return exif, icc
+		}
+		i += 12 + length
+	}
+	return exif, icc
+}
+
+// pngBitDepth reads the bits per sample from the IHDR chunk
+func pngBitDepth(data []byte) int {
+	if len(data) < 25 || string(data[12:16]) != "IHDR" {
+		return 0
+	}
+	return int(data[24])
+}
+
+// webpMetadata returns the EXIF and ICCP chunks and the number of frames of
+// a WebP file
+// maxGIFFrames bounds the frames counted in a GIF, the count stops there
+const maxGIFFrames = 10000
+
+// gifFrames counts the image descriptors of a GIF by walking its blocks,
+// skipping the compressed data rather than decoding it, so a GIF of many
+// large frames costs no more than reading it. It returns 0 for a GIF it
+// can't walk.
+func gifFrames(data []byte) int {
+	// Header and logical screen descriptor
+	const screenEnd = 13
+	if len(data) < screenEnd {
+		return 0
+	}
+	i := screenEnd
+	if flags := data[10]; flags&0x80 != 0 {
+		i += 3 << (flags&0x07 + 1)
+	}
+
+	frames := 0
+	for i < len(data) && frames < maxGIFFrames {
+		switch data[i] {
+		case 0x21: // Extension: label, then sub-blocks
+			i = skipSubBlocks(data, i+2)
+		case 0x2c: // Image descriptor, color table, LZW code size, sub-blocks
+			if i+10 > len(data) {
+				return frames
+			}
+			frames++
+			flags := data[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i = skipSubBlocks(data, i+1)
+		default: // Trailer or garbage
+			return frames
+		}
+	}
+	return frames
+}
+
+// skipSubBlocks returns the index following the sub-blocks starting at i,
+// each a length byte and that many bytes, ended by an empty one
+func skipSubBlocks(data []byte, i int) int {
+	for i < len(data) {
+		size := int(data[i])
+		i++
+		if size == 0 {
+			return i
+		}
+		i += size
+	}
+	return len(data)
+}
+
+func webpMetadata(data []byte) (exif, icc []byte, frames int) {
+	frames = 0
+	for i := 12; i+8 <= len(data); {
+		fourCC := string(data[i : i+4])
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		if size < 0 || i+8+size > len(data) {
+			break
+		}
+		chunk := data[i+8 : i+8+size]
+
+		switch fourCC {
+		case "EXIF":
+			// Some writers keep the JPEG-style prefix
+			exif = bytes.TrimPrefix(chunk, []byte("Exif\x00\x00"))
+		case "ICCP":
+			icc = chunk
+		case "ANMF":
+			frames++
+		}
+		// Chunks are padded to an even size
+		i += 8 + size + size%2
+	}
+	if frames == 0 {
+		frames = 1
+	}
+	return exif, icc, frames
+}
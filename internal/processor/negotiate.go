@@ -0,0 +1,74 @@
+package processor
+
+import (
+	"image"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/dendianugerah/reubah/internal/processor/analyze"
+)
+
+const (
+	// FormatAuto lets the processor pick the output format from the
+	// accepted formats and the image content
+	FormatAuto = "auto"
+	// FormatSmallest encodes several candidates and keeps the smallest one
+	// that meets the quality floor
+	FormatSmallest = "smallest"
+)
+
+// negotiableFormats maps Accept media types to formats that not every client
+// supports. AVIF is missing because there is no AVIF encoder available.
+var negotiableFormats = map[string]string{
+	"image/webp": "webp",
+}
+
+// AcceptedFormats returns the negotiable formats listed in an Accept header,
+// sorted so equivalent headers give equal results
+func AcceptedFormats(accept string) []string {
+	var formats []string
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, _ := strings.Cut(part, ";")
+		if isRefused(params) {
+			continue
+		}
+		if format, ok := negotiableFormats[strings.ToLower(strings.TrimSpace(mediaType))]; ok {
+			formats = append(formats, format)
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// isRefused reports whether Accept parameters carry q=0
+func isRefused(params string) bool {
+	for _, param := range strings.Split(params, ";") {
+		key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, "q") {
+			q, err := strconv.ParseFloat(value, 64)
+			return err == nil && q == 0
+		}
+	}
+	return false
+}
+
+// ChooseFormat picks the best output format for img given the negotiable
+// formats the client accepts
+func ChooseFormat(img image.Image, accepted []string) string {
+	for _, format := range accepted {
+		// WebP handles both photos and transparency better than the rest
+		if format == "webp" {
+			return "webp"
+		}
+	}
+
+	switch {
+	case analyze.HasAlpha(img):
+		return "png"
+	case analyze.IsPhotographic(img):
+		return "jpeg"
+	default:
+		return "png"
+	}
+}
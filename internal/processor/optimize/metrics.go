@@ -0,0 +1,198 @@
+package optimize
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+)
+
+// Metrics describes how much a distorted image differs from a reference
+type Metrics struct {
+	SSIM float64 // Structural similarity on luminance, 1 means identical
+	PSNR float64 // Peak signal-to-noise ratio in dB, +Inf when identical
+	MSE  float64 // Mean squared error per RGB channel on a 0-255 scale
+}
+
+// Compare computes SSIM, PSNR and MSE between two equally sized images
+func Compare(reference, distorted image.Image) (*Metrics, error) {
+	ssim, err := SSIM(reference, distorted)
+	if err != nil {
+		return nil, err
+	}
+	mse, err := MSE(reference, distorted)
+	if err != nil {
+		return nil, err
+	}
+	return &Metrics{SSIM: ssim, PSNR: PSNR(mse), MSE: mse}, nil
+}
+
+// MSE returns the mean squared error over the RGB channels of two equally
+// sized images
+func MSE(a, b image.Image) (float64, error) {
+	if err := checkSameSize(a, b); err != nil {
+		return 0, err
+	}
+
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			ra, ga, ba, _ := a.At(boundsA.Min.X+x, boundsA.Min.Y+y).RGBA()
+			rb, gb, bb, _ := b.At(boundsB.Min.X+x, boundsB.Min.Y+y).RGBA()
+			for _, d := range [3]float64{
+				float64(ra) - float64(rb),
+				float64(ga) - float64(gb),
+				float64(ba) - float64(bb),
+			} {
+				d /= 257
+				sum += d * d
+			}
+		}
+	}
+
+	pixels := boundsA.Dx() * boundsA.Dy()
+	if pixels == 0 {
+		return 0, nil
+	}
+	return sum / float64(pixels*3), nil
+}
+
+// PSNR converts a mean squared error into decibels
+func PSNR(mse float64) float64 {
+	if mse == 0 {
+		return math.Inf(1)
+	}
+	return 10 * math.Log10(255*255/mse)
+}
+
+// DiffHeatmap renders the per-pixel difference of two equally sized images,
+// from black (identical) through blue and red to yellow (maximum difference).
+// Differences are amplified so that subtle compression artifacts show up.
+func DiffHeatmap(a, b image.Image) (*image.NRGBA, error) {
+	if err := checkSameSize(a, b); err != nil {
+		return nil, err
+	}
+
+	const amplify = 4
+	boundsA, boundsB := a.Bounds(), b.Bounds()
+	heatmap := image.NewNRGBA(image.Rect(0, 0, boundsA.Dx(), boundsA.Dy()))
+	for y := 0; y < boundsA.Dy(); y++ {
+		for x := 0; x < boundsA.Dx(); x++ {
+			ra, ga, ba, aa := a.At(boundsA.Min.X+x, boundsA.Min.Y+y).RGBA()
+			rb, gb, bb, ab := b.At(boundsB.Min.X+x, boundsB.Min.Y+y).RGBA()
+
+			diff := max(absDiff(ra, rb), absDiff(ga, gb), absDiff(ba, bb), absDiff(aa, ab))
+			heatmap.SetNRGBA(x, y, heatColor(min(float64(diff)/0xffff*amplify, 1)))
+		}
+	}
+	return heatmap, nil
+}
+
+// heatColor maps t in [0, 1] onto the black-blue-red-yellow ramp
+func heatColor(t float64) color.NRGBA {
+	switch {
+	case t < 1.0/3:
+		return color.NRGBA{B: uint8(t * 3 * 255), A: 255}
+	case t < 2.0/3:
+		u := (t - 1.0/3) * 3
+		return color.NRGBA{R: uint8(u * 255), B: uint8((1 - u) * 255), A: 255}
+	default:
+		u := (t - 2.0/3) * 3
+		return color.NRGBA{R: 255, G: uint8(u * 255), A: 255}
+	}
+}
+
+func absDiff(a, b uint32) uint32 {
+	if a > b {
+		return a - b
+	}
+	return b - a
+}
+
+func checkSameSize(a, b image.Image) error {
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return fmt.Errorf("image sizes differ: %v and %v", a.Bounds().Size(), b.Bounds().Size())
+	}
+	return nil
+}
+
+// ssimWindow and ssimStride define the sliding window used by SSIM
+const (
+	ssimWindow = 8
+	ssimStride = 4
+)
+
+// SSIM returns the mean structural similarity of two equally sized images,
+// from 0 (unrelated) to 1 (identical), computed on luminance
+func SSIM(a, b image.Image) (float64, error) {
+	if err := checkSameSize(a, b); err != nil {
+		return 0, err
+	}
+
+	la, width, height := luminance(a)
+	lb, _, _ := luminance(b)
+	if width < ssimWindow || height < ssimWindow {
+		// Too small for a window, fall back to a single global window
+		return ssimWindowAt(la, lb, width, 0, 0, width, height), nil
+	}
+
+	var total float64
+	var windows int
+	for y := 0; y+ssimWindow <= height; y += ssimStride {
+		for x := 0; x+ssimWindow <= width; x += ssimStride {
+			total += ssimWindowAt(la, lb, width, x, y, ssimWindow, ssimWindow)
+			windows++
+		}
+	}
+	return total / float64(windows), nil
+}
+
+func ssimWindowAt(la, lb []float64, stride, x0, y0, w, h int) float64 {
+	const (
+		c1 = (0.01 * 255) * (0.01 * 255)
+		c2 = (0.03 * 255) * (0.03 * 255)
+	)
+
+	n := float64(w * h)
+	var sumA, sumB float64
+	for y := y0; y < y0+h; y++ {
+		for x := x0; x < x0+w; x++ {
+			sumA += la[y*stride+x]
+			sumB += lb[y*stride+x]
+		}
+	}
+	meanA, meanB := sumA/n, sumB/n
+
+	var varA, varB, covar float64
+	for y := y0; y < y0+h; y++ {
+		for x := x0; x < x0+w; x++ {
+			da := la[y*stride+x] - meanA
+			db := lb[y*stride+x] - meanB
+			varA += da * da
+			varB += db * db
+			covar += da * db
+		}
+	}
+	varA /= n
+	varB /= n
+	covar /= n
+
+	return ((2*meanA*meanB + c1) * (2*covar + c2)) /
+		((meanA*meanA + meanB*meanB + c1) * (varA + varB + c2))
+}
+
+// luminance returns the Rec. 601 luma of every pixel on a 0-255 scale
+func luminance(img image.Image) ([]float64, int, int) {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	luma := make([]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			luma[y*width+x] = (0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)) / 257
+		}
+	}
+	return luma, width, height
+}
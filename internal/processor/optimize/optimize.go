@@ -1,21 +1,25 @@
 package optimize
 
 import (
+	"bytes"
 	"image"
 	"image/jpeg"
 	"image/png"
 	"io"
 
+	"github.com/chai2010/webp"
 	"github.com/dendianugerah/reubah/internal/constants"
 	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/disintegration/imaging"
 )
 
 type OptimizeOptions struct {
 	Quality       int  // 1-100 for JPEG/WebP
-	Progressive   bool // For JPEG
 	Compression   int  // 0-9 for PNG
 	StripMetadata bool // Remove EXIF and other metadata
 	AutoQuality   bool // Automatically determine quality based on image content
+	Colors        int  // Quantize PNG to this many colors (2-256), 0 keeps full color
+	Dither        bool // Dither quantized PNGs
 }
 
 type QualityLevel string
@@ -33,7 +37,6 @@ func DefaultOptions(format string) OptimizeOptions {
 	case "jpeg", "jpg":
 		return OptimizeOptions{
 			Quality:       constants.DefaultQuality,
-			Progressive:   true,
 			StripMetadata: true,
 			AutoQuality:   true,
 		}
@@ -41,6 +44,7 @@ func DefaultOptions(format string) OptimizeOptions {
 		return OptimizeOptions{
 			Compression:   9,
 			StripMetadata: true,
+			Dither:        true,
 		}
 	case "webp":
 		return OptimizeOptions{
@@ -60,13 +64,22 @@ func DefaultOptions(format string) OptimizeOptions {
 func GetOptionsForQuality(format string, level QualityLevel) OptimizeOptions {
 	opts := DefaultOptions(format)
 
+	// PNG is lossless, so lower levels trade colors instead
+	isPNG := format == "png"
+
 	switch level {
 	case QualityLow:
 		opts.Quality = 60
 		opts.StripMetadata = true
+		if isPNG {
+			opts.Colors = 64
+		}
 	case QualityMedium:
 		opts.Quality = 75
 		opts.StripMetadata = true
+		if isPNG {
+			opts.Colors = 256
+		}
 	case QualityHigh:
 		opts.Quality = 90
 		opts.StripMetadata = false
@@ -82,7 +95,7 @@ func GetOptionsForQuality(format string, level QualityLevel) OptimizeOptions {
 // Optimize writes the image to the writer with optimization options
 func Optimize(w io.Writer, img image.Image, format string, opts OptimizeOptions) error {
 	if opts.AutoQuality {
-		opts = autoAdjustQuality(img, opts)
+		opts = autoAdjustQuality(img, format, opts)
 	}
 
 	switch format {
@@ -108,8 +121,12 @@ func optimizeJPEG(w io.Writer, img image.Image, opts OptimizeOptions) error {
 }
 
 func optimizePNG(w io.Writer, img image.Image, opts OptimizeOptions) error {
+	if opts.Colors > 0 {
+		img = Quantize(img, min(opts.Colors, 256), opts.Dither)
+	}
+
 	encoder := png.Encoder{
-		CompressionLevel: png.CompressionLevel(opts.Compression),
+		CompressionLevel: pngCompressionLevel(opts.Compression),
 	}
 	if err := encoder.Encode(w, img); err != nil {
 		return errors.New(errors.ErrOptimizationFailed, "failed to optimize PNG", err)
@@ -117,61 +134,70 @@ func optimizePNG(w io.Writer, img image.Image, opts OptimizeOptions) error {
 	return nil
 }
 
-func optimizeWebP(w io.Writer, img image.Image, opts OptimizeOptions) error {
-	return errors.New(errors.ErrOptimizationFailed, "WebP optimization not implemented", nil)
+// pngCompressionLevel maps a 0-9 zlib-style level onto the levels image/png
+// supports, 0 meaning its default
+func pngCompressionLevel(level int) png.CompressionLevel {
+	switch {
+	case level <= 0:
+		return png.DefaultCompression
+	case level <= 3:
+		return png.BestSpeed
+	case level <= 6:
+		return png.DefaultCompression
+	default:
+		return png.BestCompression
+	}
 }
 
-// autoAdjustQuality analyzes image content and adjusts quality settings
-func autoAdjustQuality(img image.Image, opts OptimizeOptions) OptimizeOptions {
-	complexity := calculateImageComplexity(img)
-
-	if complexity < 0.3 {
-		opts.Quality = 70 // Simple images
-	} else if complexity < 0.6 {
-		opts.Quality = 80 // Medium complexity
-	} else {
-		opts.Quality = 90 // Complex images
+func optimizeWebP(w io.Writer, img image.Image, opts OptimizeOptions) error {
+	options := &webp.Options{
+		Lossless: opts.Quality == 100,
+		Quality:  float32(opts.Quality),
 	}
-
-	return opts
+	if err := webp.Encode(w, img, options); err != nil {
+		return errors.New(errors.ErrOptimizationFailed, "failed to optimize WebP", err)
+	}
+	return nil
 }
 
-// calculateImageComplexity returns a value between 0 and 1
-func calculateImageComplexity(img image.Image) float64 {
-	bounds := img.Bounds()
-	width := bounds.Dx()
-	height := bounds.Dy()
-
-	if width == 0 || height == 0 {
-		return 0
-	}
+// autoQualitySteps are the qualities tried by autoAdjustQuality, lowest first
+var autoQualitySteps = []int{60, 70, 80, 90}
 
-	sampleSize := 100
-	variance := 0.0
-	lastColor := img.At(0, 0)
+// autoQualityMaxEdge bounds the size of the copy used to search for a
+// quality, so large images don't get encoded several times at full size
+const autoQualityMaxEdge = 1024
 
-	for i := 0; i < sampleSize; i++ {
-		x := (i * width) / sampleSize
-		for j := 0; j < sampleSize; j++ {
-			y := (j * height) / sampleSize
-			currentColor := img.At(x, y)
+// autoAdjustQuality picks the lowest quality whose encoding keeps an SSIM of
+// at least DefaultMinSSIM against the original
+func autoAdjustQuality(img image.Image, format string, opts OptimizeOptions) OptimizeOptions {
+	if format != "jpeg" && format != "jpg" && format != "webp" {
+		return opts
+	}
 
-			r1, g1, b1, _ := lastColor.RGBA()
-			r2, g2, b2, _ := currentColor.RGBA()
+	sample := img
+	if b := img.Bounds(); b.Dx() > autoQualityMaxEdge || b.Dy() > autoQualityMaxEdge {
+		sample = imaging.Fit(img, autoQualityMaxEdge, autoQualityMaxEdge, imaging.Box)
+	}
 
-			diff := abs(int(r1)-int(r2)) + abs(int(g1)-int(g2)) + abs(int(b1)-int(b2))
-			variance += float64(diff) / float64(0xffff*3)
+	for _, quality := range autoQualitySteps {
+		candidate := opts
+		candidate.Quality = quality
+		candidate.AutoQuality = false
 
-			lastColor = currentColor
+		var buf bytes.Buffer
+		if err := Optimize(&buf, sample, format, candidate); err != nil {
+			break
+		}
+		decoded, _, err := image.Decode(&buf)
+		if err != nil {
+			break
+		}
+		if ssim, err := SSIM(sample, decoded); err == nil && ssim >= DefaultMinSSIM {
+			opts.Quality = quality
+			return opts
 		}
 	}
 
-	return variance / float64(sampleSize*sampleSize)
-}
-
-func abs(x int) int {
-	if x < 0 {
-		return -x
-	}
-	return x
+	opts.Quality = autoQualitySteps[len(autoQualitySteps)-1]
+	return opts
 }
@@ -0,0 +1,230 @@
+package optimize
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Cluster is a palette color together with the number of pixels it stands for
+type Cluster struct {
+	Color color.NRGBA
+	Count int
+}
+
+// MedianCut reduces the colors of img to at most maxColors clusters, sorted
+// by pixel count. Alpha is treated as a fourth channel so semi-transparent
+// pixels get palette entries of their own.
+func MedianCut(img image.Image, maxColors int) []Cluster {
+	if maxColors < 1 {
+		return nil
+	}
+
+	entries := histogram(imaging.Clone(img))
+	if len(entries) == 0 {
+		return nil
+	}
+
+	boxes := []colorBox{newColorBox(entries)}
+	for len(boxes) < maxColors {
+		// Split the box spanning the widest channel range, weighted by the
+		// number of pixels so that large areas get more precise colors
+		best := -1
+		var bestScore float64
+		for i, box := range boxes {
+			if len(box.entries) < 2 {
+				continue
+			}
+			score := float64(box.spread()) * float64(box.count)
+			if best == -1 || score > bestScore {
+				best, bestScore = i, score
+			}
+		}
+		if best == -1 {
+			break
+		}
+
+		a, b := boxes[best].split()
+		boxes[best] = a
+		boxes = append(boxes, b)
+	}
+
+	clusters := make([]Cluster, len(boxes))
+	for i, box := range boxes {
+		clusters[i] = Cluster{Color: box.mean(), Count: box.count}
+	}
+	sort.SliceStable(clusters, func(i, j int) bool {
+		return clusters[i].Count > clusters[j].Count
+	})
+	return clusters
+}
+
+// Palette returns a palette of at most maxColors colors for img
+func Palette(img image.Image, maxColors int) color.Palette {
+	clusters := MedianCut(img, maxColors)
+	palette := make(color.Palette, len(clusters))
+	for i, c := range clusters {
+		palette[i] = c.Color
+	}
+	return palette
+}
+
+// Quantize maps img onto a palette of at most colors entries, optionally
+// diffusing the quantization error with Floyd-Steinberg dithering
+func Quantize(img image.Image, colors int, dither bool) *image.Paletted {
+	bounds := img.Bounds()
+	dst := image.NewPaletted(bounds, Palette(img, colors))
+
+	var drawer draw.Drawer = draw.Src
+	if dither {
+		drawer = draw.FloydSteinberg
+	}
+	drawer.Draw(dst, bounds, img, bounds.Min)
+	return dst
+}
+
+// Quantizer adapts MedianCut to draw.Quantizer for encoders such as
+// image/gif. GIF only knows fully transparent or opaque pixels, so alpha is
+// snapped to either before building the palette.
+type Quantizer struct{}
+
+func (Quantizer) Quantize(p color.Palette, m image.Image) color.Palette {
+	for _, c := range MedianCut(binaryAlpha{m}, cap(p)-len(p)) {
+		p = append(p, c.Color)
+	}
+	return p
+}
+
+// binaryAlpha presents an image with every pixel either transparent or opaque
+type binaryAlpha struct {
+	image.Image
+}
+
+func (b binaryAlpha) ColorModel() color.Model {
+	return color.NRGBAModel
+}
+
+func (b binaryAlpha) At(x, y int) color.Color {
+	c := color.NRGBAModel.Convert(b.Image.At(x, y)).(color.NRGBA)
+	if c.A < 0x80 {
+		return color.NRGBA{}
+	}
+	c.A = 0xff
+	return c
+}
+
+// histogramEntry is a color bucket with channel sums of its pixels
+type histogramEntry struct {
+	sum   [4]int
+	count int
+}
+
+func (e histogramEntry) channel(c int) int {
+	return e.sum[c] / e.count
+}
+
+// histogram buckets pixels by their top 5 bits per channel, keeping exact
+// sums so cluster means are not biased by the bucketing
+func histogram(img *image.NRGBA) []histogramEntry {
+	buckets := make(map[uint32]*histogramEntry)
+	for i := 0; i+3 < len(img.Pix); i += 4 {
+		px := [4]int{int(img.Pix[i]), int(img.Pix[i+1]), int(img.Pix[i+2]), int(img.Pix[i+3])}
+		if px[3] == 0 {
+			// All fully transparent pixels look the same
+			px = [4]int{}
+		}
+
+		key := uint32(px[0]>>3)<<15 | uint32(px[1]>>3)<<10 | uint32(px[2]>>3)<<5 | uint32(px[3]>>3)
+		entry, ok := buckets[key]
+		if !ok {
+			entry = &histogramEntry{}
+			buckets[key] = entry
+		}
+		for c := 0; c < 4; c++ {
+			entry.sum[c] += px[c]
+		}
+		entry.count++
+	}
+
+	entries := make([]histogramEntry, 0, len(buckets))
+	for _, entry := range buckets {
+		entries = append(entries, *entry)
+	}
+	return entries
+}
+
+// colorBox is a set of histogram entries forming one palette color
+type colorBox struct {
+	entries  []histogramEntry
+	count    int
+	min, max [4]int
+}
+
+func newColorBox(entries []histogramEntry) colorBox {
+	box := colorBox{entries: entries}
+	for c := 0; c < 4; c++ {
+		box.min[c], box.max[c] = 255, 0
+	}
+	for _, e := range entries {
+		box.count += e.count
+		for c := 0; c < 4; c++ {
+			v := e.channel(c)
+			box.min[c] = min(box.min[c], v)
+			box.max[c] = max(box.max[c], v)
+		}
+	}
+	return box
+}
+
+// widest returns the channel with the largest range
+func (b colorBox) widest() int {
+	widest := 0
+	for c := 1; c < 4; c++ {
+		if b.max[c]-b.min[c] > b.max[widest]-b.min[widest] {
+			widest = c
+		}
+	}
+	return widest
+}
+
+func (b colorBox) spread() int {
+	c := b.widest()
+	return b.max[c] - b.min[c]
+}
+
+// split divides the box at the pixel-weighted median of its widest channel
+func (b colorBox) split() (colorBox, colorBox) {
+	c := b.widest()
+	sort.Slice(b.entries, func(i, j int) bool {
+		return b.entries[i].channel(c) < b.entries[j].channel(c)
+	})
+
+	half, seen := b.count/2, 0
+	at := 1
+	for i, e := range b.entries[:len(b.entries)-1] {
+		seen += e.count
+		at = i + 1
+		if seen >= half {
+			break
+		}
+	}
+	return newColorBox(b.entries[:at]), newColorBox(b.entries[at:])
+}
+
+func (b colorBox) mean() color.NRGBA {
+	var sum [4]int
+	for _, e := range b.entries {
+		for c := 0; c < 4; c++ {
+			sum[c] += e.sum[c]
+		}
+	}
+	return color.NRGBA{
+		R: uint8(sum[0] / b.count),
+		G: uint8(sum[1] / b.count),
+		B: uint8(sum[2] / b.count),
+		A: uint8(sum[3] / b.count),
+	}
+}
@@ -0,0 +1,138 @@
+package optimize
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"strings"
+
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// DefaultMinSSIM is the quality floor used when none is given. Above it,
+// differences are hard to spot without flipping between the images.
+const DefaultMinSSIM = 0.97
+
+// Candidate is one encoding tried by EncodeSmallest
+type Candidate struct {
+	Format  string
+	Quality int
+	Colors  int // Palette size for quantized PNG
+}
+
+func (c Candidate) String() string {
+	switch {
+	case c.Colors > 0:
+		return fmt.Sprintf("%s %dc", c.Format, c.Colors)
+	case c.lossless():
+		return c.Format
+	default:
+		return fmt.Sprintf("%s q%d", c.Format, c.Quality)
+	}
+}
+
+func (c Candidate) lossless() bool {
+	if c.Colors > 0 {
+		return false
+	}
+	return c.Format == "png" || c.Format == "bmp" || (c.Format == "webp" && c.Quality == 100)
+}
+
+// DefaultCandidates returns the encodings worth trying. JPEG is left out for
+// images with transparency since it would flatten them.
+func DefaultCandidates(hasAlpha bool) []Candidate {
+	candidates := []Candidate{
+		{Format: "webp", Quality: 80},
+		{Format: "png", Quality: 100, Colors: 256},
+		{Format: "png", Quality: 100},
+	}
+	if !hasAlpha {
+		candidates = append(candidates, Candidate{Format: "jpeg", Quality: 82})
+	}
+	return candidates
+}
+
+// Trial records how a candidate fared
+type Trial struct {
+	Candidate Candidate
+	Size      int
+	SSIM      float64
+}
+
+// SmallestResult is the winning encoding of EncodeSmallest
+type SmallestResult struct {
+	Data    []byte
+	Chosen  Trial
+	Trials  []Trial
+	MinSSIM float64
+}
+
+// Explain describes the choice, e.g.
+// "webp q80 (12034 bytes, ssim 0.981); tried jpeg q82 15873 bytes ssim 0.984, png 40211 bytes"
+func (r *SmallestResult) Explain() string {
+	var tried []string
+	for _, t := range r.Trials {
+		if t.Candidate == r.Chosen.Candidate {
+			continue
+		}
+		entry := fmt.Sprintf("%s %d bytes ssim %.3f", t.Candidate, t.Size, t.SSIM)
+		if t.SSIM < r.MinSSIM {
+			entry += " below floor"
+		}
+		tried = append(tried, entry)
+	}
+
+	explanation := fmt.Sprintf("%s (%d bytes, ssim %.3f, floor %.3f)",
+		r.Chosen.Candidate, r.Chosen.Size, r.Chosen.SSIM, r.MinSSIM)
+	if len(tried) > 0 {
+		explanation += "; tried " + strings.Join(tried, ", ")
+	}
+	return explanation
+}
+
+// EncodeSmallest encodes img with every candidate and returns the smallest
+// encoding whose SSIM against img is at least minSSIM. Lossless candidates
+// always qualify, so include one to guarantee a result.
+func EncodeSmallest(img image.Image, candidates []Candidate, minSSIM float64) (*SmallestResult, error) {
+	if minSSIM <= 0 {
+		minSSIM = DefaultMinSSIM
+	}
+
+	result := &SmallestResult{MinSSIM: minSSIM}
+	for _, c := range candidates {
+		var buf bytes.Buffer
+		opts := OptimizeOptions{
+			Quality:       c.Quality,
+			Compression:   9,
+			StripMetadata: true,
+			Colors:        c.Colors,
+			Dither:        true,
+		}
+		if err := Optimize(&buf, img, c.Format, opts); err != nil {
+			return nil, err
+		}
+
+		trial := Trial{Candidate: c, Size: buf.Len(), SSIM: 1}
+		if !c.lossless() {
+			decoded, _, err := image.Decode(bytes.NewReader(buf.Bytes()))
+			if err != nil {
+				return nil, errors.New(errors.ErrOptimizationFailed,
+					fmt.Sprintf("failed to decode %s candidate", c), err)
+			}
+			if trial.SSIM, err = SSIM(img, decoded); err != nil {
+				return nil, errors.New(errors.ErrOptimizationFailed, "failed to compare candidate", err)
+			}
+		}
+		result.Trials = append(result.Trials, trial)
+
+		if trial.SSIM >= minSSIM && (result.Data == nil || trial.Size < result.Chosen.Size) {
+			result.Data = buf.Bytes()
+			result.Chosen = trial
+		}
+	}
+
+	if result.Data == nil {
+		return nil, errors.New(errors.ErrOptimizationFailed, "no candidate met the quality floor", nil)
+	}
+	return result, nil
+}
@@ -0,0 +1,167 @@
+package palette
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/dendianugerah/reubah/internal/processor/optimize"
+	"github.com/disintegration/imaging"
+)
+
+// analysisSize caps the longest edge of the image the palette is built from,
+// the colors barely change beyond it
+const analysisSize = 256
+
+// minTextContrast is the WCAG AA contrast ratio for normal text
+const minTextContrast = 4.5
+
+// Color is one palette entry with the representations designers ask for
+type Color struct {
+	Hex        string  `json:"hex"`
+	RGB        RGB     `json:"rgb"`
+	HSL        HSL     `json:"hsl"`
+	Percentage float64 `json:"percentage"`
+	// TextColor is black or white, whichever contrasts more with the color
+	TextColor string  `json:"textColor"`
+	Contrast  float64 `json:"contrast"`
+	// AA reports whether TextColor meets the WCAG AA ratio for normal text
+	AA bool `json:"aa"`
+}
+
+type RGB struct {
+	R uint8 `json:"r"`
+	G uint8 `json:"g"`
+	B uint8 `json:"b"`
+}
+
+// HSL holds the hue in degrees and saturation and lightness in percent
+type HSL struct {
+	H float64 `json:"h"`
+	S float64 `json:"s"`
+	L float64 `json:"l"`
+}
+
+// Extract returns up to n dominant colors of img, most common first. It uses
+// the same median-cut quantizer as PNG and GIF palette reduction. Mostly
+// transparent pixels are left out of the palette, and percentages are
+// shares of all opaque pixels, so they add up to less than 100 when the
+// image has more colors than returned.
+func Extract(img image.Image, n int) []Color {
+	if n < 1 {
+		return nil
+	}
+
+	bounds := img.Bounds()
+	if bounds.Dx() > analysisSize || bounds.Dy() > analysisSize {
+		img = imaging.Fit(img, analysisSize, analysisSize, imaging.Box)
+	}
+
+	clusters := opaqueClusters(img, n)
+	var total int
+	for _, c := range clusters {
+		total += c.Count
+	}
+	if len(clusters) > n {
+		clusters = clusters[:n]
+	}
+
+	colors := make([]Color, 0, len(clusters))
+	for _, c := range clusters {
+		entry := newColor(c.Color)
+		entry.Percentage = round(float64(c.Count)*100/float64(total), 2)
+		colors = append(colors, entry)
+	}
+	return colors
+}
+
+// maxClusters bounds how many clusters are asked for to find n opaque ones
+const maxClusters = 256
+
+// opaqueClusters returns the clusters of img that are mostly opaque, at
+// least n of them unless the image has fewer colors. Transparent pixels
+// form clusters of their own, so more clusters are asked for until enough
+// opaque ones remain.
+func opaqueClusters(img image.Image, n int) []optimize.Cluster {
+	var opaque []optimize.Cluster
+	for k := n + 1; ; {
+		clusters := optimize.MedianCut(img, k)
+		opaque = opaque[:0]
+		for _, c := range clusters {
+			if c.Color.A >= 0x80 {
+				opaque = append(opaque, c)
+			}
+		}
+		// Fewer clusters than asked for means the image has no more colors
+		if len(opaque) >= n || len(clusters) < k || k >= maxClusters {
+			return opaque
+		}
+		k = min(k+n-len(opaque), maxClusters)
+	}
+}
+
+func newColor(c color.NRGBA) Color {
+	entry := Color{
+		Hex: fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B),
+		RGB: RGB{R: c.R, G: c.G, B: c.B},
+		HSL: toHSL(c),
+	}
+
+	lum := relativeLuminance(c)
+	black, white := contrastRatio(lum, 0), contrastRatio(lum, 1)
+	if black >= white {
+		entry.TextColor, entry.Contrast = "#000000", round(black, 2)
+	} else {
+		entry.TextColor, entry.Contrast = "#ffffff", round(white, 2)
+	}
+	entry.AA = entry.Contrast >= minTextContrast
+	return entry
+}
+
+func toHSL(c color.NRGBA) HSL {
+	r, g, b := float64(c.R)/255, float64(c.G)/255, float64(c.B)/255
+	hi, lo := math.Max(r, math.Max(g, b)), math.Min(r, math.Min(g, b))
+	l := (hi + lo) / 2
+	if hi == lo {
+		return HSL{L: round(l*100, 1)}
+	}
+
+	d := hi - lo
+	s := d / (1 - math.Abs(2*l-1))
+	var h float64
+	switch hi {
+	case r:
+		h = math.Mod((g-b)/d, 6)
+	case g:
+		h = (b-r)/d + 2
+	default:
+		h = (r-g)/d + 4
+	}
+	h *= 60
+	if h < 0 {
+		h += 360
+	}
+	return HSL{H: round(h, 1), S: round(s*100, 1), L: round(l*100, 1)}
+}
+
+// relativeLuminance follows the WCAG 2 definition
+func relativeLuminance(c color.NRGBA) float64 {
+	channel := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.03928 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	return 0.2126*channel(c.R) + 0.7152*channel(c.G) + 0.0722*channel(c.B)
+}
+
+func contrastRatio(a, b float64) float64 {
+	return (math.Max(a, b) + 0.05) / (math.Min(a, b) + 0.05)
+}
+
+func round(v float64, places int) float64 {
+	p := math.Pow(10, float64(places))
+	return math.Round(v*p) / p
+}
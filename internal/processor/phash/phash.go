@@ -0,0 +1,195 @@
+package phash
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/disintegration/imaging"
+)
+
+// Hash is a 64-bit perceptual hash
+type Hash uint64
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+func (h Hash) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+// Distance returns the number of differing bits between two hashes
+func Distance(a, b Hash) int {
+	return bits.OnesCount64(uint64(a ^ b))
+}
+
+// Hashes holds all supported hashes of one image
+type Hashes struct {
+	AHash Hash `json:"ahash"`
+	DHash Hash `json:"dhash"`
+	PHash Hash `json:"phash"`
+}
+
+// Compute returns the average, difference and DCT hashes of img
+func Compute(img image.Image) Hashes {
+	return Hashes{
+		AHash: AverageHash(img),
+		DHash: DifferenceHash(img),
+		PHash: DCTHash(img),
+	}
+}
+
+// AverageHash sets a bit for every pixel of an 8x8 grayscale thumbnail that
+// is brighter than the thumbnail's mean
+func AverageHash(img image.Image) Hash {
+	pixels := grayscale(img, 8, 8)
+
+	var mean float64
+	for _, p := range pixels {
+		mean += p
+	}
+	mean /= float64(len(pixels))
+
+	var h Hash
+	for i, p := range pixels {
+		if p > mean {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// DifferenceHash sets a bit wherever a pixel of a 9x8 grayscale thumbnail is
+// brighter than its right neighbour, capturing the gradient structure
+func DifferenceHash(img image.Image) Hash {
+	pixels := grayscale(img, 9, 8)
+
+	var h Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			if pixels[y*9+x] > pixels[y*9+x+1] {
+				h |= 1 << uint(y*8+x)
+			}
+		}
+	}
+	return h
+}
+
+// DCTHash compares the lowest 8x8 frequencies of a 32x32 grayscale DCT to
+// their median, which makes it robust to scaling and recompression
+func DCTHash(img image.Image) Hash {
+	const size, low = 32, 8
+	pixels := grayscale(img, size, size)
+	coefficients := dct2D(pixels, size)
+
+	lowFreq := make([]float64, 0, low*low)
+	for y := 0; y < low; y++ {
+		for x := 0; x < low; x++ {
+			lowFreq = append(lowFreq, coefficients[y*size+x])
+		}
+	}
+
+	// The DC term only reflects overall brightness, keep it out of the median
+	sorted := append([]float64(nil), lowFreq[1:]...)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+
+	var h Hash
+	for i, c := range lowFreq {
+		if c > median {
+			h |= 1 << uint(i)
+		}
+	}
+	return h
+}
+
+// grayscale shrinks img to width x height and returns its luminance values
+func grayscale(img image.Image, width, height int) []float64 {
+	small := imaging.Resize(img, width, height, imaging.Box)
+	pixels := make([]float64, width*height)
+	for i := range pixels {
+		r, g, b := small.Pix[i*4], small.Pix[i*4+1], small.Pix[i*4+2]
+		pixels[i] = 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+	}
+	return pixels
+}
+
+// dct2D computes the two-dimensional DCT-II of a size x size matrix
+func dct2D(pixels []float64, size int) []float64 {
+	cosines := make([]float64, size*size)
+	for k := 0; k < size; k++ {
+		for n := 0; n < size; n++ {
+			cosines[k*size+n] = math.Cos(math.Pi / float64(size) * (float64(n) + 0.5) * float64(k))
+		}
+	}
+
+	// Rows first, then columns
+	rows := make([]float64, size*size)
+	for y := 0; y < size; y++ {
+		for k := 0; k < size; k++ {
+			var sum float64
+			for n := 0; n < size; n++ {
+				sum += pixels[y*size+n] * cosines[k*size+n]
+			}
+			rows[y*size+k] = sum
+		}
+	}
+
+	result := make([]float64, size*size)
+	for x := 0; x < size; x++ {
+		for k := 0; k < size; k++ {
+			var sum float64
+			for n := 0; n < size; n++ {
+				sum += rows[n*size+x] * cosines[k*size+n]
+			}
+			result[k*size+x] = sum
+		}
+	}
+	return result
+}
+
+// Group clusters hashes whose DCT hashes are within threshold bits of each
+// other, directly or through a chain of near-duplicates. It returns the
+// indices of every group with more than one member.
+func Group(hashes []Hashes, threshold int) [][]int {
+	parent := make([]int, len(hashes))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	for i := range hashes {
+		for j := i + 1; j < len(hashes); j++ {
+			if Distance(hashes[i].PHash, hashes[j].PHash) <= threshold {
+				parent[find(j)] = find(i)
+			}
+		}
+	}
+
+	members := make(map[int][]int)
+	var roots []int
+	for i := range hashes {
+		root := find(i)
+		if _, seen := members[root]; !seen {
+			roots = append(roots, root)
+		}
+		members[root] = append(members[root], i)
+	}
+
+	var groups [][]int
+	for _, root := range roots {
+		if len(members[root]) > 1 {
+			groups = append(groups, members[root])
+		}
+	}
+	return groups
+}
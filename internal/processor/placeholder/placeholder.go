@@ -0,0 +1,66 @@
+package placeholder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+
+	"github.com/chai2010/webp"
+	"github.com/dendianugerah/reubah/internal/processor/palette"
+	"github.com/disintegration/imaging"
+)
+
+// Sizes of the thumbnails the placeholders are computed from
+const (
+	blurHashSize  = 32
+	thumbHashSize = 100
+	lqipSize      = 32
+	lqipQuality   = 30
+)
+
+// dominantColors is the palette size the dominant color is picked from
+const dominantColors = 8
+
+// Placeholders are lightweight stand-ins shown while an image loads
+type Placeholders struct {
+	BlurHash      string `json:"blurhash"`
+	ThumbHash     string `json:"thumbhash"`
+	LQIP          string `json:"lqip"`
+	DominantColor string `json:"dominantColor"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+}
+
+// Generate computes all placeholders for img
+func Generate(img image.Image) (*Placeholders, error) {
+	bounds := img.Bounds()
+	if bounds.Empty() {
+		return nil, fmt.Errorf("image is empty")
+	}
+
+	p := &Placeholders{Width: bounds.Dx(), Height: bounds.Dy()}
+
+	// 4x3 components suit landscape images, 3x4 portrait ones
+	xComponents, yComponents := 4, 3
+	if bounds.Dy() > bounds.Dx() {
+		xComponents, yComponents = 3, 4
+	}
+	p.BlurHash = BlurHash(imaging.Fit(img, blurHashSize, blurHashSize, imaging.Box), xComponents, yComponents)
+
+	p.ThumbHash = base64.StdEncoding.EncodeToString(
+		ThumbHash(imaging.Fit(img, thumbHashSize, thumbHashSize, imaging.Box)))
+
+	var lqip bytes.Buffer
+	tiny := imaging.Fit(img, lqipSize, lqipSize, imaging.Lanczos)
+	if err := webp.Encode(&lqip, tiny, &webp.Options{Quality: lqipQuality}); err != nil {
+		return nil, fmt.Errorf("failed to encode LQIP: %w", err)
+	}
+	p.LQIP = "data:image/webp;base64," + base64.StdEncoding.EncodeToString(lqip.Bytes())
+
+	p.DominantColor = "#000000"
+	if colors := palette.Extract(img, dominantColors); len(colors) > 0 {
+		p.DominantColor = colors[0].Hex
+	}
+	return p, nil
+}
@@ -0,0 +1,149 @@
+package placeholder
+
+import (
+	"image"
+	"math"
+)
+
+// ThumbHash encodes img, which must fit within 100x100, following the
+// reference ThumbHash encoder. Unlike BlurHash it keeps the aspect ratio and
+// alpha channel.
+func ThumbHash(img *image.NRGBA) []byte {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	pixel := func(i int) (r, g, b, a float64) {
+		offset := (i/w)*img.Stride + (i%w)*4
+		return float64(img.Pix[offset]), float64(img.Pix[offset+1]),
+			float64(img.Pix[offset+2]), float64(img.Pix[offset+3]) / 255
+	}
+
+	// Determine the average color
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < w*h; i++ {
+		r, g, b, alpha := pixel(i)
+		avgR += alpha / 255 * r
+		avgG += alpha / 255 * g
+		avgB += alpha / 255 * b
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR /= avgA
+		avgG /= avgA
+		avgB /= avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	lLimit := 7.0
+	if hasAlpha {
+		// Use fewer luminance bits if there's alpha
+		lLimit = 5
+	}
+	longest := float64(max(w, h))
+	lx := max(1, int(jsRound(lLimit*float64(w)/longest)))
+	ly := max(1, int(jsRound(lLimit*float64(h)/longest)))
+
+	// Convert to luminance, yellow-blue, red-green and alpha, composited
+	// atop the average color
+	l := make([]float64, w*h)
+	p := make([]float64, w*h)
+	q := make([]float64, w*h)
+	a := make([]float64, w*h)
+	for i := 0; i < w*h; i++ {
+		r, g, b, alpha := pixel(i)
+		r = avgR*(1-alpha) + alpha/255*r
+		g = avgG*(1-alpha) + alpha/255*g
+		b = avgB*(1-alpha) + alpha/255*b
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	encodeChannel := func(channel []float64, nx, ny int) (dc float64, ac []float64, scale float64) {
+		fx := make([]float64, w)
+		for cy := 0; cy < ny; cy++ {
+			for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+				var f float64
+				for x := 0; x < w; x++ {
+					fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+				}
+				for y := 0; y < h; y++ {
+					fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+					for x := 0; x < w; x++ {
+						f += channel[x+y*w] * fx[x] * fy
+					}
+				}
+				f /= float64(w * h)
+				if cx > 0 || cy > 0 {
+					ac = append(ac, f)
+					scale = math.Max(scale, math.Abs(f))
+				} else {
+					dc = f
+				}
+			}
+		}
+		if scale > 0 {
+			for i := range ac {
+				ac[i] = 0.5 + 0.5/scale*ac[i]
+			}
+		}
+		return dc, ac, scale
+	}
+
+	lDC, lAC, lScale := encodeChannel(l, max(3, lx), max(3, ly))
+	pDC, pAC, pScale := encodeChannel(p, 3, 3)
+	qDC, qAC, qScale := encodeChannel(q, 3, 3)
+	var aDC, aScale float64
+	var aAC []float64
+	if hasAlpha {
+		aDC, aAC, aScale = encodeChannel(a, 5, 5)
+	}
+
+	// Write the constants
+	isLandscape := w > h
+	header24 := int(jsRound(63*lDC)) | int(jsRound(31.5+31.5*pDC))<<6 |
+		int(jsRound(31.5+31.5*qDC))<<12 | int(jsRound(31*lScale))<<18 | boolBit(hasAlpha)<<23
+	header16 := int(jsRound(63*pScale))<<3 | int(jsRound(63*qScale))<<9 | boolBit(isLandscape)<<15
+	if isLandscape {
+		header16 |= ly
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{
+		byte(header24), byte(header24 >> 8), byte(header24 >> 16),
+		byte(header16), byte(header16 >> 8),
+	}
+	if hasAlpha {
+		hash = append(hash, byte(int(jsRound(15*aDC))|int(jsRound(15*aScale))<<4))
+	}
+
+	// Write the varying factors, two per byte
+	channels := [][]float64{lAC, pAC, qAC}
+	if hasAlpha {
+		channels = append(channels, aAC)
+	}
+	acStart, acIndex := len(hash), 0
+	for _, ac := range channels {
+		for _, f := range ac {
+			at := acStart + acIndex>>1
+			for len(hash) <= at {
+				hash = append(hash, 0)
+			}
+			hash[at] |= byte(int(jsRound(15*f)) << ((acIndex & 1) << 2))
+			acIndex++
+		}
+	}
+	return hash
+}
+
+// jsRound rounds half up like JavaScript's Math.round, which the reference
+// encoder relies on
+func jsRound(v float64) float64 {
+	return math.Floor(v + 0.5)
+}
+
+func boolBit(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -19,9 +19,12 @@ import (
 
 	"github.com/MaestroError/go-libheif"
 	"github.com/chai2010/webp"
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/dendianugerah/reubah/internal/processor/analyze"
 	"github.com/dendianugerah/reubah/internal/processor/background"
 	"github.com/dendianugerah/reubah/internal/processor/optimize"
 	"github.com/dendianugerah/reubah/internal/processor/resize"
+	"github.com/dendianugerah/reubah/internal/processor/trim"
 	"github.com/disintegration/imaging"
 	"github.com/jung-kurt/gofpdf"
 	"golang.org/x/image/bmp"
@@ -29,10 +32,13 @@ import (
 
 // DecodeHeic decodes HEIC/HEIF images
 func DecodeHeic(r io.Reader) (image.Image, error) {
-	// Create temporary file for the HEIC data
-	tmpDir := os.TempDir()
-	tmpHEIC := filepath.Join(tmpDir, "temp_input.heic")
-	defer os.Remove(tmpHEIC)
+	// Every call gets its own directory, as images are decoded concurrently
+	tmpDir, err := os.MkdirTemp("", "reubah-heic-*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpHEIC := filepath.Join(tmpDir, "input.heic")
 
 	// Create temporary file
 	f, err := os.Create(tmpHEIC)
@@ -47,8 +53,7 @@ func DecodeHeic(r io.Reader) (image.Image, error) {
 	}
 
 	// Create temporary file for JPEG output
-	tmpJPG := filepath.Join(tmpDir, "temp_output.jpg")
-	defer os.Remove(tmpJPG)
+	tmpJPG := filepath.Join(tmpDir, "output.jpg")
 
 	// Convert HEIC to JPEG
 	if err := libheif.HeifToJpeg(tmpHEIC, tmpJPG, 100); err != nil {
@@ -115,8 +120,48 @@ type ProcessOptions struct {
 	ResizeMode       resize.ResizeMode
 	OutputFormat     string
 	Quality          int
-	RemoveBackground bool
 	OptimizeImage    bool
+	RemoveBackground bool
+	// BackgroundRemoval tunes RemoveBackground
+	BackgroundRemoval background.Options
+	// Remover is the ID of the background remover, which only keys the
+	// cache as the processor is given the remover itself
+	Remover string
+	// BackgroundFill replaces the transparent background
+	BackgroundFill background.Fill
+	// Trim crops uniform or transparent borders before resizing
+	Trim        bool
+	TrimOptions trim.Options
+	// PadColor fills the canvas of resize.ModePad, transparent by default
+	PadColor color.NRGBA
+	// Anchor positions the image for resize.ModePad and resize.ModeFill
+	Anchor imaging.Anchor
+	// Filter names the resampling filter, empty for resize.DefaultFilter
+	Filter             string
+	WithoutEnlargement bool
+	// DPR scales Width and Height for high density displays
+	DPR float64
+	// Scale, LongEdge, ShortEdge and MaxMegapixels size the image relative
+	// to itself, see resize.ResizeOptions
+	Scale         float64
+	LongEdge      int
+	ShortEdge     int
+	MaxMegapixels float64
+	// AcceptedFormats lists the negotiable formats the client accepts and is
+	// only used when OutputFormat is FormatAuto
+	AcceptedFormats []string
+	// MinSSIM is the quality floor for FormatSmallest, 0 means the default
+	MinSSIM float64
+	// Colors limits PNG and GIF output to a palette of this size, 0 keeps
+	// full color for PNG and 256 colors for GIF
+	Colors   int
+	NoDither bool
+}
+
+// resizing reports whether any of the sizing options is set
+func (o ProcessOptions) resizing() bool {
+	return o.Width > 0 || o.Height > 0 || o.Scale > 0 || o.LongEdge > 0 ||
+		o.ShortEdge > 0 || o.MaxMegapixels > 0
 }
 
 type Config struct {
@@ -125,49 +170,103 @@ type Config struct {
 }
 
 type ImageProcessor struct {
-	config Config
+	config  Config
+	remover background.Remover
 }
 
 func NewImageProcessor() *ImageProcessor {
 	return &ImageProcessor{
 		config: Config{
-			DefaultQuality: 85,
-			DefaultFormat:  "jpeg",
+			DefaultQuality: constants.DefaultQuality,
+			DefaultFormat:  constants.DefaultFormat,
 		},
+		remover: background.Native{},
 	}
 }
 
+// WithConfig sets the defaults for options a request leaves out
+func (p *ImageProcessor) WithConfig(config Config) *ImageProcessor {
+	p.config = config
+	return p
+}
+
+// WithRemover sets the backend used for background removal
+func (p *ImageProcessor) WithRemover(r background.Remover) *ImageProcessor {
+	p.remover = r
+	return p
+}
+
 func (p *ImageProcessor) ProcessImageData(img image.Image, opts ProcessOptions) (*ProcessedImage, error) {
 	// Set default format and validate
 	if opts.OutputFormat == "" {
 		opts.OutputFormat = p.config.DefaultFormat
 	}
-	if !isValidFormat(opts.OutputFormat) {
+	if !IsValidFormat(opts.OutputFormat) {
 		return nil, fmt.Errorf("unsupported format: %s", opts.OutputFormat)
 	}
 
 	var err error
 	// Remove background if requested
+	original := img
 	if opts.RemoveBackground {
-		img, err = background.RemoveBackground(img)
+		img, err = p.remover.Remove(img, opts.BackgroundRemoval)
 		if err != nil {
 			return nil, fmt.Errorf("failed to remove background: %w", err)
 		}
 	}
 
+	// Trim before resizing so the content fills the target box
+	if opts.Trim {
+		var area image.Rectangle
+		img, area = trim.Trim(img, opts.TrimOptions)
+		// The cut-out has the size of the original, so the same crop keeps
+		// a blurred backdrop behind the subject
+		if opts.BackgroundFill.Active() {
+			original = imaging.Crop(original, area)
+		}
+	}
+
+	// Replace the background, which may also be transparent in the source
+	if opts.BackgroundFill.Active() {
+		img, err = background.Composite(img, original, opts.BackgroundFill)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fill background: %w", err)
+		}
+	}
+
 	// Resize if needed
-	if opts.Width > 0 || opts.Height > 0 {
+	if opts.resizing() {
+		filter, err := resize.ParseFilter(opts.Filter)
+		if err != nil {
+			return nil, err
+		}
 		img, err = resize.Resize(img, resize.ResizeOptions{
-			Width:  opts.Width,
-			Height: opts.Height,
-			Mode:   opts.ResizeMode,
-			Filter: imaging.Lanczos,
+			Width:              opts.Width,
+			Height:             opts.Height,
+			Mode:               opts.ResizeMode,
+			Filter:             filter,
+			Background:         opts.PadColor,
+			Anchor:             opts.Anchor,
+			WithoutEnlargement: opts.WithoutEnlargement,
+			DPR:                opts.DPR,
+			Scale:              opts.Scale,
+			LongEdge:           opts.LongEdge,
+			ShortEdge:          opts.ShortEdge,
+			MaxMegapixels:      opts.MaxMegapixels,
 		})
 		if err != nil {
 			return nil, fmt.Errorf("failed to resize image: %w", err)
 		}
 	}
 
+	// Pick the format once the final pixels are known
+	if opts.OutputFormat == FormatSmallest {
+		return encodeSmallest(img, opts)
+	}
+	if opts.OutputFormat == FormatAuto {
+		opts.OutputFormat = ChooseFormat(img, opts.AcceptedFormats)
+	}
+
 	// Add optimization step
 	if opts.OptimizeImage {
 		optimizeOpts := optimize.GetOptionsForQuality(opts.OutputFormat,
@@ -187,6 +286,8 @@ func (p *ImageProcessor) ProcessImageData(img image.Image, opts ProcessOptions)
 		Image:   img,
 		Format:  opts.OutputFormat,
 		Quality: opts.Quality,
+		Colors:  opts.Colors,
+		Dither:  !opts.NoDither,
 	}, nil
 }
 
@@ -194,9 +295,38 @@ type ProcessedImage struct {
 	Image   image.Image
 	Format  string
 	Quality int
+	Colors  int
+	Dither  bool
+	// Encoded holds the final bytes when the encoding was already chosen
+	// during processing, Choice explains that choice
+	Encoded []byte
+	Choice  string
+}
+
+// encodeSmallest encodes img with the default candidates and keeps the
+// smallest one that stays above the quality floor
+func encodeSmallest(img image.Image, opts ProcessOptions) (*ProcessedImage, error) {
+	result, err := optimize.EncodeSmallest(img,
+		optimize.DefaultCandidates(analyze.HasAlpha(img)), opts.MinSSIM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find smallest encoding: %w", err)
+	}
+
+	return &ProcessedImage{
+		Image:   img,
+		Format:  result.Chosen.Candidate.Format,
+		Quality: result.Chosen.Candidate.Quality,
+		Encoded: result.Data,
+		Choice:  result.Explain(),
+	}, nil
 }
 
 func (pi *ProcessedImage) Write(w io.Writer) error {
+	if pi.Encoded != nil {
+		_, err := w.Write(pi.Encoded)
+		return err
+	}
+
 	switch pi.Format {
 	case "jpeg", "jpg":
 		// Create a new white background image
@@ -222,10 +352,23 @@ func (pi *ProcessedImage) Write(w io.Writer) error {
 
 		return jpeg.Encode(w, bgImage, &jpeg.Options{Quality: pi.Quality})
 	case "png":
+		if pi.Colors > 0 {
+			return png.Encode(w, optimize.Quantize(pi.Image, min(pi.Colors, 256), pi.Dither))
+		}
 		return png.Encode(w, pi.Image)
 	case "gif":
+		numColors := 256
+		if pi.Colors > 0 && pi.Colors < numColors {
+			numColors = pi.Colors
+		}
+		var drawer draw.Drawer = draw.FloydSteinberg
+		if !pi.Dither {
+			drawer = draw.Src
+		}
 		return gif.Encode(w, pi.Image, &gif.Options{
-			NumColors: 256,
+			NumColors: numColors,
+			Quantizer: optimize.Quantizer{},
+			Drawer:    drawer,
 		})
 	case "bmp":
 		return bmp.Encode(w, pi.Image)
@@ -239,7 +382,8 @@ func (pi *ProcessedImage) Write(w io.Writer) error {
 	}
 }
 
-func isValidFormat(format string) bool {
+// IsValidFormat reports whether format can be requested as output
+func IsValidFormat(format string) bool {
 	validFormats := map[string]bool{
 		"jpeg": true,
 		"jpg":  true,
@@ -251,6 +395,9 @@ func isValidFormat(format string) bool {
 		"heif": true,
 		"pdf":  true,
 		"ico":  true,
+		// Resolved during processing
+		FormatAuto:     true,
+		FormatSmallest: true,
 	}
 	return validFormats[format]
 }
@@ -269,14 +416,15 @@ func getQualityLevel(quality int) string {
 }
 
 func encodeHEIC(w io.Writer, img image.Image, quality int) error {
-	// Create temporary files for the conversion process
-	tmpDir := os.TempDir()
-	tmpPNG := filepath.Join(tmpDir, "temp.png")
-	tmpHEIC := filepath.Join(tmpDir, "temp.heic")
-
-	// Clean up temporary files when done
-	defer os.Remove(tmpPNG)
-	defer os.Remove(tmpHEIC)
+	// Every call gets its own directory for the conversion, as images are
+	// encoded concurrently
+	tmpDir, err := os.MkdirTemp("", "reubah-heic-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpPNG := filepath.Join(tmpDir, "input.png")
+	tmpHEIC := filepath.Join(tmpDir, "output.heic")
 
 	// Save image as PNG first
 	pngFile, err := os.Create(tmpPNG)
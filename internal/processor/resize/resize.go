@@ -3,11 +3,13 @@ package resize
 import (
 	"fmt"
 	"image"
+	"image/color"
+	"math"
 	"strings"
 
-	"github.com/disintegration/imaging"
 	"github.com/dendianugerah/reubah/internal/constants"
 	"github.com/dendianugerah/reubah/pkg/errors"
+	"github.com/disintegration/imaging"
 )
 
 // ResizeMode defines how the image should be resized
@@ -17,6 +19,7 @@ const (
 	ModeAspectFit ResizeMode = iota // Maintain aspect ratio, fit within dimensions
 	ModeFill                        // Fill the dimensions, crop if necessary
 	ModeStretch                     // Stretch/squish to exactly match dimensions
+	ModePad                         // Fit within dimensions and pad to exactly match them
 )
 
 // String representations of resize modes
@@ -24,6 +27,7 @@ const (
 	ModeAspectFitStr = "fit"
 	ModeFillStr      = "fill"
 	ModeStretchStr   = "stretch"
+	ModePadStr       = "pad"
 )
 
 // ParseResizeMode converts a string to ResizeMode
@@ -35,17 +39,100 @@ func ParseResizeMode(mode string) (ResizeMode, error) {
 		return ModeFill, nil
 	case ModeStretchStr, "exact":
 		return ModeStretch, nil
+	case ModePadStr, "contain", "letterbox":
+		return ModePad, nil
 	default:
 		return ModeAspectFit, fmt.Errorf("invalid resize mode: %s", mode)
 	}
 }
 
+// maxWidth and maxHeight bound the size of resized images
+var (
+	maxWidth  = constants.MaxImageWidth
+	maxHeight = constants.MaxImageHeight
+)
+
+// SetMaxDimensions sets the largest size images may be resized to
+func SetMaxDimensions(width, height int) {
+	maxWidth, maxHeight = width, height
+}
+
+// anchors maps anchor names to the positions they stand for
+var anchors = map[string]imaging.Anchor{
+	"center":      imaging.Center,
+	"top":         imaging.Top,
+	"bottom":      imaging.Bottom,
+	"left":        imaging.Left,
+	"right":       imaging.Right,
+	"topleft":     imaging.TopLeft,
+	"topright":    imaging.TopRight,
+	"bottomleft":  imaging.BottomLeft,
+	"bottomright": imaging.BottomRight,
+}
+
+// ParseAnchor converts a name such as "center" or "topleft" to an anchor
+func ParseAnchor(anchor string) (imaging.Anchor, error) {
+	a, ok := anchors[strings.ToLower(strings.NewReplacer("-", "", "_", "").Replace(anchor))]
+	if !ok {
+		return imaging.Center, fmt.Errorf("invalid anchor: %s", anchor)
+	}
+	return a, nil
+}
+
+// DefaultFilter is the resampling filter used when none is selected
+const DefaultFilter = "lanczos"
+
+// filters maps filter names to resampling filters
+var filters = map[string]imaging.ResampleFilter{
+	"nearest":    imaging.NearestNeighbor,
+	"box":        imaging.Box,
+	"linear":     imaging.Linear,
+	"catmullrom": imaging.CatmullRom,
+	"mitchell":   imaging.MitchellNetravali,
+	"lanczos":    imaging.Lanczos,
+}
+
+// ParseFilter converts a filter name such as "nearest" or "lanczos" to a
+// resampling filter, an empty name selects DefaultFilter
+func ParseFilter(name string) (imaging.ResampleFilter, error) {
+	if name == "" {
+		name = DefaultFilter
+	}
+	f, ok := filters[strings.ToLower(name)]
+	if !ok {
+		return imaging.Lanczos, fmt.Errorf("invalid resampling filter: %s", name)
+	}
+	return f, nil
+}
+
 // ResizeOptions contains all options for image resizing
 type ResizeOptions struct {
 	Width  int
 	Height int
 	Mode   ResizeMode
 	Filter imaging.ResampleFilter
+	// Background fills the canvas around the image in ModePad, the zero
+	// value is transparent
+	Background color.NRGBA
+	// Anchor positions the image on the ModePad canvas and selects the
+	// part kept by ModeFill
+	Anchor imaging.Anchor
+	// WithoutEnlargement keeps images smaller than the target at their own
+	// size instead of upscaling them
+	WithoutEnlargement bool
+	// DPR multiplies Width and Height for high density displays, 0 means 1
+	DPR float64
+
+	// Scale resizes by a factor of the original size instead of to Width
+	// and Height
+	Scale float64
+	// LongEdge and ShortEdge resize so that edge gets this length,
+	// keeping the aspect ratio
+	LongEdge  int
+	ShortEdge int
+	// MaxMegapixels shrinks the result, keeping the aspect ratio, until it
+	// has at most this many million pixels
+	MaxMegapixels float64
 }
 
 // Resize resizes the image according to the specified options
@@ -59,34 +146,93 @@ func Resize(img image.Image, opts ResizeOptions) (image.Image, error) {
 	origWidth := bounds.Dx()
 	origHeight := bounds.Dy()
 
-	// Validate dimensions
+	// Check the raw inputs, then the size they work out to
 	if err := validateDimensions(opts.Width, opts.Height, origWidth, origHeight); err != nil {
 		return nil, err
 	}
+	opts = resolveTarget(opts, origWidth, origHeight)
 
 	// If no resize needed, return original
 	if opts.Width == 0 && opts.Height == 0 {
 		return img, nil
 	}
 
+	width, height := outputSize(opts, origWidth, origHeight)
+	if err := validateDimensions(width, height, origWidth, origHeight); err != nil {
+		return nil, err
+	}
+
 	switch opts.Mode {
 	case ModeAspectFit:
 		return aspectFit(img, opts, origWidth, origHeight)
 	case ModeFill:
 		return fill(img, opts, origWidth, origHeight)
 	case ModeStretch:
-		return imaging.Resize(img, opts.Width, opts.Height, imaging.Lanczos), nil
+		return stretch(img, opts, origWidth, origHeight)
+	case ModePad:
+		return pad(img, opts, origWidth, origHeight)
 	default:
 		return nil, errors.New(errors.ErrInvalidFormat, fmt.Sprintf("unsupported resize mode: %d", opts.Mode), nil)
 	}
 }
 
+// resolveTarget turns the relative sizing options into Width and Height
+func resolveTarget(opts ResizeOptions, origWidth, origHeight int) ResizeOptions {
+	landscape := origWidth >= origHeight
+	switch {
+	case opts.Scale > 0:
+		// A small scale of a thin image still leaves a pixel, not an
+		// automatic side
+		opts.Width = max(1, int(math.Round(float64(origWidth)*opts.Scale)))
+		opts.Height = max(1, int(math.Round(float64(origHeight)*opts.Scale)))
+	case opts.LongEdge > 0 && landscape, opts.ShortEdge > 0 && !landscape:
+		opts.Width, opts.Height = max(opts.LongEdge, opts.ShortEdge), 0
+	case opts.LongEdge > 0, opts.ShortEdge > 0:
+		opts.Width, opts.Height = 0, max(opts.LongEdge, opts.ShortEdge)
+	}
+
+	if opts.DPR > 0 {
+		if opts.Width > 0 {
+			opts.Width = max(1, int(math.Round(float64(opts.Width)*opts.DPR)))
+		}
+		if opts.Height > 0 {
+			opts.Height = max(1, int(math.Round(float64(opts.Height)*opts.DPR)))
+		}
+	}
+
+	if opts.MaxMegapixels > 0 {
+		width, height := origWidth, origHeight
+		if opts.Width > 0 || opts.Height > 0 {
+			width, height = outputSize(opts, origWidth, origHeight)
+		}
+
+		limit := opts.MaxMegapixels * 1e6
+		if pixels := float64(width) * float64(height); pixels > limit {
+			factor := math.Sqrt(limit / pixels)
+			opts.Width = max(1, int(float64(width)*factor))
+			opts.Height = max(1, int(float64(height)*factor))
+		}
+	}
+	return opts
+}
+
+// outputSize returns the size Resize produces for opts
+func outputSize(opts ResizeOptions, origWidth, origHeight int) (int, int) {
+	if opts.Mode == ModeAspectFit || opts.Width == 0 || opts.Height == 0 {
+		return fitSize(opts, origWidth, origHeight)
+	}
+	if opts.WithoutEnlargement && opts.Mode != ModePad {
+		return min(opts.Width, origWidth), min(opts.Height, origHeight)
+	}
+	return opts.Width, opts.Height
+}
+
 func validateDimensions(width, height, _, _ int) error {
 	// Check maximum dimensions
-	if width > constants.MaxImageWidth || height > constants.MaxImageHeight {
+	if width > maxWidth || height > maxHeight {
 		return errors.New(
 			errors.ErrInvalidSize,
-			fmt.Sprintf("dimensions exceed maximum allowed size (%dx%d)", constants.MaxImageWidth, constants.MaxImageHeight),
+			fmt.Sprintf("dimensions exceed maximum allowed size (%dx%d)", maxWidth, maxHeight),
 			nil,
 		)
 	}
@@ -104,6 +250,16 @@ func validateDimensions(width, height, _, _ int) error {
 }
 
 func aspectFit(img image.Image, opts ResizeOptions, origWidth, origHeight int) (image.Image, error) {
+	width, height := fitSize(opts, origWidth, origHeight)
+	if width == origWidth && height == origHeight {
+		return img, nil
+	}
+	return imaging.Resize(img, width, height, opts.Filter), nil
+}
+
+// fitSize returns the largest size with the original aspect ratio that fits
+// the requested dimensions
+func fitSize(opts ResizeOptions, origWidth, origHeight int) (int, int) {
 	if opts.Width == 0 {
 		// Calculate width to maintain aspect ratio
 		opts.Width = int(float64(origWidth) * float64(opts.Height) / float64(origHeight))
@@ -114,7 +270,7 @@ func aspectFit(img image.Image, opts ResizeOptions, origWidth, origHeight int) (
 		// Both dimensions specified, maintain aspect ratio within bounds
 		widthRatio := float64(opts.Width) / float64(origWidth)
 		heightRatio := float64(opts.Height) / float64(origHeight)
-		
+
 		if widthRatio < heightRatio {
 			opts.Height = int(float64(origHeight) * widthRatio)
 		} else {
@@ -122,24 +278,88 @@ func aspectFit(img image.Image, opts ResizeOptions, origWidth, origHeight int) (
 		}
 	}
 
-	return imaging.Resize(img, opts.Width, opts.Height, imaging.Lanczos), nil
+	if opts.WithoutEnlargement && (opts.Width > origWidth || opts.Height > origHeight) {
+		return origWidth, origHeight
+	}
+	return max(1, opts.Width), max(1, opts.Height)
 }
 
 func fill(img image.Image, opts ResizeOptions, origWidth, origHeight int) (image.Image, error) {
+	// Covering needs both dimensions
+	if opts.Width == 0 || opts.Height == 0 {
+		return aspectFit(img, opts, origWidth, origHeight)
+	}
+
 	// First resize to cover the target dimensions while maintaining aspect ratio
 	widthRatio := float64(opts.Width) / float64(origWidth)
 	heightRatio := float64(opts.Height) / float64(origHeight)
-	
+
 	ratio := widthRatio
 	if heightRatio > widthRatio {
 		ratio = heightRatio
 	}
-	
-	resizedWidth := int(float64(origWidth) * ratio)
-	resizedHeight := int(float64(origHeight) * ratio)
-	
-	resized := imaging.Resize(img, resizedWidth, resizedHeight, imaging.Lanczos)
-	
-	// Then crop to exact dimensions
-	return imaging.CropCenter(resized, opts.Width, opts.Height), nil
+	if opts.WithoutEnlargement && ratio > 1 {
+		ratio = 1
+	}
+
+	resizedWidth := max(1, int(float64(origWidth)*ratio))
+	resizedHeight := max(1, int(float64(origHeight)*ratio))
+
+	resized := img
+	if resizedWidth != origWidth || resizedHeight != origHeight {
+		resized = imaging.Resize(img, resizedWidth, resizedHeight, opts.Filter)
+	}
+
+	// Then crop to exact dimensions, or as close as a small source allows
+	return imaging.CropAnchor(resized, min(opts.Width, resizedWidth), min(opts.Height, resizedHeight), opts.Anchor), nil
+}
+
+func stretch(img image.Image, opts ResizeOptions, origWidth, origHeight int) (image.Image, error) {
+	if opts.WithoutEnlargement {
+		opts.Width = min(opts.Width, origWidth)
+		opts.Height = min(opts.Height, origHeight)
+	}
+	return imaging.Resize(img, opts.Width, opts.Height, opts.Filter), nil
+}
+
+func pad(img image.Image, opts ResizeOptions, origWidth, origHeight int) (image.Image, error) {
+	// Without both dimensions there is nothing to pad to
+	if opts.Width == 0 || opts.Height == 0 {
+		return aspectFit(img, opts, origWidth, origHeight)
+	}
+
+	fitted, err := aspectFit(img, opts, origWidth, origHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	canvas := imaging.New(opts.Width, opts.Height, opts.Background)
+	return imaging.Overlay(canvas, fitted, anchorPoint(opts.Anchor, canvas.Bounds().Size(), fitted.Bounds().Size()), 1), nil
+}
+
+// anchorPoint returns where an image of size inner goes on a canvas of size
+// outer for the given anchor
+func anchorPoint(anchor imaging.Anchor, outer, inner image.Point) image.Point {
+	free := outer.Sub(inner)
+	center := free.Div(2)
+	switch anchor {
+	case imaging.TopLeft:
+		return image.Pt(0, 0)
+	case imaging.Top:
+		return image.Pt(center.X, 0)
+	case imaging.TopRight:
+		return image.Pt(free.X, 0)
+	case imaging.Left:
+		return image.Pt(0, center.Y)
+	case imaging.Right:
+		return image.Pt(free.X, center.Y)
+	case imaging.BottomLeft:
+		return image.Pt(0, free.Y)
+	case imaging.Bottom:
+		return image.Pt(center.X, free.Y)
+	case imaging.BottomRight:
+		return free
+	default:
+		return center
+	}
 }
@@ -0,0 +1,120 @@
+package trim
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+
+	"github.com/disintegration/imaging"
+)
+
+// maxDistance is the distance between transparent black and opaque white
+// in RGBA space
+var maxDistance = math.Sqrt(4 * 255 * 255)
+
+// Options tune trimming
+type Options struct {
+	// Tolerance is the color distance still counted as border, in percent
+	// of the largest possible distance
+	Tolerance float64
+	// Padding is added back around the trimmed image in the border color
+	Padding int
+}
+
+// DefaultOptions returns the options used when a request sets none
+func DefaultOptions() Options {
+	return Options{Tolerance: 10}
+}
+
+// Trim crops the uniform or transparent border around img. The border color
+// is taken from the top-left pixel. Images that are all border are returned
+// unchanged. It also returns the area of img the result shows, padding
+// included, so other images of the same size can be cropped alike.
+func Trim(img image.Image, opts Options) (image.Image, image.Rectangle) {
+	src := imaging.Clone(img)
+	bounds := src.Bounds()
+	if bounds.Empty() {
+		return img, img.Bounds()
+	}
+
+	border := src.NRGBAAt(0, 0)
+	threshold := opts.Tolerance / 100 * maxDistance
+	content := contentBounds(src, border, threshold)
+	if content.Empty() {
+		return img, img.Bounds()
+	}
+
+	trimmed := imaging.Crop(src, content)
+	area := content.Add(img.Bounds().Min)
+	if opts.Padding <= 0 {
+		return trimmed, area
+	}
+
+	if border.A == 0 {
+		border = color.NRGBA{}
+	}
+	padded := imaging.New(content.Dx()+2*opts.Padding, content.Dy()+2*opts.Padding, border)
+	draw.Draw(padded, trimmed.Bounds().Add(image.Pt(opts.Padding, opts.Padding)), trimmed, image.Point{}, draw.Src)
+	return padded, area.Inset(-opts.Padding)
+}
+
+// contentBounds returns the smallest rectangle holding every pixel that
+// differs from the border color
+func contentBounds(img *image.NRGBA, border color.NRGBA, threshold float64) image.Rectangle {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	isBorder := func(x, y int) bool {
+		return matches(img.Pix[y*img.Stride+x*4:], border, threshold)
+	}
+	rowIsBorder := func(y int) bool {
+		for x := 0; x < w; x++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+	columnIsBorder := func(x, top, bottom int) bool {
+		for y := top; y < bottom; y++ {
+			if !isBorder(x, y) {
+				return false
+			}
+		}
+		return true
+	}
+
+	top := 0
+	for top < h && rowIsBorder(top) {
+		top++
+	}
+	if top == h {
+		return image.Rectangle{}
+	}
+	bottom := h
+	for bottom > top && rowIsBorder(bottom-1) {
+		bottom--
+	}
+	left := 0
+	for left < w && columnIsBorder(left, top, bottom) {
+		left++
+	}
+	right := w
+	for right > left && columnIsBorder(right-1, top, bottom) {
+		right--
+	}
+	return image.Rect(left, top, right, bottom)
+}
+
+// matches reports whether px is within threshold of the border color. Every
+// fully transparent pixel looks the same whatever its color channels hold.
+func matches(px []uint8, border color.NRGBA, threshold float64) bool {
+	if border.A == 0 {
+		return float64(px[3]) <= threshold/maxDistance*255
+	}
+	var sum float64
+	for i, c := range []uint8{border.R, border.G, border.B, border.A} {
+		d := float64(px[i]) - float64(c)
+		sum += d * d
+	}
+	return math.Sqrt(sum) <= threshold
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Source is an original image fetched from an origin
+type Source struct {
+	Name    string
+	Data    []byte
+	ModTime time.Time
+}
+
+// Origin fetches source images by their path relative to the origin root
+type Origin interface {
+	Fetch(ctx context.Context, name string) (*Source, error)
+}
+
+// OriginOptions tune how sources are fetched
+type OriginOptions struct {
+	// Timeout bounds a request to an HTTP origin
+	Timeout time.Duration
+	// MaxSize bounds the size of a source image in bytes
+	MaxSize int64
+}
+
+// DefaultOriginOptions returns the options used unless configured otherwise
+func DefaultOriginOptions() OriginOptions {
+	return OriginOptions{
+		Timeout: 10 * time.Second,
+		MaxSize: constants.MaxFileSize,
+	}
+}
+
+// NewOrigin returns an HTTP origin for http(s) base URLs and a local
+// directory origin for anything else
+func NewOrigin(spec string, opts OriginOptions) (Origin, error) {
+	if strings.HasPrefix(spec, "http://") || strings.HasPrefix(spec, "https://") {
+		base, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid origin URL: %w", err)
+		}
+		return &HTTPOrigin{
+			BaseURL: base,
+			Client:  &http.Client{Timeout: opts.Timeout},
+			MaxSize: opts.MaxSize,
+		}, nil
+	}
+
+	info, err := os.Stat(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid origin directory: %w", err)
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("origin %s is not a directory", spec)
+	}
+	return &LocalOrigin{Root: spec, MaxSize: opts.MaxSize}, nil
+}
+
+// LocalOrigin serves source images from a directory on disk
+type LocalOrigin struct {
+	Root    string
+	MaxSize int64
+}
+
+func (o *LocalOrigin) Fetch(_ context.Context, name string) (*Source, error) {
+	// Cleaning against "/" keeps the path inside the root
+	rel := filepath.FromSlash(path.Clean("/" + name))
+	f, err := os.Open(filepath.Join(o.Root, rel))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New(errors.ErrSourceNotFound, "Source image not found", err)
+		}
+		return nil, errors.New(errors.ErrSourceUnavailable, "Failed to open source image", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, errors.New(errors.ErrSourceUnavailable, "Failed to read source image", err)
+	}
+	if info.IsDir() {
+		return nil, errors.New(errors.ErrSourceNotFound, "Source image not found", nil)
+	}
+
+	data, err := readLimited(f, o.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Source{Name: name, Data: data, ModTime: info.ModTime()}, nil
+}
+
+// HTTPOrigin fetches source images relative to a base URL
+type HTTPOrigin struct {
+	BaseURL *url.URL
+	Client  *http.Client
+	MaxSize int64
+}
+
+func (o *HTTPOrigin) Fetch(ctx context.Context, name string) (*Source, error) {
+	target := o.BaseURL.JoinPath(path.Clean("/" + name))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, errors.New(errors.ErrSourceUnavailable, "Failed to build origin request", err)
+	}
+
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return nil, errors.New(errors.ErrSourceUnavailable, "Failed to fetch source image", err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, errors.New(errors.ErrSourceNotFound, "Source image not found", nil)
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.New(errors.ErrSourceUnavailable,
+			fmt.Sprintf("Origin responded with status %d", resp.StatusCode), nil)
+	}
+
+	data, err := readLimited(resp.Body, o.MaxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	src := &Source{Name: name, Data: data}
+	if modTime, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		src.ModTime = modTime
+	}
+	return src, nil
+}
+
+func readLimited(r io.Reader, maxSize int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return nil, errors.New(errors.ErrSourceUnavailable, "Failed to read source image", err)
+	}
+	if int64(len(data)) > maxSize {
+		return nil, errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("Source image exceeds maximum allowed size (%dMB)", maxSize>>20), nil)
+	}
+	return data, nil
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Signer signs and verifies transformation paths with HMAC-SHA256
+type Signer struct {
+	key []byte
+}
+
+func NewSigner(key string) *Signer {
+	return &Signer{key: []byte(key)}
+}
+
+// Sign returns the URL-safe signature for a path such as
+// "/w_400,h_300,f_webp/photos/cat.jpg"
+func (s *Signer) Sign(path string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify reports whether signature is valid for path
+func (s *Signer) Verify(signature, path string) bool {
+	expected, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(path))
+	return hmac.Equal(expected, mac.Sum(nil))
+}
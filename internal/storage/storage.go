@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long results are kept unless configured otherwise
+const DefaultTTL = time.Hour
+
+// sweepInterval is how often expired results are removed
+const sweepInterval = time.Minute
+
+// ErrNotFound is returned for unknown and expired results
+var ErrNotFound = fmt.Errorf("result not found")
+
+// Result describes a stored result
+type Result struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Created     time.Time `json:"created"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Store keeps processing results on disk for a limited time, so API clients
+// can download them by ID instead of receiving them inline. Each result is a
+// data file and a JSON metadata file.
+type Store struct {
+	dir string
+	ttl time.Duration
+
+	stop      chan struct{}
+	stopped   sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New returns a store in dir that keeps results for ttl and removes them
+// once they expire until Close. An empty dir uses a directory below the
+// system temp directory.
+func New(dir string, ttl time.Duration) (*Store, error) {
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "reubah-results")
+	}
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("creating result directory: %w", err)
+	}
+	s := &Store{dir: dir, ttl: ttl, stop: make(chan struct{})}
+	s.stopped.Add(1)
+	go s.sweepLoop()
+	return s, nil
+}
+
+// Close stops removing expired results. Stored results stay on disk for a
+// later store in the same directory.
+func (s *Store) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+	s.stopped.Wait()
+}
+
+// TTL returns how long results are kept
+func (s *Store) TTL() time.Duration {
+	return s.ttl
+}
+
+// Put stores the contents of r under a new random ID
+func (s *Store) Put(filename, contentType string, r io.Reader) (*Result, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.Create(s.dataPath(id))
+	if err != nil {
+		return nil, fmt.Errorf("storing result: %w", err)
+	}
+	size, err := io.Copy(data, r)
+	if closeErr := data.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(s.dataPath(id))
+		return nil, fmt.Errorf("storing result: %w", err)
+	}
+
+	now := time.Now()
+	result := &Result{
+		ID:          id,
+		Filename:    filename,
+		ContentType: contentType,
+		Size:        size,
+		Created:     now,
+		Expires:     now.Add(s.ttl),
+	}
+	meta, err := json.Marshal(result)
+	if err == nil {
+		err = os.WriteFile(s.metaPath(id), meta, 0o600)
+	}
+	if err != nil {
+		os.Remove(s.dataPath(id))
+		return nil, fmt.Errorf("storing result: %w", err)
+	}
+	return result, nil
+}
+
+// Open returns a stored result and its data, ErrNotFound when it doesn't
+// exist or has expired
+func (s *Store) Open(id string) (*Result, *os.File, error) {
+	if !validID(id) {
+		return nil, nil, ErrNotFound
+	}
+	result, err := s.stat(id)
+	if err != nil {
+		return nil, nil, err
+	}
+	if time.Now().After(result.Expires) {
+		s.remove(id)
+		return nil, nil, ErrNotFound
+	}
+
+	f, err := os.Open(s.dataPath(id))
+	if os.IsNotExist(err) {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, f, nil
+}
+
+func (s *Store) stat(id string) (*Result, error) {
+	meta, err := os.ReadFile(s.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var result Result
+	if err := json.Unmarshal(meta, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// sweepLoop sweeps every sweepInterval until Close, starting with the
+// results left by a previous run
+func (s *Store) sweepLoop() {
+	defer s.stopped.Done()
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		s.sweep()
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// sweep removes expired results, and data files older than the TTL without
+// metadata, which a failed Put or a crash between its two writes leaves
+// behind
+func (s *Store) sweep() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	for _, entry := range entries {
+		if id, ok := strings.CutSuffix(entry.Name(), ".json"); ok {
+			if !validID(id) {
+				continue
+			}
+			result, err := s.stat(id)
+			switch {
+			case err == nil:
+				if now.After(result.Expires) {
+					s.remove(id)
+				}
+			case err != ErrNotFound && s.olderThanTTL(entry, now):
+				// Unreadable metadata may still be being written
+				s.remove(id)
+			}
+			continue
+		}
+
+		// Put writes the data first, so a young data file may still be
+		// waiting for its metadata
+		id := entry.Name()
+		if !validID(id) || !s.olderThanTTL(entry, now) {
+			continue
+		}
+		if _, err := os.Stat(s.metaPath(id)); os.IsNotExist(err) {
+			os.Remove(s.dataPath(id))
+		}
+	}
+}
+
+// olderThanTTL reports whether entry was last written more than the TTL
+// before now
+func (s *Store) olderThanTTL(entry os.DirEntry, now time.Time) bool {
+	info, err := entry.Info()
+	return err == nil && now.Sub(info.ModTime()) > s.ttl
+}
+
+func (s *Store) remove(id string) {
+	os.Remove(s.metaPath(id))
+	os.Remove(s.dataPath(id))
+}
+
+func (s *Store) dataPath(id string) string {
+	return filepath.Join(s.dir, id)
+}
+
+func (s *Store) metaPath(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// idLength is the length of an ID in hex characters
+const idLength = 32
+
+func newID() (string, error) {
+	b := make([]byte, idLength/2)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating result ID: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id could have been generated by newID, which also
+// keeps it from naming paths outside the store
+func validID(id string) bool {
+	if len(id) != idLength {
+		return false
+	}
+	for _, c := range id {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return false
+		}
+	}
+	return true
+}
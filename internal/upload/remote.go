@@ -0,0 +1,88 @@
+package upload
+
+import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/netguard"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// DefaultFetchTimeout bounds the download of a remote source
+const DefaultFetchTimeout = 15 * time.Second
+
+// maxRedirects bounds the redirects followed for a remote source
+const maxRedirects = 5
+
+// Fetcher downloads sources given by URL into a form, within its limits
+type Fetcher struct {
+	client *http.Client
+}
+
+// NewFetcher returns a fetcher whose downloads take at most timeout. Unless
+// allowPrivate is set it refuses to connect to addresses that aren't
+// publicly routable, see netguard.Transport.
+func NewFetcher(timeout time.Duration, allowPrivate bool) *Fetcher {
+	return &Fetcher{client: &http.Client{
+		Timeout:   timeout,
+		Transport: netguard.Transport(timeout, allowPrivate),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if !isHTTP(req.URL) {
+				return fmt.Errorf("redirect to unsupported scheme %s", req.URL.Scheme)
+			}
+			return nil
+		},
+	}}
+}
+
+// Fetch downloads rawURL and adds it to form as a file uploaded as field.
+// filename defaults to the last element of the URL path.
+func (f *Fetcher) Fetch(ctx context.Context, form *Form, field, rawURL, filename string) error {
+	source, err := url.Parse(rawURL)
+	if err != nil || !isHTTP(source) || source.Host == "" {
+		return errors.New(errors.ErrInvalidFormat, "Source URL must be an absolute http or https URL", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, source.String(), nil)
+	if err != nil {
+		return errors.New(errors.ErrInvalidFormat, "Invalid source URL", err)
+	}
+	resp, err := f.client.Do(req)
+	if stderrors.Is(err, netguard.ErrPrivateAddress) {
+		return errors.New(errors.ErrInvalidFormat, "Source URL must not point to a private address", err)
+	}
+	if err != nil {
+		return errors.New(errors.ErrSourceUnavailable, "Failed to fetch "+source.Redacted(), err)
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errors.New(errors.ErrSourceNotFound, "Source not found: "+source.Redacted(), nil)
+	case resp.StatusCode != http.StatusOK:
+		return errors.New(errors.ErrSourceUnavailable,
+			fmt.Sprintf("Fetching %s failed with status %d", source.Redacted(), resp.StatusCode), nil)
+	}
+
+	if filename == "" {
+		filename = path.Base(resp.Request.URL.Path)
+	}
+	header := textproto.MIMEHeader{}
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return form.Add(field, filename, header, resp.Body)
+}
+
+func isHTTP(u *url.URL) bool {
+	return u.Scheme == "http" || u.Scheme == "https"
+}
@@ -0,0 +1,246 @@
+package upload
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Defaults for the limits not tied to a single file
+const (
+	DefaultMaxTotalSize = 256 << 20
+	DefaultMaxFiles     = 100
+	DefaultMaxValueSize = 1 << 20
+)
+
+// multipartOverhead is allowed on top of the file and field limits for part
+// headers and boundaries
+const multipartOverhead = 1 << 20
+
+// Limits bound what a single request may upload
+type Limits struct {
+	// MaxFileSize bounds each file, MaxTotalSize all files together
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+	// MaxValueSize bounds all non-file fields together
+	MaxValueSize int64
+	// Dir is where files are spooled, empty for the system temp directory
+	Dir string
+}
+
+// DefaultLimits returns the limits used unless configured otherwise
+func DefaultLimits() Limits {
+	return Limits{
+		MaxFileSize:  constants.MaxFileSize,
+		MaxTotalSize: DefaultMaxTotalSize,
+		MaxFiles:     DefaultMaxFiles,
+		MaxValueSize: DefaultMaxValueSize,
+	}
+}
+
+// File is an uploaded file spooled to disk
+type File struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	path     string
+	// extracted files don't count against the limits of the form
+	extracted bool
+}
+
+// Open opens the spooled file for reading
+func (f *File) Open() (*os.File, error) {
+	return os.Open(f.path)
+}
+
+// Form holds the fields and files of an upload
+type Form struct {
+	Value url.Values
+	File  map[string][]*File
+	dir   string
+
+	limits Limits
+	// files and total count what was spooled against the limits
+	files int
+	total int64
+}
+
+// NewForm returns an empty form whose files are spooled within limits. Parse
+// fills one from a multipart request, Add from other sources.
+func NewForm(limits Limits) (*Form, error) {
+	dir, err := os.MkdirTemp(limits.Dir, "reubah-upload-")
+	if err != nil {
+		return nil, errors.New(errors.ErrProcessingFailed, "Unable to store upload", err)
+	}
+	return &Form{Value: url.Values{}, File: map[string][]*File{}, dir: dir, limits: limits}, nil
+}
+
+// RemoveAll deletes the spooled files
+func (f *Form) RemoveAll() error {
+	return os.RemoveAll(f.dir)
+}
+
+// Parse reads the multipart body of r part by part, copying files to disk as
+// they arrive, so memory use doesn't grow with the size or number of files.
+// The fields are also merged into r.Form and r.PostForm, keeping
+// r.FormValue working. Exceeding a limit fails with ErrInvalidSize.
+func Parse(w http.ResponseWriter, r *http.Request, limits Limits) (*Form, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, limits.MaxTotalSize+limits.MaxValueSize+multipartOverhead)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.New(errors.ErrInvalidFormat, "Unable to parse form", err)
+	}
+
+	form, err := NewForm(limits)
+	if err != nil {
+		return nil, err
+	}
+	if err := form.read(reader); err != nil {
+		form.RemoveAll()
+		return nil, err
+	}
+
+	if err := r.ParseForm(); err != nil {
+		form.RemoveAll()
+		return nil, errors.New(errors.ErrInvalidFormat, "Unable to parse form", err)
+	}
+	// Body fields come first, as with http.Request.ParseMultipartForm
+	r.PostForm = form.Value
+	for name, values := range form.Value {
+		r.Form[name] = append(values, r.Form[name]...)
+	}
+	return form, nil
+}
+
+func (f *Form) read(reader *multipart.Reader) error {
+	var values int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return readError(err)
+		}
+
+		name := part.FormName()
+		if name == "" {
+			part.Close()
+			continue
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, f.limits.MaxValueSize-values+1))
+			part.Close()
+			if err != nil {
+				return readError(err)
+			}
+			values += int64(len(value))
+			if values > f.limits.MaxValueSize {
+				return errors.New(errors.ErrInvalidSize, "Form fields exceed the maximum allowed size", nil)
+			}
+			f.Value.Add(name, string(value))
+			continue
+		}
+
+		err = f.Add(name, part.FileName(), part.Header, part)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Add spools the contents of r as a file uploaded as field, stopping at
+// whichever of the file, total and count limits is hit first
+func (f *Form) Add(field, filename string, header textproto.MIMEHeader, r io.Reader) error {
+	return f.add(field, filename, header, r, false)
+}
+
+// AddExtracted spools a file extracted from an upload, such as an archive
+// entry, as field. Only the file size limit applies: the caller bounds what
+// it extracts, so the count and total limits are left to the uploads.
+func (f *Form) AddExtracted(field, filename string, header textproto.MIMEHeader, r io.Reader) error {
+	return f.add(field, filename, header, r, true)
+}
+
+func (f *Form) add(field, filename string, header textproto.MIMEHeader, r io.Reader, extracted bool) error {
+	if !extracted && f.files >= f.limits.MaxFiles {
+		return errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("Too many files, at most %d are allowed", f.limits.MaxFiles), nil)
+	}
+
+	tmp, err := os.CreateTemp(f.dir, "part-")
+	if err != nil {
+		return errors.New(errors.ErrProcessingFailed, "Unable to store upload", err)
+	}
+	defer tmp.Close()
+
+	limit := f.limits.MaxFileSize
+	if !extracted {
+		limit = min(limit, f.limits.MaxTotalSize-f.total)
+	}
+	size, err := io.Copy(tmp, io.LimitReader(r, limit+1))
+	if err != nil {
+		return readError(err)
+	}
+	switch {
+	case !extracted && f.total+size > f.limits.MaxTotalSize:
+		return errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("Upload exceeds maximum allowed total size (%dMB)", f.limits.MaxTotalSize>>20), nil)
+	case size > f.limits.MaxFileSize:
+		return errors.New(errors.ErrInvalidSize,
+			fmt.Sprintf("File %s exceeds maximum allowed size (%dMB)", filename, f.limits.MaxFileSize>>20), nil)
+	}
+
+	if !extracted {
+		f.files++
+		f.total += size
+	}
+	f.File[field] = append(f.File[field], &File{
+		Filename:  filename,
+		Header:    header,
+		Size:      size,
+		path:      tmp.Name(),
+		extracted: extracted,
+	})
+	return nil
+}
+
+// Remove deletes file, uploaded as field, from the form and gives back what
+// it counted against the limits
+func (f *Form) Remove(field string, file *File) error {
+	files := f.File[field]
+	for i, candidate := range files {
+		if candidate != file {
+			continue
+		}
+		f.File[field] = append(files[:i:i], files[i+1:]...)
+		if !file.extracted {
+			f.files--
+			f.total -= file.Size
+		}
+		return os.Remove(file.path)
+	}
+	return nil
+}
+
+// readError reports a failed read, which is a size error when the request
+// outgrew the body limit. Readers that fail with an AppError, such as
+// archive entries over their limits, keep it.
+func readError(err error) error {
+	var tooLarge *http.MaxBytesError
+	if stderrors.As(err, &tooLarge) {
+		return errors.New(errors.ErrInvalidSize, "Request body too large", err)
+	}
+	return errors.Wrap(errors.ErrInvalidFormat, "Unable to parse form", err)
+}
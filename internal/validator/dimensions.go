@@ -0,0 +1,194 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+
+	"github.com/dendianugerah/reubah/internal/constants"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// DefaultMaxPixels is the decode budget used unless SetMaxPixels is called,
+// the area of the largest output image
+const DefaultMaxPixels = constants.MaxImageWidth * constants.MaxImageHeight
+
+// bytesPerPixel is what a decoded 8-bit image takes per pixel. The budget is
+// counted in these, so 16-bit images may only have half as many pixels.
+const bytesPerPixel = 4
+
+// maxPixels bounds the area of images that are decoded
+var maxPixels int64 = DefaultMaxPixels
+
+// SetMaxPixels sets the decode budget in pixels
+func SetMaxPixels(n int64) {
+	maxPixels = n
+}
+
+// ValidateImageData reads the dimensions declared in the header of encoded
+// image data and rejects the image before any pixels are decoded when it
+// would not fit the decode budget. A few kilobytes of compressed data can
+// declare billions of pixels.
+func ValidateImageData(data []byte) error {
+	width, height, depth, err := readDimensions(data)
+	if err != nil {
+		return errors.New(errors.ErrInvalidFormat, "Unable to read image dimensions", err)
+	}
+	return validatePixels(width, height, depth)
+}
+
+func validatePixels(width, height, depth int) error {
+	if width <= 0 || height <= 0 {
+		return errors.New(errors.ErrInvalidSize, fmt.Sprintf("Invalid image dimensions %dx%d", width, height), nil)
+	}
+	if int64(width)*int64(height)*int64(depth) > maxPixels*bytesPerPixel {
+		return errors.New(
+			errors.ErrInvalidSize,
+			fmt.Sprintf("Image dimensions %dx%d exceed the maximum of %g megapixels", width, height, float64(maxPixels)/1e6),
+			nil,
+		)
+	}
+	return nil
+}
+
+// readDimensions returns the size declared by an image header and the bytes
+// per pixel of its decoded form. HEIF and ICO are parsed here because their
+// registered decoders can't read a header on its own.
+func readDimensions(data []byte) (width, height, depth int, err error) {
+	switch {
+	case len(data) >= 12 && string(data[4:8]) == "ftyp":
+		width, height, err = heifDimensions(data)
+		return width, height, bytesPerPixel, err
+	case isIcoSignature(data):
+		width, height, err = icoDimensions(data)
+		return width, height, bytesPerPixel, err
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	depth = bytesPerPixel
+	if config.ColorModel == color.RGBA64Model || config.ColorModel == color.NRGBA64Model {
+		depth *= 2
+	}
+	return config.Width, config.Height, depth, nil
+}
+
+// heifDimensions returns the largest image spatial extent ("ispe") property
+// of a HEIF file, found in meta/iprp/ipco. Grid images carry the size of the
+// whole image next to the sizes of their tiles.
+func heifDimensions(data []byte) (int, int, error) {
+	meta := findBox(data, "meta")
+	// meta is a full box, its children follow the version and flags
+	if len(meta) < 4 {
+		return 0, 0, fmt.Errorf("HEIF file has no meta box")
+	}
+	properties := findBox(findBox(meta[4:], "iprp"), "ipco")
+
+	var width, height int
+	eachBox(properties, func(typ string, payload []byte) bool {
+		if typ == "ispe" && len(payload) >= 12 {
+			w := int(binary.BigEndian.Uint32(payload[4:]))
+			h := int(binary.BigEndian.Uint32(payload[8:]))
+			if int64(w)*int64(h) > int64(width)*int64(height) {
+				width, height = w, h
+			}
+		}
+		return true
+	})
+	if width == 0 || height == 0 {
+		return 0, 0, fmt.Errorf("HEIF file has no image size")
+	}
+	return width, height, nil
+}
+
+// findBox returns the payload of the first ISO BMFF box of type typ in data
+func findBox(data []byte, typ string) []byte {
+	var found []byte
+	eachBox(data, func(t string, payload []byte) bool {
+		if t == typ {
+			found = payload
+			return false
+		}
+		return true
+	})
+	return found
+}
+
+// eachBox calls fn with the type and payload of every ISO BMFF box in data
+// until fn returns false, stopping at the first malformed box
+func eachBox(data []byte, fn func(typ string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size := uint64(binary.BigEndian.Uint32(data))
+		typ := string(data[4:8])
+		header := uint64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of the data
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)) {
+			return
+		}
+		if !fn(typ, data[header:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
+
+// icoDimensions returns the size of the largest icon in an ICO file. Icons
+// stored as PNG declare their real size in the PNG header, the directory
+// only holds a byte per dimension.
+func icoDimensions(data []byte) (int, int, error) {
+	if len(data) < 6 {
+		return 0, 0, fmt.Errorf("ICO file too small")
+	}
+	count := int(binary.LittleEndian.Uint16(data[4:]))
+	if count == 0 {
+		return 0, 0, fmt.Errorf("no images in ICO file")
+	}
+
+	var width, height int
+	for i := 0; i < count; i++ {
+		entry := 6 + i*16
+		if entry+16 > len(data) {
+			return 0, 0, fmt.Errorf("invalid ICO directory")
+		}
+		w, h := int(data[entry]), int(data[entry+1])
+		if w == 0 {
+			w = 256
+		}
+		if h == 0 {
+			h = 256
+		}
+
+		size := int64(binary.LittleEndian.Uint32(data[entry+8:]))
+		offset := int64(binary.LittleEndian.Uint32(data[entry+12:]))
+		if offset+size <= int64(len(data)) {
+			icon := data[offset : offset+size]
+			if bytes.HasPrefix(icon, []byte("\x89PNG\r\n\x1a\n")) {
+				config, err := png.DecodeConfig(bytes.NewReader(icon))
+				if err != nil {
+					return 0, 0, err
+				}
+				w, h = config.Width, config.Height
+			}
+		}
+
+		if int64(w)*int64(h) > int64(width)*int64(height) {
+			width, height = w, h
+		}
+	}
+	return width, height, nil
+}
@@ -34,6 +34,15 @@ func ValidateMIMEType(file multipart.File) error {
 		return errors.New(errors.ErrInvalidMIME, "Failed to reset file pointer", err)
 	}
 
+	return ValidateMIMEBytes(buffer)
+}
+
+// ValidateMIMEBytes checks the content type of data that is already in memory
+func ValidateMIMEBytes(buffer []byte) error {
+	if len(buffer) > 512 {
+		buffer = buffer[:512]
+	}
+
 	mimeType := http.DetectContentType(buffer)
 
 	// Special handling for HEIC/HEIF and ICO files since they might not be correctly detected
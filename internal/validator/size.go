@@ -15,14 +15,3 @@ func ValidateFileSize(size int64) error {
 	}
 	return nil
 }
-
-func ValidateImageDimensions(width, height int) error {
-	if width > constants.MaxImageWidth || height > constants.MaxImageHeight {
-		return errors.New(
-			errors.ErrInvalidSize,
-			"Image dimensions exceed maximum allowed size (8192x8192)",
-			nil,
-		)
-	}
-	return nil
-} 
\ No newline at end of file
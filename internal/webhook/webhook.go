@@ -0,0 +1,352 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dendianugerah/reubah/internal/netguard"
+	"github.com/dendianugerah/reubah/pkg/errors"
+)
+
+// Headers sent with every delivery
+const (
+	EventHeader     = "X-Reubah-Event"
+	DeliveryHeader  = "X-Reubah-Delivery"
+	TimestampHeader = "X-Reubah-Timestamp"
+	// SignatureHeader holds "sha256=" and the hex HMAC-SHA256 of the
+	// timestamp, a dot and the body, keyed with the shared secret
+	SignatureHeader = "X-Reubah-Signature"
+)
+
+// DeliveryStatus is the state of a delivery
+type DeliveryStatus string
+
+const (
+	StatusPending   DeliveryStatus = "pending"
+	StatusDelivered DeliveryStatus = "delivered"
+	StatusFailed    DeliveryStatus = "failed"
+)
+
+// Attempt is one try at delivering a callback
+type Attempt struct {
+	Time time.Time `json:"time"`
+	// StatusCode is the answer of the receiver, Error why there was none
+	// or why it was refused
+	StatusCode int    `json:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Delivery is the log of a callback and its attempts
+type Delivery struct {
+	ID       string         `json:"id"`
+	URL      string         `json:"url"`
+	Event    string         `json:"event"`
+	Status   DeliveryStatus `json:"status" enum:"pending,delivered,failed"`
+	Attempts []Attempt      `json:"attempts"`
+	// NextAttempt is set while a failed attempt waits to be retried
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	finished    time.Time
+}
+
+// Options configure a dispatcher
+type Options struct {
+	// Secret keys the signature of the payloads
+	Secret string
+	// Attempts bounds the tries of a delivery. The first retry waits
+	// Backoff, every further one twice as long as the one before.
+	Attempts int
+	Backoff  time.Duration
+	// Timeout bounds every attempt
+	Timeout time.Duration
+	// AllowPrivate allows callbacks to loopback, private and link-local
+	// addresses
+	AllowPrivate bool
+	// LogTTL is how long the log of a finished delivery is kept
+	LogTTL time.Duration
+}
+
+// DefaultOptions returns the options used unless configured otherwise,
+// without a secret
+func DefaultOptions() Options {
+	return Options{
+		Attempts: 5,
+		Backoff:  2 * time.Second,
+		Timeout:  10 * time.Second,
+		LogTTL:   time.Hour,
+	}
+}
+
+// Dispatcher posts signed JSON payloads to callback URLs in the background,
+// retrying failed deliveries, and keeps a log of them
+type Dispatcher struct {
+	client   *http.Client
+	secret   []byte
+	attempts int
+	backoff  time.Duration
+	ttl      time.Duration
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu         sync.Mutex
+	deliveries map[string][]*Delivery
+	closed     bool
+}
+
+// New returns a dispatcher sending with opts
+func New(opts Options) *Dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Dispatcher{
+		client: &http.Client{
+			Timeout:   opts.Timeout,
+			Transport: netguard.Transport(opts.Timeout, opts.AllowPrivate),
+			// A redirect would repeat the payload somewhere the client
+			// didn't ask for
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		secret:     []byte(opts.Secret),
+		attempts:   max(opts.Attempts, 1),
+		backoff:    opts.Backoff,
+		ttl:        opts.LogTTL,
+		ctx:        ctx,
+		cancel:     cancel,
+		deliveries: map[string][]*Delivery{},
+	}
+}
+
+// ValidateURL checks that rawURL can be used as a callback URL
+func ValidateURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New(errors.ErrInvalidFormat, "Callback URL must be an absolute http or https URL", err)
+	}
+	return nil
+}
+
+// Send posts payload as event to callbackURL in the background. The
+// delivery is logged under key.
+func (d *Dispatcher) Send(key, callbackURL, event string, payload interface{}) {
+	id, err := newID()
+	if err != nil {
+		log.Printf("Webhook %s for %s not sent: %v", event, key, err)
+		return
+	}
+	delivery := &Delivery{ID: id, URL: callbackURL, Event: event, Status: StatusPending, Attempts: []Attempt{}}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		d.record(key, delivery)
+		d.fail(delivery, Attempt{Time: time.Now(), Error: "encoding payload: " + err.Error()})
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sweep()
+	d.deliveries[key] = append(d.deliveries[key], delivery)
+	if d.closed {
+		delivery.Status = StatusFailed
+		delivery.finished = time.Now()
+		delivery.Attempts = append(delivery.Attempts, Attempt{Time: delivery.finished, Error: "server shutting down"})
+		return
+	}
+	d.wg.Add(1)
+	go d.deliver(delivery, body)
+}
+
+// Deliveries returns the log of the deliveries sent under key
+func (d *Dispatcher) Deliveries(key string) []Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	deliveries := make([]Delivery, 0, len(d.deliveries[key]))
+	for _, delivery := range d.deliveries[key] {
+		copied := *delivery
+		copied.Attempts = append([]Attempt(nil), delivery.Attempts...)
+		deliveries = append(deliveries, copied)
+	}
+	return deliveries
+}
+
+// Shutdown stops accepting deliveries and waits for the pending ones. When
+// ctx ends first, their retries are abandoned.
+func (d *Dispatcher) Shutdown(ctx context.Context) error {
+	d.mu.Lock()
+	d.closed = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (d *Dispatcher) deliver(delivery *Delivery, body []byte) {
+	defer d.wg.Done()
+	wait := d.backoff
+	for attempt := 1; ; attempt++ {
+		result, retry := d.post(delivery, body)
+		if result.Error == "" {
+			d.mu.Lock()
+			delivery.Status = StatusDelivered
+			delivery.finished = time.Now()
+			delivery.NextAttempt = nil
+			delivery.Attempts = append(delivery.Attempts, result)
+			d.mu.Unlock()
+			return
+		}
+		if !retry || attempt >= d.attempts {
+			d.fail(delivery, result)
+			return
+		}
+
+		next := time.Now().Add(wait)
+		d.mu.Lock()
+		delivery.Attempts = append(delivery.Attempts, result)
+		delivery.NextAttempt = &next
+		d.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.ctx.Done():
+			timer.Stop()
+			d.fail(delivery, Attempt{Time: time.Now(), Error: "retry abandoned at shutdown"})
+			return
+		}
+		wait *= 2
+	}
+}
+
+// post makes one attempt at delivering body, reporting whether a failure is
+// worth retrying
+func (d *Dispatcher) post(delivery *Delivery, body []byte) (Attempt, bool) {
+	result := Attempt{Time: time.Now()}
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		result.Error = err.Error()
+		return result, false
+	}
+	timestamp := strconv.FormatInt(result.Time.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "reubah-webhook")
+	req.Header.Set(EventHeader, delivery.Event)
+	req.Header.Set(DeliveryHeader, delivery.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(d.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		result.Error = err.Error()
+		return result, !stderrors.Is(err, netguard.ErrPrivateAddress)
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	result.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return result, true
+	}
+	result.Error = "unexpected status " + resp.Status
+	// The receiver is overloaded or down, anything else won't change
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode == http.StatusRequestTimeout
+	return result, retry
+}
+
+func (d *Dispatcher) fail(delivery *Delivery, last Attempt) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delivery.Status = StatusFailed
+	delivery.finished = time.Now()
+	delivery.NextAttempt = nil
+	delivery.Attempts = append(delivery.Attempts, last)
+	log.Printf("Webhook %s %s to %s failed after %d attempts: %s",
+		delivery.Event, delivery.ID, delivery.URL, len(delivery.Attempts), last.Error)
+}
+
+func (d *Dispatcher) record(key string, delivery *Delivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deliveries[key] = append(d.deliveries[key], delivery)
+}
+
+// sweep forgets the logs whose deliveries all finished more than the log
+// TTL ago, d.mu must be held
+func (d *Dispatcher) sweep() {
+	now := time.Now()
+	for key, deliveries := range d.deliveries {
+		expired := true
+		for _, delivery := range deliveries {
+			if delivery.finished.IsZero() || now.Sub(delivery.finished) <= d.ttl {
+				expired = false
+				break
+			}
+		}
+		if expired {
+			delete(d.deliveries, key)
+		}
+	}
+}
+
+// Sign returns the signature header of body sent at timestamp
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a delivery received with header and body,
+// refusing deliveries whose timestamp is more than tolerance away from now
+// so a captured delivery can't be replayed later
+func Verify(secret []byte, header http.Header, body []byte, tolerance time.Duration) error {
+	timestamp := header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", TimestampHeader)
+	}
+	if age := time.Since(time.Unix(seconds, 0)); age > tolerance || age < -tolerance {
+		return fmt.Errorf("timestamp is %v away from now", age.Round(time.Second))
+	}
+	expected := Sign(secret, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(header.Get(SignatureHeader))) {
+		return stderrors.New("signature mismatch")
+	}
+	return nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
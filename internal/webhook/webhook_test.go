@@ -0,0 +1,278 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "test-secret"
+
+// receiver is a callback endpoint answering deliveries with statuses in
+// turn, the last one repeating, and recording when each one arrived
+type receiver struct {
+	t        *testing.T
+	statuses []int
+
+	mu       sync.Mutex
+	arrivals []time.Time
+	bodies   [][]byte
+	headers  []http.Header
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	rcv := &receiver{t: t, statuses: statuses}
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+	return rcv, server
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		rcv.t.Errorf("reading delivery: %v", err)
+	}
+	rcv.mu.Lock()
+	n := len(rcv.arrivals)
+	rcv.arrivals = append(rcv.arrivals, time.Now())
+	rcv.bodies = append(rcv.bodies, body)
+	rcv.headers = append(rcv.headers, r.Header.Clone())
+	rcv.mu.Unlock()
+	w.WriteHeader(rcv.statuses[min(n, len(rcv.statuses)-1)])
+}
+
+func (rcv *receiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.arrivals)
+}
+
+func newTestDispatcher(t *testing.T, attempts int, backoff time.Duration) *Dispatcher {
+	d := New(Options{
+		Secret:       testSecret,
+		Attempts:     attempts,
+		Backoff:      backoff,
+		Timeout:      time.Second,
+		AllowPrivate: true,
+		LogTTL:       time.Hour,
+	})
+	t.Cleanup(func() { d.Shutdown(context.Background()) })
+	return d
+}
+
+// waitFinished waits for the only delivery logged under key to finish
+func waitFinished(t *testing.T, d *Dispatcher, key string) Delivery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		deliveries := d.Deliveries(key)
+		if len(deliveries) == 1 && deliveries[0].Status != StatusPending {
+			return deliveries[0]
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("delivery under %s did not finish: %+v", key, d.Deliveries(key))
+	return Delivery{}
+}
+
+func TestSignVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	header := http.Header{}
+	header.Set(TimestampHeader, now)
+	header.Set(SignatureHeader, Sign([]byte(testSecret), now, body))
+
+	if err := Verify([]byte(testSecret), header, body, time.Minute); err != nil {
+		t.Errorf("Verify of a signed delivery: %v", err)
+	}
+	if err := Verify([]byte("other"), header, body, time.Minute); err == nil {
+		t.Error("Verify accepted the wrong secret")
+	}
+	if err := Verify([]byte(testSecret), header, []byte(`{"id":"2"}`), time.Minute); err == nil {
+		t.Error("Verify accepted a changed body")
+	}
+
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	stale := http.Header{}
+	stale.Set(TimestampHeader, old)
+	stale.Set(SignatureHeader, Sign([]byte(testSecret), old, body))
+	if err := Verify([]byte(testSecret), stale, body, time.Minute); err == nil {
+		t.Error("Verify accepted a timestamp outside the tolerance")
+	}
+
+	missing := http.Header{}
+	missing.Set(SignatureHeader, Sign([]byte(testSecret), "", body))
+	if err := Verify([]byte(testSecret), missing, body, time.Minute); err == nil {
+		t.Error("Verify accepted a delivery without timestamp")
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	rcv, server := newReceiver(t, http.StatusNoContent)
+	d := newTestDispatcher(t, 3, time.Millisecond)
+
+	d.Send("job", server.URL, "job.done", map[string]string{"id": "job"})
+	delivery := waitFinished(t, d, "job")
+	if delivery.Status != StatusDelivered || len(delivery.Attempts) != 1 {
+		t.Fatalf("delivery = %+v, want delivered at the first attempt", delivery)
+	}
+
+	rcv.mu.Lock()
+	header, body := rcv.headers[0], rcv.bodies[0]
+	rcv.mu.Unlock()
+	if err := Verify([]byte(testSecret), header, body, time.Minute); err != nil {
+		t.Errorf("receiver can't verify the delivery: %v", err)
+	}
+	if got := header.Get(EventHeader); got != "job.done" {
+		t.Errorf("%s = %q, want job.done", EventHeader, got)
+	}
+	if got := header.Get(DeliveryHeader); got != delivery.ID {
+		t.Errorf("%s = %q, want the delivery ID %q", DeliveryHeader, got, delivery.ID)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal(body, &payload); err != nil || payload["id"] != "job" {
+		t.Errorf("payload = %s, want the JSON sent", body)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int
+		attempts int
+		want     DeliveryStatus
+		tries    int
+	}{
+		{"server error", []int{500, 502, 204}, 5, StatusDelivered, 3},
+		{"unavailable", []int{503}, 3, StatusFailed, 3},
+		{"too many requests", []int{429, 200}, 5, StatusDelivered, 2},
+		{"request timeout", []int{408, 200}, 5, StatusDelivered, 2},
+		{"bad request", []int{400}, 5, StatusFailed, 1},
+		{"unauthorized", []int{401}, 5, StatusFailed, 1},
+		{"not found", []int{404}, 5, StatusFailed, 1},
+		{"redirect", []int{302}, 5, StatusFailed, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rcv, server := newReceiver(t, tt.statuses...)
+			d := newTestDispatcher(t, tt.attempts, time.Millisecond)
+
+			d.Send("job", server.URL, "job.done", struct{}{})
+			delivery := waitFinished(t, d, "job")
+			if delivery.Status != tt.want {
+				t.Errorf("status = %s, want %s", delivery.Status, tt.want)
+			}
+			if rcv.count() != tt.tries || len(delivery.Attempts) != tt.tries {
+				t.Errorf("received %d deliveries and logged %d attempts, want %d",
+					rcv.count(), len(delivery.Attempts), tt.tries)
+			}
+			for i, attempt := range delivery.Attempts {
+				want := tt.statuses[min(i, len(tt.statuses)-1)]
+				if attempt.StatusCode != want {
+					t.Errorf("attempt %d status = %d, want %d", i+1, attempt.StatusCode, want)
+				}
+			}
+			if delivery.NextAttempt != nil {
+				t.Errorf("finished delivery still has a next attempt at %v", delivery.NextAttempt)
+			}
+		})
+	}
+}
+
+func TestBackoffDoubles(t *testing.T) {
+	const backoff = 40 * time.Millisecond
+	rcv, server := newReceiver(t, http.StatusServiceUnavailable)
+	d := newTestDispatcher(t, 4, backoff)
+
+	d.Send("job", server.URL, "job.done", struct{}{})
+	waitFinished(t, d, "job")
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.arrivals) != 4 {
+		t.Fatalf("received %d deliveries, want 4", len(rcv.arrivals))
+	}
+	want := backoff
+	for i := 1; i < len(rcv.arrivals); i++ {
+		gap := rcv.arrivals[i].Sub(rcv.arrivals[i-1])
+		// Timers fire late, never early, and the next wait is longer still
+		if gap < want || gap >= 2*want {
+			t.Errorf("wait before attempt %d = %v, want about %v", i+1, gap, want)
+		}
+		want *= 2
+	}
+}
+
+func TestPendingDeliveryLog(t *testing.T) {
+	_, server := newReceiver(t, http.StatusInternalServerError)
+	d := newTestDispatcher(t, 2, time.Hour)
+
+	d.Send("job", server.URL, "job.failed", struct{}{})
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		deliveries := d.Deliveries("job")
+		if len(deliveries) == 1 && len(deliveries[0].Attempts) == 1 {
+			delivery := deliveries[0]
+			if delivery.Status != StatusPending {
+				t.Errorf("status = %s while waiting to retry, want pending", delivery.Status)
+			}
+			if delivery.NextAttempt == nil || time.Until(*delivery.NextAttempt) < 50*time.Minute {
+				t.Errorf("next attempt = %v, want about an hour from now", delivery.NextAttempt)
+			}
+			if delivery.Event != "job.failed" || delivery.URL != server.URL {
+				t.Errorf("delivery = %+v, want the event and URL sent", delivery)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("first attempt not logged: %+v", deliveries)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := d.Deliveries("other"); len(got) != 0 {
+		t.Errorf("deliveries of another key = %+v, want none", got)
+	}
+
+	// Shutting down abandons the retry
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	d.Shutdown(ctx)
+	delivery := d.Deliveries("job")[0]
+	if delivery.Status != StatusFailed || len(delivery.Attempts) != 2 {
+		t.Errorf("delivery after shutdown = %+v, want failed with the abandoned retry logged", delivery)
+	}
+}
+
+func TestPrivateAddressRefused(t *testing.T) {
+	rcv, server := newReceiver(t, http.StatusNoContent)
+	d := New(Options{Secret: testSecret, Attempts: 3, Backoff: time.Millisecond, Timeout: time.Second})
+	t.Cleanup(func() { d.Shutdown(context.Background()) })
+
+	d.Send("job", server.URL, "job.done", struct{}{})
+	delivery := waitFinished(t, d, "job")
+	if delivery.Status != StatusFailed || len(delivery.Attempts) != 1 {
+		t.Errorf("delivery = %+v, want failed without retries", delivery)
+	}
+	if rcv.count() != 0 {
+		t.Errorf("loopback receiver got %d deliveries, want none", rcv.count())
+	}
+}
+
+func TestValidateURL(t *testing.T) {
+	for _, rawURL := range []string{"https://example.com/hook", "http://example.com:8080/"} {
+		if err := ValidateURL(rawURL); err != nil {
+			t.Errorf("ValidateURL(%q) = %v, want nil", rawURL, err)
+		}
+	}
+	for _, rawURL := range []string{"", "example.com/hook", "ftp://example.com/", "https://", "/relative"} {
+		if err := ValidateURL(rawURL); err == nil {
+			t.Errorf("ValidateURL(%q) accepted an invalid URL", rawURL)
+		}
+	}
+}
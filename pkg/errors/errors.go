@@ -2,6 +2,7 @@ package errors
 
 import (
 	"encoding/json"
+	stderrors "errors"
 	"fmt"
 	"net/http"
 )
@@ -11,21 +12,27 @@ type ErrorCode string
 
 // Error codes
 const (
-	ErrInvalidFormat     ErrorCode = "INVALID_FORMAT"
-	ErrInvalidSize       ErrorCode = "INVALID_SIZE"
-	ErrProcessingFailed  ErrorCode = "PROCESSING_FAILED"
-	ErrInvalidMIME       ErrorCode = "INVALID_MIME"
-	ErrOptimizationFailed ErrorCode = "OPTIMIZATION_FAILED"
-	ErrResizeFailed      ErrorCode = "RESIZE_FAILED"
-	ErrBackgroundRemoval ErrorCode = "BACKGROUND_REMOVAL_FAILED"
+	ErrInvalidFormat       ErrorCode = "INVALID_FORMAT"
+	ErrInvalidSize         ErrorCode = "INVALID_SIZE"
+	ErrProcessingFailed    ErrorCode = "PROCESSING_FAILED"
+	ErrInvalidMIME         ErrorCode = "INVALID_MIME"
+	ErrOptimizationFailed  ErrorCode = "OPTIMIZATION_FAILED"
+	ErrResizeFailed        ErrorCode = "RESIZE_FAILED"
+	ErrBackgroundRemoval   ErrorCode = "BACKGROUND_REMOVAL_FAILED"
 	ErrPDFConversionFailed ErrorCode = "PDF_CONVERSION_FAILED"
+	ErrInvalidSignature    ErrorCode = "INVALID_SIGNATURE"
+	ErrSourceNotFound      ErrorCode = "SOURCE_NOT_FOUND"
+	ErrSourceUnavailable   ErrorCode = "SOURCE_UNAVAILABLE"
+	ErrUnauthorized        ErrorCode = "UNAUTHORIZED"
+	ErrNotFound            ErrorCode = "NOT_FOUND"
+	ErrQueueFull           ErrorCode = "QUEUE_FULL"
 )
 
 // AppError represents an application error
 type AppError struct {
 	Code    ErrorCode `json:"code"`
 	Message string    `json:"message"`
-	err     error    // Internal error (not exposed in JSON)
+	err     error     // Internal error (not exposed in JSON)
 }
 
 func (e *AppError) Error() string {
@@ -44,6 +51,16 @@ func New(code ErrorCode, message string, err error) *AppError {
 	}
 }
 
+// Wrap returns the AppError err already carries, so specific failures deep
+// in a call chain keep their code, or a new AppError otherwise
+func Wrap(code ErrorCode, message string, err error) *AppError {
+	var appErr *AppError
+	if stderrors.As(err, &appErr) {
+		return appErr
+	}
+	return New(code, message, err)
+}
+
 // Response represents the standard API response
 type Response struct {
 	Success bool        `json:"success"`
@@ -75,7 +92,17 @@ func getHTTPCode(code ErrorCode) int {
 		return http.StatusBadRequest
 	case ErrProcessingFailed, ErrOptimizationFailed, ErrResizeFailed, ErrBackgroundRemoval:
 		return http.StatusUnprocessableEntity
+	case ErrInvalidSignature:
+		return http.StatusForbidden
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrSourceNotFound, ErrNotFound:
+		return http.StatusNotFound
+	case ErrSourceUnavailable:
+		return http.StatusBadGateway
+	case ErrQueueFull:
+		return http.StatusServiceUnavailable
 	default:
 		return http.StatusInternalServerError
 	}
-} 
\ No newline at end of file
+}
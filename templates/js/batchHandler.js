@@ -56,7 +56,9 @@ document.addEventListener("DOMContentLoaded", function () {
             const isImage = file.type.startsWith("image/");
             const isHeic = file.name.toLowerCase().endsWith('.heic') || 
                           file.name.toLowerCase().endsWith('.heif');
-            return isImage || isHeic;
+            // The server expands archives into their images
+            const isArchive = /\.(zip|tar|tgz|tar\.gz)$/i.test(file.name);
+            return isImage || isHeic || isArchive;
         });
         
         if (files.length === 0) {
@@ -145,37 +147,37 @@ document.addEventListener("DOMContentLoaded", function () {
 
     async function processIndividualFiles(options) {
         const total = state.files.length;
-        let processed = 0;
-        let errors = [];
+        const formData = new FormData();
+        state.files.forEach(file => {
+            formData.append("images", file);
+        });
+
+        // Add processing options
+        for (const [key, value] of Object.entries(options)) {
+            formData.append(key, value);
+        }
+
+        // The server processes the whole batch and answers with a ZIP
+        elements.batchProgressCount.textContent = `Processing ${total} files...`;
 
         try {
-            for (const file of state.files) {
-                const formData = new FormData();
-                formData.append("image", file);
-                
-                // Add processing options
-                for (const [key, value] of Object.entries(options)) {
-                    formData.append(key, value);
-                }
+            const response = await fetch("/process/batch", {
+                method: "POST",
+                body: formData
+            });
 
-                try {
-                    await processFile(formData);
-                    processed++;
-                } catch (error) {
-                    errors.push(`Failed to process ${file.name}: ${error.message}`);
-                }
-                
-                updateProgress(processed, total);
+            if (!response.ok) {
+                const error = await response.json();
+                throw new Error(error.error?.message || "Batch processing failed");
             }
 
-            if (errors.length > 0) {
-                alert(`Batch processing completed with ${errors.length} errors:\n${errors.join('\n')}`);
-            } else {
-                alert("Batch processing completed successfully!");
-            }
+            const blob = await response.blob();
+            updateProgress(total, total);
+            downloadFile(blob, `processed_${Date.now()}.zip`);
+            alert("Batch processing completed! Files that could not be processed are listed in manifest.json inside the ZIP.");
         } catch (error) {
             console.error("Batch processing error:", error);
-            alert("An error occurred during batch processing");
+            alert("Batch processing failed: " + error.message);
         }
     }
 
@@ -209,57 +211,6 @@ document.addEventListener("DOMContentLoaded", function () {
         }
     }
 
-    async function processFile(formData) {
-        try {
-            const response = await fetch("/process", {
-                method: "POST",
-                body: formData
-            });
-
-            if (!response.ok) {
-                const error = await response.json();
-                throw new Error(error.message || "Processing failed");
-            }
-
-            const blob = await response.blob();
-            const originalName = formData.get("image").name;
-            const format = formData.get("format") || "jpeg";
-            
-            // Get the original file extension
-            const originalExt = originalName.split('.').pop();
-            
-            // Create the new filename
-            const baseName = originalName.replace(`.${originalExt}`, '');
-            let filename = `processed_${baseName}.${format}`;
-            
-            // Set the correct content type based on the format
-            const contentType = getContentType(format);
-            const processedBlob = new Blob([blob], { type: contentType });
-            
-            downloadFile(processedBlob, filename);
-            return true;
-        } catch (error) {
-            console.error(`Error processing file: ${error.message}`);
-            throw error;
-        }
-    }
-
-    function getContentType(format) {
-        const contentTypes = {
-            'jpeg': 'image/jpeg',
-            'jpg': 'image/jpeg',
-            'png': 'image/png',
-            'webp': 'image/webp',
-            'gif': 'image/gif',
-            'bmp': 'image/bmp',
-            'heic': 'image/heic',
-            'heif': 'image/heif',
-            'ico': 'image/x-icon',
-            'pdf': 'application/pdf'
-        };
-        return contentTypes[format] || 'application/octet-stream';
-    }
-
     function downloadFile(blob, filename) {
         const url = URL.createObjectURL(blob);
         const a = document.createElement("a");
@@ -9,6 +9,10 @@ document.addEventListener("DOMContentLoaded", function () {
     heightInput: document.getElementById("heightInput"),
     removeBackground: document.getElementById("removeBackground"),
     bgRemovalOptions: document.getElementById("bgRemovalOptions"),
+    bgMethodSelect: document.getElementById("bgMethodSelect"),
+    bgToleranceInput: document.getElementById("bgToleranceInput"),
+    bgFeatherInput: document.getElementById("bgFeatherInput"),
+    bgColorInput: document.getElementById("bgColorInput"),
     resizeModeSelect: document.getElementById("resizeModeSelect"),
     optimize: document.getElementById("optimize")
   };
@@ -165,6 +169,16 @@ document.addEventListener("DOMContentLoaded", function () {
     }
     if (elements.removeBackground?.checked) {
       formData.append("removeBackground", "true");
+      formData.append("bgMethod", elements.bgMethodSelect?.value || "auto");
+      if (elements.bgToleranceInput?.value) {
+        formData.append("bgTolerance", elements.bgToleranceInput.value);
+      }
+      if (elements.bgFeatherInput?.value) {
+        formData.append("bgFeather", elements.bgFeatherInput.value);
+      }
+      if (elements.bgMethodSelect?.value === "chroma" && elements.bgColorInput?.value) {
+        formData.append("bgColor", elements.bgColorInput.value);
+      }
     }
     if (elements.optimize?.checked) {
       formData.append("optimize", "true");
@@ -200,7 +214,12 @@ document.addEventListener("DOMContentLoaded", function () {
             throw new Error(errorData.error?.message || errorData.message || "Processing failed");
         }
 
-        await handleSuccess(response, elements.formatSelect?.value || "jpeg");
+        // With "auto" the server decides, so take the format from the response
+        const contentType = response.headers.get("Content-Type") || "";
+        const format = contentType.startsWith("image/")
+            ? contentType.slice("image/".length)
+            : elements.formatSelect?.value || "jpeg";
+        await handleSuccess(response, format);
     } catch (error) {
         console.error("Processing error:", error);
         showError(error.message || "Failed to process image");